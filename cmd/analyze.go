@@ -15,6 +15,7 @@
 package cmd
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
@@ -29,7 +30,12 @@ import (
 	"github.com/tetratelabs/istio-cost-analyzer/pkg"
 )
 
-const prometheusEndpoint = "http://localhost:9990"
+// prometheus is port-forwarded to prometheusPort on localhost, or to the ports after it
+// when analyzing several clusters.
+const (
+	prometheusHost = "http://localhost"
+	prometheusPort = 9990
+)
 
 var (
 	cloud             string
@@ -42,11 +48,38 @@ var (
 	analyzerNamespace string
 	targetNamespace   string
 	analyzeAll        bool
+	useOperator       bool
+	dryRun            bool
+	render            string
+	renderDir         string
+	valuesPath        string
+	webhookValues     pkg.WebhookValues
+	webhookReplicas   int32
+	webhookTimeout    int32
+	backfillTimeout   time.Duration
+	certManager       bool
+	certManagerIssuer string
+	certIssuerKind    string
 	operatorName      string
 	operatorNamespace string
 	kubeconfig        string
+	fetchLatest       bool
+	egressGateways    []string
+	ingressGateways   []string
+	contexts          []string
+	clustersPath      string
+	eastWestGateway   string
+	istioNamespace    string
+	resolveOwners     bool
+	inferLocality     bool
+	localityCacheDir  string
+	localityCacheAge  time.Duration
+	reportPath        string
+	priceSheetOpts    = pkg.DefaultPriceSheetOptions()
 )
 
+// these are only used when --fetchLatestPricing is set; by default the price sheets
+// embedded in the binary are used.
 // todo these should change to tetrate-hosted s3 files, with which we can send over cluster information
 // 	to track usage patterns.
 const (
@@ -59,40 +92,42 @@ var analyzeCmd = &cobra.Command{
 	Short: "List all the service links in the mesh",
 	Long:  ``,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		kubeClient := pkg.NewAnalyzerKube(kubeconfig)
-		// if a custom price path isn't provided, use the default price path for the cloud
-		// the cluster is on.
+		clusters, err := analyzedClusters()
+		if err != nil {
+			return err
+		}
+		kubeClient := pkg.NewAnalyzerKubeForContext(kubeconfig, clusters[0].Context)
+		// if a custom price path isn't provided, use the embedded price sheet for the cloud
+		// the cluster is on, or the latest one from GitHub if asked to.
 		if pricePath == "" {
 			if cloud == "" {
 				cloud = string(kubeClient.InferCloud())
 			}
 			cloud = strings.ToUpper(cloud)
-			if pkg.Cloud(cloud).IsGCP() {
-				pricePath = gcpPricingLocation
-			} else if pkg.Cloud(cloud).IsAWS() {
-				pricePath = awsPricingLocation
-			} else {
+			if !pkg.Cloud(cloud).IsGCP() && !pkg.Cloud(cloud).IsAWS() {
 				// we don't have a price path or cloud, so fail
 				fmt.Println("when no price path is provided, the only supported clouds are gcp and aws. couldn't infer cloud info.")
 				return errors.New("provide different cloud")
 			}
 			fmt.Printf("found cloud: %s\n", cloud)
-		}
-		fmt.Printf("using pricing file: %s\n", pricePath)
-		analyzerProm, err := pkg.NewAnalyzerProm(prometheusEndpoint, cloud)
-		if err != nil {
-			return err
+			if fetchLatest {
+				pricePath = gcpPricingLocation
+				if pkg.Cloud(cloud).IsAWS() {
+					pricePath = awsPricingLocation
+				}
+			}
 		}
 		// initialize analyzer
-		cost, err := pkg.NewCostAnalysis(pricePath)
-		if err != nil {
-			return err
+		var cost *pkg.CostAnalysis
+		if pricePath == "" {
+			cost, err = pkg.NewEmbeddedCostAnalysis(pkg.Cloud(cloud), priceSheetOpts)
+		} else {
+			cost, err = pkg.NewCostAnalysisWithOptions(pricePath, priceSheetOpts)
 		}
-		// port-forward prometheus asynchronously and wait for it to be ready
-		go analyzerProm.PortForwardProm(promNs)
-		if err := analyzerProm.WaitForProm(); err != nil {
+		if err != nil {
 			return err
 		}
+		fmt.Printf("using price sheet: %s\n", cost.SheetInfo())
 		var endTime time.Time
 		var startTime *time.Time
 		if end == "" {
@@ -112,10 +147,37 @@ var analyzeCmd = &cobra.Command{
 			}
 			startTime = &st
 		}
-		// query prometheus for raw pod calls
-		localityCalls, err := analyzerProm.GetCalls(startTime, &endTime)
-		if err != nil {
-			return err
+		// gather calls from each cluster's prometheus
+		clusterCalls := make([][]*pkg.Call, 0, len(clusters))
+		gatewayLocalities := make(map[string]map[string]int)
+		for i, c := range clusters {
+			clusterKube := kubeClient
+			if i > 0 {
+				clusterKube = pkg.NewAnalyzerKubeForContext(kubeconfig, c.Context)
+			}
+			calls, err := clusterLocalityCalls(i, c, clusterKube, cost, startTime, endTime)
+			if err != nil {
+				return err
+			}
+			clusterCalls = append(clusterCalls, calls)
+			if len(clusters) == 1 {
+				continue
+			}
+			// find where each cluster's east-west gateway runs, to price cross-cluster traffic
+			id := c.ClusterID
+			if id == "" {
+				if id, err = clusterKube.MeshClusterID(istioNamespace); err != nil {
+					return err
+				}
+			}
+			if gatewayLocalities[id], err = clusterKube.WorkloadLocalities(eastWestGateway, cloud); err != nil {
+				return err
+			}
+		}
+		// count calls reported by both sidecars, or by several clusters, once
+		localityCalls := pkg.MergeClusterCalls(clusterCalls)
+		if len(clusters) > 1 {
+			localityCalls = pkg.SplitEastWestCalls(localityCalls, eastWestGateway, gatewayLocalities)
 		}
 		// transform raw pod calls to locality information
 		localityCalls, err = kubeClient.CollapseLocalityCalls(localityCalls)
@@ -127,11 +189,134 @@ var analyzeCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		pkg.PrintCostTable(localityCalls, totalCost, details)
+		localityCalls = pkg.CollapseDays(localityCalls)
+		fmt.Printf("\nPrice sheet: %s\n", cost.SheetInfo())
+		fmt.Printf("Currency: %s\n", cost.CurrencyInfo())
+		pkg.PrintCostTable(localityCalls, totalCost, cost.Currency(), details)
+		if reportPath != "" {
+			return writeReport(reportPath, cost.Report(localityCalls, totalCost))
+		}
 		return nil
 	},
 }
 
+// writeReport writes report to path as JSON.
+func writeReport(path string, report *pkg.CostReport) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		fmt.Printf("unable to write report to %v: %v\n", path, err)
+		return err
+	}
+	fmt.Printf("Report written to %v\n", path)
+	return nil
+}
+
+// analyzedClusters returns the clusters to analyze, from --clusters or --contexts. Without
+// either, only the current context is analyzed.
+func analyzedClusters() ([]pkg.Cluster, error) {
+	clusters := make([]pkg.Cluster, 0)
+	if clustersPath != "" {
+		var err error
+		if clusters, err = pkg.LoadClusters(clustersPath); err != nil {
+			return nil, err
+		}
+	}
+	for _, c := range contexts {
+		clusters = append(clusters, pkg.Cluster{Context: c})
+	}
+	if len(clusters) == 0 {
+		clusters = append(clusters, pkg.Cluster{})
+	}
+	for i := range clusters {
+		if clusters[i].PrometheusNamespace == "" {
+			clusters[i].PrometheusNamespace = promNs
+		}
+	}
+	return clusters, nil
+}
+
+// clusterLocalityCalls queries the i-th cluster's prometheus for raw pod calls, and resolves
+// the localities and hosts of its gateways. Each cluster's prometheus is port-forwarded to
+// its own local port.
+func clusterLocalityCalls(i int, c pkg.Cluster, kubeClient *pkg.KubeClient, cost *pkg.CostAnalysis, startTime *time.Time, endTime time.Time) ([]*pkg.Call, error) {
+	analyzerProm, err := pkg.NewAnalyzerProm(fmt.Sprintf("%v:%v", prometheusHost, prometheusPort+i), cloud)
+	if err != nil {
+		return nil, err
+	}
+	if c.Context != "" {
+		fmt.Printf("analyzing cluster %v\n", c.Context)
+		analyzerProm.SetKubeContext(c.Context)
+	}
+	// port-forward prometheus asynchronously and wait for it to be ready
+	go analyzerProm.PortForwardProm(c.PrometheusNamespace)
+	if err := analyzerProm.WaitForProm(); err != nil {
+		return nil, err
+	}
+	analyzerProm.SetEgressGateways(egressGateways)
+	analyzerProm.SetIngressGateways(ingressGateways)
+	if inferLocality {
+		// place pods by their nodes, remembering pods that have since gone away
+		cachePath := ""
+		if localityCacheDir != "" {
+			name := c.Context
+			if name == "" {
+				name = "default"
+			}
+			cachePath = filepath.Join(localityCacheDir, name+".json")
+		}
+		cache, err := pkg.LoadLocalityCache(cachePath)
+		if err != nil {
+			return nil, err
+		}
+		if err := kubeClient.UpdateLocalityCache(cache, cloud); err != nil {
+			return nil, err
+		}
+		cache.Prune(localityCacheAge, time.Now())
+		if err := cache.Save(); err != nil {
+			fmt.Printf("unable to save locality cache: %v\n", err)
+		}
+		analyzerProm.SetInferredLocalities(cache)
+	}
+	// query prometheus for raw pod calls. if rates changed over time, traffic
+	// is queried per day so each day is priced with the rates in effect then.
+	var localityCalls []*pkg.Call
+	if cost.TimeVersioned() && startTime != nil {
+		localityCalls, err = analyzerProm.GetDailyCalls(*startTime, endTime)
+	} else {
+		localityCalls, err = analyzerProm.GetCalls(startTime, &endTime)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if cost.TimeVersioned() && startTime == nil {
+		// without a start, we can't split by day, so use the rates at the end of the window.
+		for _, c := range localityCalls {
+			c.Day = endTime.UTC().Truncate(24 * time.Hour)
+		}
+	}
+	// gateways may not report their own locality, so look up where they run
+	localityCalls, err = kubeClient.ResolveGatewayLocalities(localityCalls, cloud)
+	if err != nil {
+		return nil, err
+	}
+	// attribute ingress traffic to the public hosts routed to its destination
+	if len(ingressGateways) > 0 {
+		if err := kubeClient.ResolveIngressHosts(localityCalls); err != nil {
+			return nil, err
+		}
+	}
+	// report workloads by their top-level controller
+	if resolveOwners {
+		if err := kubeClient.ResolveOwners(localityCalls); err != nil {
+			return nil, err
+		}
+	}
+	return localityCalls, nil
+}
+
 func init() {
 	defaultKube := ""
 	if os.Getenv("KUBECONFIG") == "" {
@@ -140,26 +325,83 @@ func init() {
 	} else {
 		defaultKube = os.Getenv("KUBECONFIG")
 	}
+	defaultPriceCache, defaultLocalityCache := "", ""
+	if dir, err := os.UserCacheDir(); err == nil {
+		defaultPriceCache = filepath.Join(dir, "istio-cost-analyzer", "pricing")
+		defaultLocalityCache = filepath.Join(dir, "istio-cost-analyzer", "localities")
+	}
 	// setup/destroy need this
 	rootCmd.PersistentFlags().StringVar(&operatorName, "operatorName", "", "name of your istio operator. If not set, cost tool will use the first operator found in the istio-system namespace")
 	rootCmd.PersistentFlags().StringVar(&operatorNamespace, "operatorNamespace", "istio-system", "namespace of your istio operator")
+	rootCmd.PersistentFlags().StringVar(&istioNamespace, "istioNamespace", "istio-system", "root namespace of the mesh, where istiod runs. setup creates its Telemetry resource here, and analyze looks up each cluster's name in the mesh here.")
 
 	analyzeCmd.PersistentFlags().StringVar(&pricePath, "pricePath", "", "if custom egress rates are provided, dapani will use the rates in this file.")
+	analyzeCmd.PersistentFlags().BoolVar(&fetchLatest, "fetchLatestPricing", false, "if true, download the latest price sheet for the cloud from GitHub instead of using the one embedded in the binary.")
+	analyzeCmd.PersistentFlags().StringVar(&priceSheetOpts.CacheDir, "priceSheetCacheDir", defaultPriceCache, "directory remote price sheets are cached in. if empty, remote price sheets aren't cached.")
+	analyzeCmd.PersistentFlags().StringVar(&priceSheetOpts.SHA256, "priceSheetSHA256", "", "if provided, the price sheet must have this hex-encoded sha256 checksum.")
+	analyzeCmd.PersistentFlags().DurationVar(&priceSheetOpts.Timeout, "priceSheetTimeout", priceSheetOpts.Timeout, "timeout for downloading a remote price sheet.")
+	analyzeCmd.PersistentFlags().DurationVar(&priceSheetOpts.MaxAge, "priceSheetMaxAge", 30*24*time.Hour, "if a remote price sheet can't be downloaded, a cached copy older than this is an error. 0 means no limit.")
+	analyzeCmd.PersistentFlags().StringVar(&priceSheetOpts.OverlayPath, "priceOverlay", "", "if provided, negotiated discounts/rates in this file are applied on top of the price sheet. See /pricing.")
+	analyzeCmd.PersistentFlags().StringVar((*string)(&priceSheetOpts.Currency), "currency", "", "currency to report costs in, like EUR. defaults to the price sheet's currency (USD for the default sheets).")
+	analyzeCmd.PersistentFlags().StringVar(&priceSheetOpts.ExchangeRatesPath, "exchangeRates", "", "local exchange rate file, needed if --currency differs from the price sheet's currency. See /pricing.")
+	analyzeCmd.PersistentFlags().StringSliceVar(&contexts, "contexts", nil, "comma-separated kubeconfig contexts of the clusters of a multi-cluster mesh to analyze together. defaults to the current context.")
+	analyzeCmd.PersistentFlags().StringVar(&clustersPath, "clusters", "", "file listing the clusters of a multi-cluster mesh to analyze together, instead of --contexts. See README.")
+	analyzeCmd.PersistentFlags().StringVar(&eastWestGateway, "eastWestGateway", "istio-eastwestgateway", "workload name of the east-west gateways traffic between clusters goes through.")
+	analyzeCmd.PersistentFlags().BoolVar(&inferLocality, "inferLocality", false, "if true, infer localities from the nodes pods run on instead of the locality labels set up by setup. gives an estimate without changing the cluster.")
+	analyzeCmd.PersistentFlags().StringVar(&localityCacheDir, "localityCacheDir", defaultLocalityCache, "directory the pod localities seen with --inferLocality are kept in, to place traffic from pods that no longer exist. if empty, nothing is kept.")
+	analyzeCmd.PersistentFlags().DurationVar(&localityCacheAge, "localityCacheMaxAge", 15*24*time.Hour, "pods not seen running for longer than this are dropped from the locality cache. should cover the analysis window. 0 keeps them forever.")
+	analyzeCmd.PersistentFlags().BoolVar(&resolveOwners, "resolveOwners", false, "if true, workloads are reported by their top-level controller (like Deployment/reviews-v1 or CronJob/backup), found through ownerReferences.")
+	analyzeCmd.PersistentFlags().StringSliceVar(&egressGateways, "egressGateways", []string{"istio-egressgateway"}, "workloads that are egress gateways. traffic to them is priced as the first hop of internet egress.")
+	analyzeCmd.PersistentFlags().StringSliceVar(&ingressGateways, "ingressGateways", []string{"istio-ingressgateway"}, "workloads that are ingress gateways. traffic from them to backends is attributed to the public host it was addressed to.")
+	analyzeCmd.PersistentFlags().BoolVar(&priceSheetOpts.LoadBalancer, "loadBalancer", false, "if true, ingress traffic enters through a cloud load balancer, and its per-GB processing charge is added.")
+	analyzeCmd.PersistentFlags().BoolVar(&priceSheetOpts.NATGateway, "natGateway", false, "if true, internet egress goes through a cloud NAT, and its per-GB processing charge is added.")
 	analyzeCmd.PersistentFlags().StringVar(&queryBefore, "queryBefore", "0s", "if provided a time duration (go format), dapani will only use data from that much time ago and before.")
+	analyzeCmd.PersistentFlags().StringVar(&reportPath, "report", "", "if provided, the costs are also written to this file as JSON, with the currency and exchange rate they're in.")
 	analyzeCmd.PersistentFlags().BoolVar(&details, "details", false, "if true, tool will provide a more detailed view of egress costs, including both destination and source")
 	analyzeCmd.PersistentFlags().StringVar(&promNs, "prometheusNamespace", "istio-system", "promNs that the prometheus pod lives in, if different from analyzerNamespace")
 	analyzeCmd.PersistentFlags().StringVar(&start, "start", "", "if provided, the cost analyzer will analyze costs from this time onwards")
 	analyzeCmd.PersistentFlags().StringVar(&end, "end", "", "if provided, the cost analyzer will analyze costs up to this time")
 
+	topologyCmd.PersistentFlags().StringVarP(&topologyNamespace, "namespace", "n", "", "namespace to show workloads of. defaults to all namespaces.")
+	topologyCmd.PersistentFlags().BoolVar(&topologyCallers, "callers", true, "if true, query prometheus for the zones each workload is called from, and flag those without replicas.")
+	topologyCmd.PersistentFlags().StringVar(&promNs, "prometheusNamespace", "istio-system", "namespace that the prometheus pod lives in")
+	doctorCmd.PersistentFlags().StringVar(&promNs, "prometheusNamespace", "istio-system", "namespace that the prometheus pod lives in")
 	rootCmd.PersistentFlags().StringVar(&cloud, "cloud", "", "aws/gcp/azure are provided by default. if nothing is set, cloud info is inferred.")
 	rootCmd.PersistentFlags().StringVar(&analyzerNamespace, "analyzerNamespace", "istio-system", "namespace that the cost analyzer and associated resources lives in")
 	webhookSetupCmd.PersistentFlags().StringVar(&targetNamespace, "targetNamespace", "default", "namespace that the cost analyzer will analyze")
 	rootCmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", defaultKube, "path to kubeconfig file")
 
 	destroyCmd.PersistentFlags().BoolVarP(&destroyOperator, "destroyOperator", "o", false, "if true, cost analyzer will destroy the istio operator config that it created")
+	webhookSetupCmd.PersistentFlags().BoolVar(&useOperator, "useOperator", false, "if true, edit the istio operator even if the istio telemetry API is available.")
+	webhookSetupCmd.PersistentFlags().BoolVar(&dryRun, "dry-run", false, "if true, print what setup would change in the cluster, without changing anything.")
+	webhookSetupCmd.PersistentFlags().StringVar(&render, "render", "", "if set to yaml or kustomize, write the manifests setup would apply instead of applying them, without needing a cluster.")
+	webhookSetupCmd.PersistentFlags().StringVar(&renderDir, "renderDir", "istio-cost-analyzer", "directory the kustomize base is written to, with --render kustomize.")
+	webhookSetupCmd.PersistentFlags().StringVar(&valuesPath, "values", "", "yaml file customizing the webhook deployment, like its images, resources and scheduling. flags below override it. See README.")
+	webhookSetupCmd.PersistentFlags().StringVar(&webhookValues.Image, "image", "", "image of the webhook server, like registry.example.com/cost-analyzer-mutating-webhook@sha256:<digest>.")
+	webhookSetupCmd.PersistentFlags().StringVar(&webhookValues.CAImage, "caImage", "", "image of the init container generating the webhook's certificate.")
+	webhookSetupCmd.PersistentFlags().StringVar((*string)(&webhookValues.ImagePullPolicy), "imagePullPolicy", "", "pull policy of the webhook images. defaults to IfNotPresent for images pinned to a digest, and Always otherwise.")
+	webhookSetupCmd.PersistentFlags().StringSliceVar(&webhookValues.ImagePullSecrets, "imagePullSecrets", nil, "comma-separated secrets in the analyzer namespace to pull the webhook images with.")
+	webhookSetupCmd.PersistentFlags().Int32Var(&webhookReplicas, "replicas", 0, "replicas of the webhook deployment. defaults to 1.")
+	webhookSetupCmd.PersistentFlags().StringToStringVar(&webhookValues.NodeSelector, "nodeSelector", nil, "node selector of the webhook pods, like kubernetes.io/os=linux.")
+	webhookSetupCmd.PersistentFlags().StringVar(&webhookValues.PriorityClassName, "priorityClassName", "", "priority class of the webhook pods.")
+	webhookSetupCmd.PersistentFlags().StringVar((*string)(&webhookValues.FailurePolicy), "failurePolicy", "", "Ignore or Fail: whether deployments are created unchanged or rejected when the webhook can't be called. defaults to Ignore.")
+	webhookSetupCmd.PersistentFlags().Int32Var(&webhookTimeout, "timeoutSeconds", 0, "seconds the API server waits for the webhook, from 1 to 30. defaults to 5.")
+	webhookSetupCmd.PersistentFlags().BoolVar(&webhookValues.Backfill.Enabled, "backfill", false, "if true, the webhook annotates the workloads that already exist, restarting their pods a batch at a time. otherwise only new workloads are annotated.")
+	webhookSetupCmd.PersistentFlags().Int32Var(&webhookValues.Backfill.BatchSize, "backfillBatchSize", 0, "workloads the backfill restarts at a time, waiting for their rollouts. defaults to 1.")
+	webhookSetupCmd.PersistentFlags().DurationVar(&backfillTimeout, "backfillRolloutTimeout", 0, "how long the backfill waits for a rollout before it stops. defaults to 10m.")
+	webhookSetupCmd.PersistentFlags().StringVar(&webhookValues.Backfill.Window, "backfillWindow", "", "daily maintenance window the backfill restarts workloads in, in UTC, like 22:00-04:00. if empty, any time.")
+	webhookSetupCmd.PersistentFlags().BoolVar(&certManager, "certManager", false, "if true, have cert-manager issue the webhook's certificate and inject its CA, instead of the webhook generating and rotating it.")
+	webhookSetupCmd.PersistentFlags().StringVar(&certManagerIssuer, "certManagerIssuer", "", "cert-manager issuer of the webhook's certificate, with --certManager. if empty, a self-signed Issuer is created.")
+	webhookSetupCmd.PersistentFlags().StringVar(&certIssuerKind, "certManagerIssuerKind", "Issuer", "kind of --certManagerIssuer, Issuer or ClusterIssuer.")
 	webhookSetupCmd.PersistentFlags().BoolVarP(&analyzeAll, "analyzeAll", "a", false, "if true, cost analyzer will analyze all namespaces in the cluster")
+	rbacCmd.PersistentFlags().StringVar(&targetNamespace, "targetNamespace", "default", "namespace that the cost analyzer will analyze")
+	rbacCmd.PersistentFlags().BoolVarP(&analyzeAll, "analyzeAll", "a", false, "if true, cost analyzer will analyze all namespaces in the cluster")
+	rbacCmd.PersistentFlags().StringVarP(&rbacOutput, "output", "o", "text", "text or yaml.")
 
 	rootCmd.AddCommand(analyzeCmd)
 	rootCmd.AddCommand(webhookSetupCmd)
 	rootCmd.AddCommand(destroyCmd)
+	rootCmd.AddCommand(topologyCmd)
+	rootCmd.AddCommand(doctorCmd)
+	rootCmd.AddCommand(rbacCmd)
 }
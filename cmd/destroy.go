@@ -15,11 +15,9 @@
 package cmd
 
 import (
-	"context"
 	"fmt"
 
 	"github.com/spf13/cobra"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/tetratelabs/istio-cost-analyzer/pkg"
 )
@@ -29,41 +27,37 @@ var destroyOperator bool
 var destroyCmd = &cobra.Command{
 	Use:   "destroy",
 	Short: "Destroy the webhook object in kubernetes and delete the server container.",
-	Long:  "Destroying the webhook object in kubernetes and deleting the server container makes it so you don't have to manually change all the configuration",
+	Long: "Revert what setup changed, as recorded in the cost-analyzer-setup ConfigMap: delete the objects it created, " +
+		"remove the labels it added to namespaces and the istio operator edit, and remove the locality labels and " +
+		"extraStatTags annotations the webhook added to workloads and pods.",
+	SilenceUsage: true,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		kubeClient := pkg.NewAnalyzerKube(kubeconfig)
-		// todo make config names package-wide constants
-		// todo more visibility into errors
-		if err := kubeClient.Client().AppsV1().Deployments(analyzerNamespace).Delete(context.TODO(), "cost-analyzer-mutating-webhook", metav1.DeleteOptions{}); err != nil {
-			fmt.Println(err)
+		record, err := kubeClient.LoadSetupRecord(analyzerNamespace)
+		if err != nil {
+			cmd.PrintErrf("unable to load setup record: %v", err)
+			return err
 		}
-		if err := kubeClient.Client().CoreV1().Services(analyzerNamespace).Delete(context.TODO(), "cost-analyzer-mutating-webhook", metav1.DeleteOptions{}); err != nil {
-			fmt.Println(err)
-		}
-		if err := kubeClient.Client().AdmissionregistrationV1().MutatingWebhookConfigurations().Delete(context.TODO(), "cost-analyzer-mutating-webhook-configuration", metav1.DeleteOptions{}); err != nil {
-			fmt.Println(err)
-		}
-		if err := kubeClient.Client().RbacV1().ClusterRoleBindings().Delete(context.TODO(), "cost-analyzer-role-binding", metav1.DeleteOptions{}); err != nil {
-			fmt.Println(err)
-		}
-		if err := kubeClient.Client().RbacV1().ClusterRoles().Delete(context.TODO(), "cost-analyzer-service-role", metav1.DeleteOptions{}); err != nil {
-			fmt.Println(err)
-		}
-		if err := kubeClient.Client().CoreV1().ServiceAccounts(analyzerNamespace).Delete(context.TODO(), "cost-analyzer-sa", metav1.DeleteOptions{}); err != nil {
-			fmt.Println(err)
+		if record == nil {
+			// set up by a version that didn't keep a record
+			cmd.PrintErrf("no setup record in %v, reverting everything setup may have changed\n", analyzerNamespace)
+			if record, err = kubeClient.LegacySetupRecord(analyzerNamespace, istioNamespace); err != nil {
+				return err
+			}
 		}
-		if destroyOperator {
+		if destroyOperator && record.Operator == nil {
 			if operatorName == "" {
-				var err error
 				operatorName, err = kubeClient.GetDefaultOperator(operatorNamespace)
 				if err != nil {
-					fmt.Printf("not destroying operator: %v", err)
-					return nil
+					cmd.PrintErrf("unable to get default operator: %v", err)
+					return err
 				}
 			}
-			if err := kubeClient.DeleteOperatorConfig(operatorName, operatorNamespace); err != nil {
-				fmt.Println(err)
-			}
+			ref := pkg.OperatorRef(operatorName, operatorNamespace)
+			record.Operator = &ref
+		}
+		if failed := pkg.PrintReverted(cmd.OutOrStdout(), kubeClient.RevertSetup(analyzerNamespace, record)); failed > 0 {
+			return fmt.Errorf("%v changes failed to revert, run destroy again to retry them", failed)
 		}
 		return nil
 	},
@@ -0,0 +1,65 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tetratelabs/istio-cost-analyzer/pkg"
+)
+
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check the prerequisites of analyze",
+	Long:  "Check the webhook is running, namespaces and pods are labelled, istio reports destination_locality, and prometheus has series with valid localities, with hints to fix what isn't.",
+	// failed checks exit non-zero, but aren't usage errors
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kubeClient := pkg.NewAnalyzerKube(kubeconfig)
+		checks, targets := kubeClient.CheckWebhook(analyzerNamespace)
+		checks = append(checks,
+			kubeClient.CheckNamespaces(targets),
+			kubeClient.CheckPods(targets),
+			kubeClient.CheckTelemetry(istioNamespace, operatorName, operatorNamespace),
+			kubeClient.CheckBackfill(analyzerNamespace),
+		)
+		if cloud == "" {
+			cloud = string(kubeClient.InferCloud())
+		}
+		cloud = strings.ToUpper(cloud)
+		analyzerProm, err := pkg.NewAnalyzerProm(fmt.Sprintf("%v:%v", prometheusHost, prometheusPort), cloud)
+		if err != nil {
+			return err
+		}
+		// port-forward prometheus asynchronously and wait for it to be ready
+		go analyzerProm.PortForwardProm(promNs)
+		if err := analyzerProm.WaitForProm(); err != nil {
+			checks = append(checks, pkg.Check{
+				Name:   "prometheus",
+				Detail: fmt.Sprintf("unable to port-forward to deployment/prometheus in %v: %v", promNs, err),
+				Hint:   "set --prometheusNamespace to the namespace prometheus runs in",
+			})
+		} else {
+			checks = append(checks, analyzerProm.CheckMetrics()...)
+		}
+		if failed := pkg.PrintChecks(cmd.OutOrStdout(), checks); failed > 0 {
+			return fmt.Errorf("%v of %v checks failed", failed, len(checks))
+		}
+		return nil
+	},
+}
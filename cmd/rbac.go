@@ -0,0 +1,60 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tetratelabs/istio-cost-analyzer/pkg"
+)
+
+var rbacOutput string
+
+var rbacCmd = &cobra.Command{
+	Use:   "rbac",
+	Short: "Print the permissions setup grants the webhook.",
+	Long: "Print the roles setup binds the webhook's service account to for the given --targetNamespace or --analyzeAll, " +
+		"as a summary or, with --output yaml, as manifests. It doesn't need a cluster.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if rbacOutput != "text" && rbacOutput != "yaml" {
+			return fmt.Errorf("unknown --output %q, must be text or yaml", rbacOutput)
+		}
+		cfg := pkg.SetupConfig{AnalyzerNamespace: analyzerNamespace}
+		if !analyzeAll {
+			cfg.TargetNamespaces = strings.Split(targetNamespace, ",")
+		}
+		objects, err := pkg.NewSetupObjects(cfg)
+		if err != nil {
+			return err
+		}
+		if rbacOutput == "text" {
+			pkg.PrintRBAC(cmd.OutOrStdout(), objects)
+			return nil
+		}
+		manifests, err := objects.RBACManifests()
+		if err != nil {
+			return err
+		}
+		out, err := pkg.RenderYAML(manifests)
+		if err != nil {
+			return err
+		}
+		_, err = cmd.OutOrStdout().Write(out)
+		return err
+	},
+}
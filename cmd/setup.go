@@ -15,232 +15,334 @@
 package cmd
 
 import (
-	"bytes"
+	"fmt"
 	"strings"
 
 	"github.com/spf13/cobra"
-	v1 "k8s.io/api/apps/v1"
-	v12 "k8s.io/api/core/v1"
-	v13 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	k8Yaml "k8s.io/apimachinery/pkg/util/yaml"
 
 	"github.com/tetratelabs/istio-cost-analyzer/pkg"
 )
 
-var costAnalyzerSA = &v12.ServiceAccount{
-	ObjectMeta: metav1.ObjectMeta{
-		Name: "cost-analyzer-sa",
-	},
-}
-
-var costAnalyzerClusterRoleBinding = &v13.ClusterRoleBinding{
-	ObjectMeta: metav1.ObjectMeta{
-		Name: "cost-analyzer-role-binding",
-	},
-	RoleRef: v13.RoleRef{
-		APIGroup: "rbac.authorization.k8s.io",
-		Kind:     "ClusterRole",
-		Name:     "cost-analyzer-service-role",
-	},
-	Subjects: []v13.Subject{
-		{
-			Kind:      "ServiceAccount",
-			Name:      "cost-analyzer-sa",
-			Namespace: analyzerNamespace,
-		},
-	},
-}
-
-var costAnalyzerClusterRole = &v13.ClusterRole{
-	ObjectMeta: metav1.ObjectMeta{
-		Name: "cost-analyzer-service-role",
-	},
-	Rules: []v13.PolicyRule{
-		{
-			APIGroups: []string{"", "admissionregistration.k8s.io", "apps"},
-			Resources: []string{"mutatingwebhookconfigurations", "pods", "nodes", "deployments"},
-			Verbs:     []string{"get", "create", "patch", "list", "update"},
-		},
-	},
-}
-
 var webhookSetupCmd = &cobra.Command{
 	Use:   "setup",
 	Short: "Create the webhook object in kubernetes and deploy the server container.",
 	Long:  "Setting up a webhook to receive config changes makes it so you don't have to manually change all the configuration",
 	RunE: func(cmd *cobra.Command, args []string) error {
-		kubeClient := pkg.NewAnalyzerKube(kubeconfig)
-		//ic := kubeClient.IstioClient()
-		var err error
-		webhookDeployment := `
-kind: Deployment
-apiVersion: apps/v1
-metadata:
-  name: cost-analyzer-mutating-webhook
-spec:
-  replicas: 1
-  selector:
-    matchLabels:
-      app: cost-analyzer-mutating-webhook
-  template:
-    metadata:
-      labels:
-        app: cost-analyzer-mutating-webhook
-    spec:
-      initContainers:
-        - name: cost-analyzer-mutating-webhook-ca
-          image: adiprerepa/cost-analyzer-mutating-webhook-ca:latest
-          imagePullPolicy: Always
-          volumeMounts:
-            - mountPath: /etc/webhook/certs
-              name: certs
-          env:
-            - name: MUTATE_CONFIG
-              value: cost-analyzer-mutating-webhook-configuration
-            - name: WEBHOOK_SERVICE
-              value: cost-analyzer-mutating-webhook
-      containers:
-        - name: cost-analyzer-mutating-webhook
-          image: adiprerepa/cost-analyzer-mutating-webhook:latest
-          imagePullPolicy: Always
-          ports:
-            - containerPort: 443
-          volumeMounts:
-            - name: certs
-              mountPath: /etc/webhook/certs
-          resources: 
-            requests:
-              memory: "64Mi"
-              cpu: "250m"
-            limits:
-              memory: "128Mi"
-              cpu: "500m"
-      volumes:
-        - name: certs
-          emptyDir: {}
-      serviceAccountName: cost-analyzer-sa
-`
-		webhookService := `
-kind: Service
-apiVersion: v1
-metadata:
-  name: cost-analyzer-mutating-webhook
-spec:
-  selector:
-    app: cost-analyzer-mutating-webhook
-  ports:
-    - port: 443
-      protocol: TCP
-      targetPort: 443
-`
-		var sa *v12.ServiceAccount
-		var cr *v13.ClusterRole
-		var crb *v13.ClusterRoleBinding
-		var status bool
-		cmd.Println("creating webhook deployment/service and role/binding...")
-		if sa, err, status = kubeClient.CreateServiceAccount(costAnalyzerSA, analyzerNamespace); err != nil {
-			cmd.PrintErrf("unable to create service account: %v", err)
-			return err
-		} else {
-			if status {
-				cmd.Printf("service account %v already exists\n", costAnalyzerSA.Name)
-			} else {
-				cmd.Printf("service account %v created\n", sa.Name)
-			}
+		if render != "" && render != "yaml" && render != "kustomize" {
+			return fmt.Errorf("unknown --render format %q, must be yaml or kustomize", render)
 		}
-		if cr, err, status = kubeClient.CreateClusterRole(costAnalyzerClusterRole); err != nil {
-			cmd.PrintErrf("unable to create cluster role: %v", err)
-			return err
-		} else {
-			if status {
-				cmd.Printf("cluster role %v already exists\n", costAnalyzerClusterRole.Name)
-			} else {
-				cmd.Printf("cluster role %v created\n", cr.Name)
-			}
+		cfg := pkg.SetupConfig{
+			AnalyzerNamespace:     analyzerNamespace,
+			Cloud:                 cloud,
+			CertManager:           certManager,
+			CertManagerIssuer:     certManagerIssuer,
+			CertManagerIssuerKind: certIssuerKind,
 		}
-		// todo dont do this now and actually properly structure the stuff
-		costAnalyzerClusterRoleBinding.Subjects[0].Namespace = analyzerNamespace
-		if crb, err, status = kubeClient.CreateClusterRoleBinding(costAnalyzerClusterRoleBinding); err != nil {
-			cmd.PrintErrf("unable to create cluster role binding: %v", err)
-			return err
-		} else {
-			if status {
-				cmd.Printf("cluster role binding %v already exists\n", costAnalyzerClusterRoleBinding.Name)
-			} else {
-				cmd.Printf("cluster role binding %v created\n", crb.Name)
+		if !analyzeAll {
+			cfg.TargetNamespaces = strings.Split(targetNamespace, ",")
+		}
+		if valuesPath != "" {
+			values, err := pkg.LoadWebhookValues(valuesPath)
+			if err != nil {
+				return err
 			}
+			cfg.Webhook = values
 		}
-		depl := &v1.Deployment{}
-		decoder := k8Yaml.NewYAMLOrJSONDecoder(bytes.NewReader([]byte(webhookDeployment)), 1000)
-		if err = decoder.Decode(&depl); err != nil {
-			cmd.PrintErrf("unable to decode deployment: %v", err)
-			return err
+		if webhookReplicas != 0 {
+			webhookValues.Replicas = &webhookReplicas
 		}
-		if analyzeAll {
-			targetNamespace = ""
-		}
-		depl.Spec.Template.Spec.Containers[0].Env = []v12.EnvVar{{
-			Name:  "CLOUD",
-			Value: cloud,
-		}, {
-			Name:  "NAMESPACE",
-			Value: targetNamespace,
-		}}
-		depl.Spec.Template.Spec.InitContainers[0].Env = append(depl.Spec.Template.Spec.InitContainers[0].Env, v12.EnvVar{
-			Name:  "WEBHOOK_NAMESPACE",
-			Value: analyzerNamespace,
-		})
-		serv := &v12.Service{}
-		decoder = k8Yaml.NewYAMLOrJSONDecoder(bytes.NewReader([]byte(webhookService)), 1000)
-		if err = decoder.Decode(&serv); err != nil {
-			cmd.PrintErrf("unable to decode service: %v", err)
-			return err
+		if webhookTimeout != 0 {
+			webhookValues.TimeoutSeconds = &webhookTimeout
 		}
-		if serv, err, status = kubeClient.CreateService(serv, analyzerNamespace); err != nil {
-			cmd.PrintErrf("unable to create service: %v", err)
-			return err
-		} else {
-			if status {
-				cmd.Printf("service %v already exists\n", serv.Name)
-			} else {
-				cmd.Printf("service %v created\n", serv.Name)
-			}
+		if backfillTimeout != 0 {
+			webhookValues.Backfill.RolloutTimeout = &metav1.Duration{Duration: backfillTimeout}
 		}
-		if depl, err, status = kubeClient.CreateDeployment(depl, analyzerNamespace); err != nil {
-			cmd.PrintErrf("unable to create deployment: %v", err)
-			return err
-		} else {
-			if status {
-				cmd.Printf("deployment %v already exists\n", depl.Name)
+		cfg.Webhook.Override(webhookValues)
+		// rendering shouldn't need a cluster, so the telemetry API is assumed
+		if render != "" {
+			if !useOperator {
+				cfg.TelemetryNamespace = istioNamespace
 			} else {
-				cmd.Printf("deployment %v created\n", depl.Name)
+				cmd.PrintErrf("the istio operator edit can't be rendered, it has to be made separately\n")
 			}
+			objects, err := pkg.NewSetupObjects(cfg)
+			if err != nil {
+				return err
+			}
+			return renderSetup(cmd, objects)
 		}
 
-		// label namespaces with cost-analyzer-analysis-enabled=true
-		namespaces := strings.Split(targetNamespace, ",")
-		for _, namespace := range namespaces {
-			if err = kubeClient.LabelNamespace(namespace, "cost-analyzer-analysis-enabled", "true"); err != nil {
-				cmd.PrintErrf("unable to label namespace %v: %v", namespace, err)
+		kubeClient := pkg.NewAnalyzerKube(kubeconfig)
+		// have istio report the locality of the destination of requests, with the telemetry
+		// API if there is one, or else by editing the istio operator.
+		if !useOperator {
+			telemetryAPI, err := kubeClient.TelemetryAPIAvailable()
+			if err != nil {
+				cmd.PrintErrf("unable to discover the istio telemetry API: %v", err)
 				return err
 			}
+			if telemetryAPI {
+				if err := kubeClient.CheckMeshTelemetry(istioNamespace); err != nil {
+					cmd.PrintErrf("unable to add the locality telemetry: %v\n", err)
+					return err
+				}
+				cfg.TelemetryNamespace = istioNamespace
+			} else {
+				cmd.Printf("istio telemetry API not found, using the istio operator instead\n")
+			}
 		}
-
-		// istio operator setup
-		if operatorName == "" {
+		if cfg.TelemetryNamespace == "" && operatorName == "" {
 			// first healthy operator
+			var err error
 			operatorName, err = kubeClient.GetDefaultOperator(operatorNamespace)
 			if err != nil {
 				cmd.PrintErrf("unable to get default operator: %v", err)
 				return err
 			}
 		}
-		err = kubeClient.EditIstioOperator(operatorName, operatorNamespace)
+		// the webhook looks up the zone, or the region on aws, of the nodes pods run on
+		if cfg.Cloud == "" {
+			if inferred := kubeClient.InferCloud(); inferred == pkg.AWS || inferred == pkg.GCP {
+				cfg.Cloud = strings.ToLower(string(inferred))
+			}
+		}
+		objects, err := pkg.NewSetupObjects(cfg)
 		if err != nil {
-			cmd.PrintErrf("unable to edit Istio Operator: %v", err)
 			return err
 		}
-		return nil
+		if dryRun {
+			return planSetup(cmd, kubeClient, objects)
+		}
+		return applySetup(cmd, kubeClient, objects)
 	},
 }
+
+// applySetup server-side applies objects, and edits the istio operator if they don't
+// include a Telemetry resource. What it changes is saved to the setup record, for destroy.
+func applySetup(cmd *cobra.Command, kubeClient *pkg.KubeClient, objects *pkg.SetupObjects) (err error) {
+	manifests, err := objects.Manifests()
+	if err != nil {
+		return err
+	}
+	record, err := loadSetupRecord(cmd, kubeClient)
+	if err != nil {
+		return err
+	}
+	// save what was changed even if setup fails part way, so destroy can revert it
+	defer func() {
+		if saveErr := kubeClient.SaveSetupRecord(analyzerNamespace, record); saveErr != nil {
+			cmd.PrintErrf("unable to save setup record: %v", saveErr)
+			if err == nil {
+				err = saveErr
+			}
+		}
+	}()
+	changes, err := kubeClient.PlanManifests(withoutNamespaces(manifests))
+	if err != nil {
+		cmd.PrintErrf("unable to compare manifests to the cluster: %v", err)
+		return err
+	}
+	for _, c := range changes {
+		change := describeChange(c, record)
+		if err = kubeClient.ApplyManifest(c.Manifest); err != nil {
+			cmd.PrintErrf("unable to apply %v: %v", c.Manifest, err)
+			return err
+		}
+		if !c.Exists {
+			record.AddCreated(pkg.RefOf(c.Manifest))
+		}
+		record.SetApplied(c.Manifest)
+		cmd.Printf("%v: %v\n", c.Manifest, change)
+		if c.Exists {
+			cmd.Print(c.Diff)
+		}
+	}
+	for _, ref := range objects.Generated() {
+		record.AddGenerated(ref)
+	}
+	for _, kind := range objects.WorkloadKinds {
+		record.AddWorkloadKind(kind)
+	}
+
+	for _, ref := range record.Stale(manifests) {
+		if err = kubeClient.DeleteObject(ref); err != nil && !apierrors.IsNotFound(err) {
+			cmd.PrintErrf("unable to delete %v: %v", ref, err)
+			return err
+		}
+		record.RemoveCreated(ref)
+		cmd.Printf("%v: deleted, it isn't needed anymore\n", ref)
+	}
+
+	// label namespaces with cost-analyzer-analysis-enabled=true
+	for _, namespace := range objects.Namespaces {
+		labelled, err := kubeClient.LabelNamespace(namespace.Name, pkg.AnalysisEnabledLabel, "true")
+		if err != nil {
+			cmd.PrintErrf("unable to label namespace %v: %v", namespace.Name, err)
+			return err
+		}
+		if labelled {
+			record.AddLabelledNamespace(namespace.Name)
+			cmd.Printf("namespace %v: labelled\n", namespace.Name)
+		}
+	}
+	for _, namespace := range unlabelledNamespaces(objects, record) {
+		if err = kubeClient.UnlabelNamespace(namespace, pkg.AnalysisEnabledLabel); err != nil && !apierrors.IsNotFound(err) {
+			cmd.PrintErrf("unable to unlabel namespace %v: %v", namespace, err)
+			return err
+		}
+		record.RemoveLabelledNamespace(namespace)
+		cmd.Printf("namespace %v: unlabelled\n", namespace)
+	}
+
+	if objects.Telemetry != nil {
+		return nil
+	}
+	// istio operator setup, for meshes without the telemetry API
+	edited, err := kubeClient.EditIstioOperator(operatorName, operatorNamespace)
+	if err != nil {
+		cmd.PrintErrf("unable to edit Istio Operator: %v", err)
+		return err
+	}
+	if edited {
+		ref := pkg.OperatorRef(operatorName, operatorNamespace)
+		record.Operator = &ref
+		cmd.Printf("istio operator %v configured\n", operatorName)
+	} else {
+		cmd.Printf("istio operator %v already configured\n", operatorName)
+	}
+	return nil
+}
+
+// loadSetupRecord loads the record of previous setups, or an empty one.
+func loadSetupRecord(cmd *cobra.Command, kubeClient *pkg.KubeClient) (*pkg.SetupRecord, error) {
+	record, err := kubeClient.LoadSetupRecord(analyzerNamespace)
+	if err != nil {
+		cmd.PrintErrf("unable to load setup record: %v", err)
+		return nil, err
+	}
+	if record == nil {
+		record = &pkg.SetupRecord{}
+	}
+	return record, nil
+}
+
+// withoutNamespaces returns the manifests, except namespaces. Setup only labels
+// namespaces, it doesn't create them.
+func withoutNamespaces(manifests []pkg.Manifest) []pkg.Manifest {
+	filtered := make([]pkg.Manifest, 0, len(manifests))
+	for _, m := range manifests {
+		if m.Object.GetKind() != "Namespace" {
+			filtered = append(filtered, m)
+		}
+	}
+	return filtered
+}
+
+// unlabelledNamespaces returns the namespaces a previous setup labelled that aren't
+// targeted anymore. When all namespaces are analyzed, labels are left as they are.
+func unlabelledNamespaces(objects *pkg.SetupObjects, record *pkg.SetupRecord) []string {
+	if len(objects.Namespaces) == 0 {
+		return nil
+	}
+	targets := make(map[string]bool, len(objects.Namespaces))
+	for _, n := range objects.Namespaces {
+		targets[n.Name] = true
+	}
+	unlabelled := make([]string, 0)
+	for _, n := range record.LabelledNamespaces {
+		if !targets[n] {
+			unlabelled = append(unlabelled, n)
+		}
+	}
+	return unlabelled
+}
+
+// describeChange says what applying a manifest changes.
+func describeChange(c pkg.ManifestChange, record *pkg.SetupRecord) string {
+	switch {
+	case !c.Exists:
+		return "created"
+	case c.Diff == "":
+		return "unchanged"
+	case record.Drifted(c):
+		return "edited outside setup, reverted"
+	default:
+		return "updated"
+	}
+}
+
+// planSetup prints what setup would change, without changing anything.
+func planSetup(cmd *cobra.Command, kubeClient *pkg.KubeClient, objects *pkg.SetupObjects) error {
+	manifests, err := objects.Manifests()
+	if err != nil {
+		return err
+	}
+	record, err := loadSetupRecord(cmd, kubeClient)
+	if err != nil {
+		return err
+	}
+	changes, err := kubeClient.PlanManifests(manifests)
+	if err != nil {
+		cmd.PrintErrf("unable to compare manifests to the cluster: %v", err)
+		return err
+	}
+	for _, c := range changes {
+		switch {
+		case c.Manifest.Object.GetKind() == "Namespace" && !c.Exists:
+			cmd.Printf("%v: doesn't exist, setup will fail to label it\n", c.Manifest)
+			continue
+		case c.Manifest.Object.GetKind() == "Namespace" && c.Diff != "":
+			cmd.Printf("%v: labelled\n", c.Manifest)
+		default:
+			cmd.Printf("%v: %v\n", c.Manifest, describeChange(c, record))
+		}
+		cmd.Print(c.Diff)
+	}
+	for _, ref := range record.Stale(manifests) {
+		cmd.Printf("%v: deleted, it isn't needed anymore\n", ref)
+	}
+	for _, namespace := range unlabelledNamespaces(objects, record) {
+		cmd.Printf("namespace %v: unlabelled\n", namespace)
+	}
+	if objects.Telemetry != nil {
+		return nil
+	}
+	diff, err := kubeClient.PlanIstioOperator(operatorName, operatorNamespace)
+	if err != nil {
+		cmd.PrintErrf("unable to compare istio operator: %v", err)
+		return err
+	}
+	if diff == "" {
+		cmd.Printf("istiooperator %v/%v: unchanged\n", operatorNamespace, operatorName)
+		return nil
+	}
+	cmd.Printf("istiooperator %v/%v: outbound sidecar metrics edited\n", operatorNamespace, operatorName)
+	cmd.Print(diff)
+	return nil
+}
+
+// renderSetup writes the manifests of objects as yaml to stdout, or as a kustomize base
+// to --renderDir.
+func renderSetup(cmd *cobra.Command, objects *pkg.SetupObjects) error {
+	manifests, err := objects.Manifests()
+	if err != nil {
+		return err
+	}
+	if render == "kustomize" {
+		if err := pkg.RenderKustomize(manifests, renderDir); err != nil {
+			cmd.PrintErrf("unable to write kustomize base: %v", err)
+			return err
+		}
+		cmd.PrintErrf("kustomize base written to %v\n", renderDir)
+		return nil
+	}
+	out, err := pkg.RenderYAML(manifests)
+	if err != nil {
+		cmd.PrintErrf("unable to render manifests: %v", err)
+		return err
+	}
+	_, err = cmd.OutOrStdout().Write(out)
+	return err
+}
@@ -0,0 +1,67 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/tetratelabs/istio-cost-analyzer/pkg"
+)
+
+var (
+	topologyNamespace string
+	topologyCallers   bool
+)
+
+var topologyCmd = &cobra.Command{
+	Use:   "topology",
+	Short: "Show the zones each workload's replicas run in",
+	Long:  "Show the spread of each workload's replicas across zones, and flag workloads called from zones they have no replicas in, which forces that traffic across zones.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		kubeClient := pkg.NewAnalyzerKube(kubeconfig)
+		topologies, err := kubeClient.WorkloadTopologies(topologyNamespace)
+		if err != nil {
+			return err
+		}
+		if topologyCallers {
+			if cloud == "" {
+				cloud = string(kubeClient.InferCloud())
+			}
+			cloud = strings.ToUpper(cloud)
+			analyzerProm, err := pkg.NewAnalyzerProm(fmt.Sprintf("%v:%v", prometheusHost, prometheusPort), cloud)
+			if err != nil {
+				return err
+			}
+			// port-forward prometheus asynchronously and wait for it to be ready
+			go analyzerProm.PortForwardProm(promNs)
+			if err := analyzerProm.WaitForProm(); err != nil {
+				return err
+			}
+			endTime := time.Now()
+			calls, err := analyzerProm.GetCalls(nil, &endTime)
+			if err != nil {
+				return err
+			}
+			pkg.FlagUnservedCallers(topologies, calls)
+		}
+		fmt.Println()
+		pkg.PrintTopologyTable(topologies)
+		return nil
+	},
+}
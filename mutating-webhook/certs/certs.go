@@ -0,0 +1,328 @@
+// Package certs generates the webhook's serving certificate, keeps it in a Secret shared
+// by every replica, rotates it before it expires and keeps the caBundle of the
+// MutatingWebhookConfiguration in sync with it.
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	// Validity is how long generated certificates are valid for.
+	Validity = 365 * 24 * time.Hour
+	// RotateBefore is how long before it expires a certificate is replaced.
+	RotateBefore = 30 * 24 * time.Hour
+
+	// keys of the Secret, tls.crt and tls.key like a kubernetes.io/tls Secret.
+	caKey         = "ca.crt"
+	previousCAKey = "previous-ca.crt"
+)
+
+// Bundle is a serving certificate and key, and the CA that signed it, PEM encoded.
+type Bundle struct {
+	CA   []byte
+	Cert []byte
+	Key  []byte
+	// PreviousCA is the CA of the certificate this one replaced. It stays in the caBundle
+	// until it expires, so the API server trusts replicas still serving the old one.
+	PreviousCA []byte
+}
+
+// DNSNames returns the names the certificate of the webhook service in namespace is for.
+func DNSNames(service, namespace string) []string {
+	return []string{service, service + "." + namespace, service + "." + namespace + ".svc"}
+}
+
+// Generate generates a self-signed CA, and a certificate signed by it for dnsNames. The
+// last name, the fully qualified one, is the common name.
+func Generate(dnsNames []string, now time.Time) (*Bundle, error) {
+	caKeyPair, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	ca := &x509.Certificate{
+		SerialNumber:          serialNumber(),
+		Subject:               pkix.Name{Organization: []string{"tetrate.io"}, CommonName: "istio-cost-analyzer-webhook-ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(Validity),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKeyPair.PublicKey, caKeyPair)
+	if err != nil {
+		return nil, err
+	}
+	keyPair, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	cert := &x509.Certificate{
+		SerialNumber: serialNumber(),
+		Subject:      pkix.Name{Organization: []string{"tetrate.io"}, CommonName: dnsNames[len(dnsNames)-1]},
+		DNSNames:     dnsNames,
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(Validity),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, cert, ca, &keyPair.PublicKey, caKeyPair)
+	if err != nil {
+		return nil, err
+	}
+	return &Bundle{
+		CA:   pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}),
+		Cert: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER}),
+		Key:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(keyPair)}),
+	}, nil
+}
+
+func serialNumber() *big.Int {
+	n, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return n
+}
+
+// NeedsRotation returns whether the certificate of b should be replaced at now: it's
+// invalid, not for dnsNames, or expires within RotateBefore.
+func (b *Bundle) NeedsRotation(dnsNames []string, now time.Time) bool {
+	cert, err := parseCert(b.Cert)
+	if err != nil {
+		return true
+	}
+	if _, err := tls.X509KeyPair(b.Cert, b.Key); err != nil {
+		return true
+	}
+	for _, name := range dnsNames {
+		if cert.VerifyHostname(name) != nil {
+			return true
+		}
+	}
+	return now.Add(RotateBefore).After(cert.NotAfter)
+}
+
+// CABundle returns the CAs the API server should trust: the CA of the certificate, and the
+// previous one while it's valid.
+func (b *Bundle) CABundle(now time.Time) []byte {
+	if previous, err := parseCert(b.PreviousCA); err == nil && now.Before(previous.NotAfter) {
+		return append(append([]byte{}, b.CA...), b.PreviousCA...)
+	}
+	return b.CA
+}
+
+func parseCert(data []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM certificate")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Store keeps a Bundle in a Secret.
+type Store struct {
+	Client    kubernetes.Interface
+	Namespace string
+	Name      string
+}
+
+// Load returns the bundle in the Secret, or nil if there is none.
+func (s Store) Load(ctx context.Context) (*Bundle, error) {
+	_, bundle, err := s.load(ctx)
+	return bundle, err
+}
+
+func (s Store) load(ctx context.Context) (*corev1.Secret, *Bundle, error) {
+	secret, err := s.Client.CoreV1().Secrets(s.Namespace).Get(ctx, s.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return secret, &Bundle{
+		CA:         secret.Data[caKey],
+		Cert:       secret.Data[corev1.TLSCertKey],
+		Key:        secret.Data[corev1.TLSPrivateKeyKey],
+		PreviousCA: secret.Data[previousCAKey],
+	}, nil
+}
+
+// Ensure returns the bundle in the Secret, first generating one for dnsNames if there is
+// none or it needs rotation. If several replicas generate one at the same time, the first
+// to save it wins, and the others return it.
+func (s Store) Ensure(ctx context.Context, dnsNames []string, now time.Time) (*Bundle, error) {
+	secret, current, err := s.load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && !current.NeedsRotation(dnsNames, now) {
+		return current, nil
+	}
+	bundle, err := Generate(dnsNames, now)
+	if err != nil {
+		return nil, err
+	}
+	data := map[string][]byte{
+		caKey:                   bundle.CA,
+		corev1.TLSCertKey:       bundle.Cert,
+		corev1.TLSPrivateKeyKey: bundle.Key,
+	}
+	if current == nil {
+		_, err = s.Client.CoreV1().Secrets(s.Namespace).Create(ctx, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.Name,
+				Namespace: s.Namespace,
+				Labels:    map[string]string{"app": "cost-analyzer"},
+			},
+			Type: corev1.SecretTypeTLS,
+			Data: data,
+		}, metav1.CreateOptions{})
+	} else {
+		if len(current.CA) != 0 {
+			bundle.PreviousCA = current.CA
+			data[previousCAKey] = current.CA
+		}
+		// fails with a conflict if another replica rotated it since it was loaded
+		secret.Data = data
+		_, err = s.Client.CoreV1().Secrets(s.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+	}
+	if apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err) {
+		// another replica got there first
+		return s.Load(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("generated certificate in secret %v/%v, valid until %v", s.Namespace, s.Name, now.Add(Validity).Format(time.RFC3339))
+	return bundle, nil
+}
+
+// PatchCABundle sets the caBundle of every webhook of the MutatingWebhookConfiguration
+// named name, if it isn't already. It returns false if there was nothing to change.
+func PatchCABundle(ctx context.Context, client kubernetes.Interface, name string, caBundle []byte) (bool, error) {
+	config, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	for i := range config.Webhooks {
+		if !bytes.Equal(config.Webhooks[i].ClientConfig.CABundle, caBundle) {
+			config.Webhooks[i].ClientConfig.CABundle = caBundle
+			changed = true
+		}
+	}
+	if !changed {
+		return false, nil
+	}
+	if _, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Update(ctx, config, metav1.UpdateOptions{}); err != nil {
+		return false, err
+	}
+	log.Printf("patched caBundle of %v", name)
+	return true, nil
+}
+
+// Keeper keeps the serving certificate of the webhook in a Secret current, and serves it.
+type Keeper struct {
+	Store Store
+	// DNSNames are the names the certificate is for.
+	DNSNames []string
+	// WebhookConfiguration is the name of the MutatingWebhookConfiguration whose caBundle
+	// is patched on rotation.
+	WebhookConfiguration string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// Sync rotates the certificate if it needs to be, patches the caBundle if it changed, and
+// serves the certificate in the Secret.
+func (k *Keeper) Sync(ctx context.Context, now time.Time) error {
+	bundle, err := k.Store.Ensure(ctx, k.DNSNames, now)
+	if err != nil {
+		return fmt.Errorf("unable to ensure certificate: %w", err)
+	}
+	if _, err := PatchCABundle(ctx, k.Store.Client, k.WebhookConfiguration, bundle.CABundle(now)); err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("unable to patch caBundle: %w", err)
+	}
+	cert, err := tls.X509KeyPair(bundle.Cert, bundle.Key)
+	if err != nil {
+		return err
+	}
+	k.mu.Lock()
+	k.cert = &cert
+	k.mu.Unlock()
+	return nil
+}
+
+// Run syncs the certificate every interval until ctx is done.
+func (k *Keeper) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if err := k.Sync(ctx, now); err != nil {
+				log.Printf("error in syncing certificate: %v", err)
+			}
+		}
+	}
+}
+
+// GetCertificate serves the certificate, for tls.Config.
+func (k *Keeper) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.cert == nil {
+		return nil, errors.New("certificate not synced yet")
+	}
+	return k.cert, nil
+}
+
+// Files serves the certificate in files, like a Secret cert-manager issues mounted in
+// the pod, loading them again when they change.
+type Files struct {
+	CertFile string
+	KeyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// GetCertificate serves the certificate, for tls.Config.
+func (f *Files) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	info, err := os.Stat(f.CertFile)
+	if err != nil {
+		return nil, err
+	}
+	if f.cert == nil || !info.ModTime().Equal(f.modTime) {
+		cert, err := tls.LoadX509KeyPair(f.CertFile, f.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		f.cert, f.modTime = &cert, info.ModTime()
+	}
+	return f.cert, nil
+}
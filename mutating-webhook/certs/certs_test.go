@@ -0,0 +1,67 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestStore_Ensure(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset()
+	store := Store{Client: client, Namespace: "istio-system", Name: "webhook-certs"}
+	dnsNames := DNSNames("webhook", "istio-system")
+	now := time.Now()
+
+	first, err := store.Ensure(ctx, dnsNames, now)
+	require.NoError(t, err)
+	assert.False(t, first.NeedsRotation(dnsNames, now))
+	assert.Empty(t, first.PreviousCA)
+
+	// another replica starting gets the same certificate
+	again, err := store.Ensure(ctx, dnsNames, now.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, first.Cert, again.Cert)
+
+	// close to expiry, it's rotated, and the old CA is still trusted
+	later := now.Add(Validity - RotateBefore + time.Hour)
+	assert.True(t, first.NeedsRotation(dnsNames, later))
+	rotated, err := store.Ensure(ctx, dnsNames, later)
+	require.NoError(t, err)
+	assert.NotEqual(t, first.Cert, rotated.Cert)
+	assert.Equal(t, first.CA, rotated.PreviousCA)
+	assert.True(t, bytes.Contains(rotated.CABundle(later), first.CA))
+	assert.False(t, bytes.Contains(rotated.CABundle(now.Add(Validity+time.Hour)), first.CA))
+
+	loaded, err := store.Load(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, rotated, loaded)
+
+	// a certificate for another service is replaced
+	assert.True(t, rotated.NeedsRotation(DNSNames("other", "istio-system"), later))
+}
+
+func TestPatchCABundle(t *testing.T) {
+	ctx := context.Background()
+	client := fake.NewSimpleClientset(&admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "webhook-configuration"},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "webhook.example.com"}},
+	})
+	changed, err := PatchCABundle(ctx, client, "webhook-configuration", []byte("ca"))
+	require.NoError(t, err)
+	assert.True(t, changed)
+	config, err := client.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "webhook-configuration", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, []byte("ca"), config.Webhooks[0].ClientConfig.CABundle)
+
+	changed, err = PatchCABundle(ctx, client, "webhook-configuration", []byte("ca"))
+	require.NoError(t, err)
+	assert.False(t, changed)
+}
@@ -1,25 +1,20 @@
 package main
 
 import (
-	"bytes"
 	"context"
-	cryptorand "crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/pem"
 	"flag"
 	"log"
-	"math/big"
 	"os"
 	"path"
-	"strings"
 	"time"
 
 	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	ctrl "sigs.k8s.io/controller-runtime"
+
+	"github.com/tetratelabs/istio-cost-analyzer/mutating-webhook/certs"
 )
 
 func main() {
@@ -29,6 +24,7 @@ func main() {
 		webhookNamespace, _ = os.LookupEnv("WEBHOOK_NAMESPACE")
 		mutationCfgName, _  = os.LookupEnv("MUTATE_CONFIG")
 		webhookService, _   = os.LookupEnv("WEBHOOK_SERVICE")
+		certSecret, _       = os.LookupEnv("CERT_SECRET")
 	)
 	log.Printf("webhookNamespace: %s, mutationCfgName: %s", webhookNamespace, mutationCfgName)
 	if webhookNamespace == "" {
@@ -39,11 +35,16 @@ func main() {
 	if err != nil {
 		panic("failed to set go -client")
 	}
-	org := "tetrate.io"
-	dnsNames := []string{"cost-analyzer-mutating-webhook",
-		"cost-analyzer-mutating-webhook." + webhookNamespace, "cost-analyzer-mutating-webhook." + webhookNamespace + ".svc"}
-	commonName := "cost-analyzer-mutating-webhook." + webhookNamespace + ".svc"
-	caPEM, certPEM, certKeyPEM, err := generateCert([]string{org}, dnsNames, commonName)
+	now := time.Now()
+	dnsNames := certs.DNSNames(webhookService, webhookNamespace)
+	var bundle *certs.Bundle
+	if certSecret != "" {
+		// shared by every replica, and rotated by the webhook before it expires
+		bundle, err = certs.Store{Client: kubeClient, Namespace: webhookNamespace, Name: certSecret}.Ensure(context.Background(), dnsNames, now)
+	} else {
+		// set up by a version without a secret, so every pod has its own certificate
+		bundle, err = certs.Generate(dnsNames, now)
+	}
 	if err != nil {
 		log.Fatalf("unable to generate cert: %v", err)
 	}
@@ -52,16 +53,17 @@ func main() {
 	if err != nil {
 		log.Panic(err)
 	}
-	err = WriteFile(path.Join(*outputDir, "tls.crt"), certPEM)
+	err = os.WriteFile(path.Join(*outputDir, "tls.crt"), bundle.Cert, 0600)
 	if err != nil {
 		log.Fatal(err)
 	}
-	err = WriteFile(path.Join(*outputDir, "tls.key"), certKeyPEM)
+	err = os.WriteFile(path.Join(*outputDir, "tls.key"), bundle.Key, 0600)
 	if err != nil {
 		log.Fatal(err)
 	}
 	path := "/mutate"
-	fail := admissionregistrationv1.Fail
+	// only used if deployed without setup, which applies its own
+	ignore := admissionregistrationv1.Ignore
 	sf := admissionregistrationv1.SideEffectClassNone
 	mutateconfig := &admissionregistrationv1.MutatingWebhookConfiguration{
 		ObjectMeta: metav1.ObjectMeta{
@@ -70,7 +72,7 @@ func main() {
 		Webhooks: []admissionregistrationv1.MutatingWebhook{{
 			Name: "mutating-webhook.istio-cost-analyzer.io",
 			ClientConfig: admissionregistrationv1.WebhookClientConfig{
-				CABundle: caPEM.Bytes(), // CA bundle created earlier
+				CABundle: bundle.CABundle(now),
 				Service: &admissionregistrationv1.ServiceReference{
 					Name:      webhookService,
 					Namespace: webhookNamespace,
@@ -85,7 +87,7 @@ func main() {
 					Resources:   []string{"deployments"},
 				},
 			}},
-			FailurePolicy:           &fail,
+			FailurePolicy:           &ignore,
 			SideEffects:             &sf,
 			AdmissionReviewVersions: []string{"v1"},
 			NamespaceSelector: &metav1.LabelSelector{
@@ -97,101 +99,12 @@ func main() {
 	}
 
 	if _, err := kubeClient.AdmissionregistrationV1().MutatingWebhookConfigurations().Create(context.Background(), mutateconfig, metav1.CreateOptions{}); err != nil {
-		if !strings.Contains(err.Error(), "already exists") {
+		if !apierrors.IsAlreadyExists(err) {
+			panic(err)
+		}
+		// created by an earlier run, or applied from rendered manifests without a caBundle
+		if _, err := certs.PatchCABundle(context.Background(), kubeClient, mutationCfgName, bundle.CABundle(now)); err != nil {
 			panic(err)
 		}
 	}
 }
-
-// generateCert generate a self-signed CA for given organization
-// and sign certificate with the CA for given common name and dns names
-// it resurns the CA, certificate and private key in PEM format
-func generateCert(orgs, dnsNames []string, commonName string) (*bytes.Buffer, *bytes.Buffer, *bytes.Buffer, error) {
-	// init CA config
-	ca := &x509.Certificate{
-		SerialNumber:          big.NewInt(2022),
-		Subject:               pkix.Name{Organization: orgs},
-		NotBefore:             time.Now(),
-		NotAfter:              time.Now().AddDate(1, 0, 0), // expired in 1 year
-		IsCA:                  true,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
-		BasicConstraintsValid: true,
-	}
-
-	// generate private key for CA
-	caPrivateKey, err := rsa.GenerateKey(cryptorand.Reader, 4096)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
-	// create the CA certificate
-	caBytes, err := x509.CreateCertificate(cryptorand.Reader, ca, ca, &caPrivateKey.PublicKey, caPrivateKey)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
-	// CA certificate with PEM encoded
-	caPEM := new(bytes.Buffer)
-	_ = pem.Encode(caPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: caBytes,
-	})
-
-	// new certificate config
-	newCert := &x509.Certificate{
-		DNSNames:     dnsNames,
-		SerialNumber: big.NewInt(1024),
-		Subject: pkix.Name{
-			CommonName:   commonName,
-			Organization: orgs,
-		},
-		NotBefore:   time.Now(),
-		NotAfter:    time.Now().AddDate(1, 0, 0), // expired in 1 year
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
-		KeyUsage:    x509.KeyUsageDigitalSignature,
-	}
-
-	// generate new private key
-	newPrivateKey, err := rsa.GenerateKey(cryptorand.Reader, 4096)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
-	// sign the new certificate
-	newCertBytes, err := x509.CreateCertificate(cryptorand.Reader, newCert, ca, &newPrivateKey.PublicKey, caPrivateKey)
-	if err != nil {
-		return nil, nil, nil, err
-	}
-
-	// new certificate with PEM encoded
-	newCertPEM := new(bytes.Buffer)
-	_ = pem.Encode(newCertPEM, &pem.Block{
-		Type:  "CERTIFICATE",
-		Bytes: newCertBytes,
-	})
-
-	// new private key with PEM encoded
-	newPrivateKeyPEM := new(bytes.Buffer)
-	_ = pem.Encode(newPrivateKeyPEM, &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(newPrivateKey),
-	})
-
-	return caPEM, newCertPEM, newPrivateKeyPEM, nil
-}
-
-// WriteFile writes data in the file at the given path
-func WriteFile(filepath string, sCert *bytes.Buffer) error {
-	f, err := os.Create(filepath)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	_, err = f.Write(sCert.Bytes())
-	if err != nil {
-		return err
-	}
-	return nil
-}
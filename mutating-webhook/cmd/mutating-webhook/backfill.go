@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/retry"
+)
+
+// backfillAnnotation on a workload, set to false, opts it out of the backfill. It's still
+// annotated by the webhook when it's created. It must match pkg.BackfillAnnotation in the
+// cli.
+const backfillAnnotation = "cost-analyzer.tetrate.io/backfill"
+
+// outcomes of backfilling a workload.
+const (
+	outcomeRestarted = "restarted"
+	outcomeSkipped   = "skipped"
+	outcomeFailed    = "failed"
+	outcomePending   = "pending"
+)
+
+// backfillLease is the Lease the webhook replicas hold to backfill, so only one does, and
+// backfillReportName the ConfigMap the report is saved to. They must match
+// pkg.BackfillLeaseName and pkg.BackfillReportName in the cli.
+const (
+	backfillLease      = "cost-analyzer-backfill"
+	backfillReportName = "cost-analyzer-backfill-report"
+)
+
+// backfillConfig is how the webhook annotates existing workloads, which restarts their pods.
+type backfillConfig struct {
+	enabled bool
+	// batchSize workloads are annotated at a time, and their rollouts waited for.
+	batchSize int
+	// rolloutTimeout is how long a rollout is waited for, before the backfill stops.
+	rolloutTimeout time.Duration
+	// window is when workloads may be restarted. If nil, it's any time.
+	window *maintenanceWindow
+	// pollInterval is how often rollouts and the window are checked.
+	pollInterval time.Duration
+}
+
+// loadBackfillConfig reads the backfill config from the environment.
+func loadBackfillConfig(getenv func(string) string) (backfillConfig, error) {
+	cfg := backfillConfig{batchSize: 1, rolloutTimeout: 10 * time.Minute, pollInterval: 10 * time.Second}
+	cfg.enabled = getenv("BACKFILL") == "true"
+	if v := getenv("BACKFILL_BATCH_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return cfg, fmt.Errorf("invalid BACKFILL_BATCH_SIZE %q, must be a positive number", v)
+		}
+		cfg.batchSize = n
+	}
+	if v := getenv("BACKFILL_ROLLOUT_TIMEOUT"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid BACKFILL_ROLLOUT_TIMEOUT %q: %v", v, err)
+		}
+		cfg.rolloutTimeout = d
+	}
+	window, err := parseMaintenanceWindow(getenv("BACKFILL_WINDOW"))
+	if err != nil {
+		return cfg, err
+	}
+	cfg.window = window
+	return cfg, nil
+}
+
+// maintenanceWindow is a daily window of time, in UTC. It may span midnight.
+type maintenanceWindow struct {
+	// start and end are offsets from midnight.
+	start, end time.Duration
+}
+
+// parseMaintenanceWindow parses a window like 22:00-04:00, in UTC. It returns nil for "".
+func parseMaintenanceWindow(s string) (*maintenanceWindow, error) {
+	if s == "" {
+		return nil, nil
+	}
+	bounds := strings.Split(s, "-")
+	if len(bounds) != 2 {
+		return nil, fmt.Errorf("invalid maintenance window %q, must be like 22:00-04:00", s)
+	}
+	offsets := make([]time.Duration, 2)
+	for i, b := range bounds {
+		t, err := time.Parse("15:04", strings.TrimSpace(b))
+		if err != nil {
+			return nil, fmt.Errorf("invalid maintenance window %q, must be like 22:00-04:00", s)
+		}
+		offsets[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	return &maintenanceWindow{start: offsets[0], end: offsets[1]}, nil
+}
+
+// contains returns whether t is in the window.
+func (w *maintenanceWindow) contains(t time.Time) bool {
+	if w == nil {
+		return true
+	}
+	t = t.UTC()
+	offset := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	if w.start <= w.end {
+		return offset >= w.start && offset < w.end
+	}
+	return offset >= w.start || offset < w.end
+}
+
+func (w *maintenanceWindow) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return format(w.start) + "-" + format(w.end) + " UTC"
+}
+
+// backfillResult is what the backfill did with a workload.
+type backfillResult struct {
+	Workload string `json:"workload"`
+	Outcome  string `json:"outcome"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// backfillReport is what the backfill did, saved as it goes.
+type backfillReport struct {
+	Started  time.Time        `json:"started"`
+	Finished *time.Time       `json:"finished,omitempty"`
+	Results  []backfillResult `json:"results"`
+}
+
+// runBackfill backfills existing workloads once this replica holds the backfill lease. It
+// keeps the lease until ctx is done, so other replicas don't backfill again.
+func runBackfill(ctx context.Context, config backfillConfig) {
+	webhookNamespace := os.Getenv("WEBHOOK_NAMESPACE")
+	identity, err := os.Hostname()
+	if err != nil {
+		logger.Printf("error in getting hostname, not backfilling: %v\n", err)
+		return
+	}
+	b := &backfiller{
+		client:     dynamicClient,
+		kinds:      workloadKinds,
+		namespaces: namespaces,
+		config:     config,
+		skip:       skipReason,
+		save:       saveBackfillReport(clientset, webhookNamespace, backfillReportName),
+		now:        time.Now,
+		sleep:      sleep,
+	}
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta:  metav1.ObjectMeta{Name: backfillLease, Namespace: webhookNamespace},
+		Client:     clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+	}
+	leaderelection.RunOrDie(ctx, leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: 30 * time.Second,
+		RenewDeadline: 20 * time.Second,
+		RetryPeriod:   5 * time.Second,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				log.Println("backfilling existing workloads...")
+				report, err := b.run(ctx)
+				if err != nil {
+					logger.Printf("backfill stopped: %v\n", err)
+				}
+				counts := make(map[string]int)
+				for _, r := range report.Results {
+					counts[r.Outcome]++
+				}
+				log.Printf("backfill: %v restarted, %v skipped, %v failed, %v pending, see configmap %v/%v\n",
+					counts[outcomeRestarted], counts[outcomeSkipped], counts[outcomeFailed], counts[outcomePending], webhookNamespace, backfillReportName)
+			},
+			OnStoppedLeading: func() {},
+		},
+	})
+}
+
+// backfillTarget is an existing workload to annotate.
+type backfillTarget struct {
+	kind     workloadKind
+	workload *unstructured.Unstructured
+	// result is its index in the report.
+	result int
+}
+
+func (t backfillTarget) String() string {
+	return fmt.Sprintf("%v %v/%v", strings.ToLower(t.kind.Kind), t.workload.GetNamespace(), t.workload.GetName())
+}
+
+// backfiller annotates the pod templates of existing workloads with stats tags, a batch at a
+// time, waiting for their rollouts.
+type backfiller struct {
+	client     dynamic.Interface
+	kinds      []workloadKind
+	namespaces []string
+	config     backfillConfig
+	// skip returns why a workload with labels in namespace is left alone, or "".
+	skip func(namespace string, labels map[string]string) string
+	// save saves the report.
+	save  func(ctx context.Context, report *backfillReport) error
+	now   func() time.Time
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// run backfills existing workloads until it's done or ctx is done, and returns the report.
+func (b *backfiller) run(ctx context.Context) (*backfillReport, error) {
+	report := &backfillReport{Started: b.now(), Results: make([]backfillResult, 0)}
+	targets, err := b.targets(ctx, report)
+	if err != nil {
+		return report, err
+	}
+	for i := range targets {
+		report.Results[targets[i].result].Outcome = outcomePending
+	}
+	b.saveReport(ctx, report)
+	for start := 0; start < len(targets); start += b.config.batchSize {
+		end := start + b.config.batchSize
+		if end > len(targets) {
+			end = len(targets)
+		}
+		batch := targets[start:end]
+		if err := b.waitForWindow(ctx, report, batch); err != nil {
+			return report, err
+		}
+		restarted := make([]backfillTarget, 0, len(batch))
+		for _, t := range batch {
+			result := &report.Results[t.result]
+			if err := annotateWorkload(ctx, b.client, t.kind, t.workload); err != nil {
+				result.Outcome, result.Detail = outcomeFailed, err.Error()
+				continue
+			}
+			result.Outcome, result.Detail = outcomeRestarted, "rolling out"
+			restarted = append(restarted, t)
+		}
+		b.saveReport(ctx, report)
+		if err := b.waitForRollouts(ctx, report, restarted); err != nil {
+			// stop, rather than restart more workloads while some can't roll out
+			for _, t := range targets[end:] {
+				report.Results[t.result].Detail = "not restarted: " + err.Error()
+			}
+			b.finish(ctx, report)
+			return report, err
+		}
+	}
+	b.finish(ctx, report)
+	return report, nil
+}
+
+// targets lists the workloads to backfill, and adds those it skips to report.
+func (b *backfiller) targets(ctx context.Context, report *backfillReport) ([]backfillTarget, error) {
+	targets := make([]backfillTarget, 0)
+	for _, ns := range b.namespaces {
+		if reason := b.skip(ns, nil); reason != "" {
+			log.Printf("skipping workloads in %v: %v\n", ns, reason)
+			continue
+		}
+		for _, kind := range b.kinds {
+			if kind.Immutable {
+				continue
+			}
+			workloads, err := b.client.Resource(kind.groupVersionResource()).Namespace(ns).List(ctx, metav1.ListOptions{})
+			if apierrors.IsNotFound(err) {
+				// a custom resource that isn't installed
+				log.Printf("%v aren't served, skipping...\n", kind.groupVersionResource())
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			for i := range workloads.Items {
+				t := backfillTarget{kind: kind, workload: &workloads.Items[i], result: len(report.Results)}
+				report.Results = append(report.Results, backfillResult{Workload: t.String()})
+				if reason := b.skipTarget(t); reason != "" {
+					report.Results[t.result].Outcome, report.Results[t.result].Detail = outcomeSkipped, reason
+					continue
+				}
+				targets = append(targets, t)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// skipTarget returns why a workload isn't backfilled, or "".
+func (b *backfiller) skipTarget(t backfillTarget) string {
+	if reason := b.skip(t.workload.GetNamespace(), t.workload.GetLabels()); reason != "" {
+		return reason
+	}
+	if t.workload.GetAnnotations()[backfillAnnotation] == "false" {
+		return "annotated " + backfillAnnotation + "=false"
+	}
+	if _, ok, _ := unstructured.NestedMap(t.workload.Object, t.kind.templateFields()...); !ok {
+		// like a rollout referencing the template of another workload
+		return "no pod template at " + t.kind.TemplatePath
+	}
+	annotations, _, _ := unstructured.NestedStringMap(t.workload.Object, append(t.kind.templateFields(), "metadata", "annotations")...)
+	if hasLocalityTag(annotations[extraStatTagsAnnotation]) {
+		return "already tagged"
+	}
+	return ""
+}
+
+// waitForWindow waits for the maintenance window to open.
+func (b *backfiller) waitForWindow(ctx context.Context, report *backfillReport, batch []backfillTarget) error {
+	if b.config.window.contains(b.now()) {
+		return nil
+	}
+	log.Printf("waiting for the maintenance window %v to restart workloads\n", b.config.window)
+	for _, t := range batch {
+		report.Results[t.result].Detail = "waiting for the maintenance window " + b.config.window.String()
+	}
+	b.saveReport(ctx, report)
+	for !b.config.window.contains(b.now()) {
+		if err := b.sleep(ctx, b.config.pollInterval); err != nil {
+			return err
+		}
+	}
+	for _, t := range batch {
+		report.Results[t.result].Detail = ""
+	}
+	return nil
+}
+
+// waitForRollouts waits for the rollouts of restarted to complete.
+func (b *backfiller) waitForRollouts(ctx context.Context, report *backfillReport, restarted []backfillTarget) error {
+	deadline := b.now().Add(b.config.rolloutTimeout)
+	for len(restarted) > 0 {
+		pending := make([]backfillTarget, 0, len(restarted))
+		for _, t := range restarted {
+			workload, err := b.client.Resource(t.kind.groupVersionResource()).Namespace(t.workload.GetNamespace()).Get(ctx, t.workload.GetName(), metav1.GetOptions{})
+			if err != nil || !rolloutComplete(t.kind, workload) {
+				pending = append(pending, t)
+				continue
+			}
+			report.Results[t.result].Detail = ""
+		}
+		restarted = pending
+		if len(restarted) == 0 {
+			break
+		}
+		if !b.now().Before(deadline) {
+			names := make([]string, 0, len(restarted))
+			for _, t := range restarted {
+				result := &report.Results[t.result]
+				result.Outcome, result.Detail = outcomeFailed, fmt.Sprintf("annotated, but the rollout didn't complete within %v", b.config.rolloutTimeout)
+				names = append(names, t.String())
+			}
+			return fmt.Errorf("rollout of %v didn't complete within %v", strings.Join(names, ", "), b.config.rolloutTimeout)
+		}
+		if err := b.sleep(ctx, b.config.pollInterval); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *backfiller) finish(ctx context.Context, report *backfillReport) {
+	finished := b.now()
+	report.Finished = &finished
+	b.saveReport(ctx, report)
+}
+
+func (b *backfiller) saveReport(ctx context.Context, report *backfillReport) {
+	if err := b.save(ctx, report); err != nil {
+		log.Printf("error in saving backfill report: %v\n", err)
+	}
+}
+
+// rolloutComplete returns whether all the pods of a workload of kind run its current pod
+// template. Kinds without replicas, like CronJobs, only need their update observed.
+func rolloutComplete(kind workloadKind, workload *unstructured.Unstructured) bool {
+	if observed, ok, _ := unstructured.NestedInt64(workload.Object, "status", "observedGeneration"); ok && observed < workload.GetGeneration() {
+		return false
+	}
+	status := func(field string) int64 {
+		v, _, _ := unstructured.NestedInt64(workload.Object, "status", field)
+		return v
+	}
+	switch kind.Kind {
+	case "DaemonSet":
+		desired := status("desiredNumberScheduled")
+		return status("updatedNumberScheduled") == desired && status("numberAvailable") == desired
+	case "Deployment", "StatefulSet", "Rollout":
+		replicas, ok, _ := unstructured.NestedInt64(workload.Object, "spec", "replicas")
+		if !ok {
+			replicas = 1
+		}
+		ready := status("availableReplicas")
+		if kind.Kind == "StatefulSet" {
+			ready = status("readyReplicas")
+		}
+		// and no pods of the previous template left
+		return status("updatedReplicas") == replicas && ready == replicas && status("replicas") == replicas
+	}
+	return true
+}
+
+// annotateWorkload annotates the pod template of an existing workload of kind with stats
+// tags, and marks it, for destroy. It sends a merge patch of only those annotations, with
+// the resourceVersion of the workload it's computed from, retried if the workload changed
+// meanwhile.
+func annotateWorkload(ctx context.Context, client dynamic.Interface, kind workloadKind, workload *unstructured.Unstructured) error {
+	resource := client.Resource(kind.groupVersionResource()).Namespace(workload.GetNamespace())
+	log.Printf("annotating %v %v/%v\n", strings.ToLower(kind.Kind), workload.GetNamespace(), workload.GetName())
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		current, err := resource.Get(ctx, workload.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		patch, err := workloadPatch(kind, current)
+		if err != nil {
+			return err
+		}
+		_, err = resource.Patch(ctx, workload.GetName(), types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+}
+
+// workloadPatch returns the merge patch adding the stats tags to the pod template of
+// workload, and marking it.
+func workloadPatch(kind workloadKind, workload *unstructured.Unstructured) ([]byte, error) {
+	annotationFields := append(kind.templateFields(), "metadata", "annotations")
+	annotations, _, _ := unstructured.NestedStringMap(workload.Object, annotationFields...)
+	// keep the tags already there
+	tags, _ := mergeStatTags(annotations[extraStatTagsAnnotation])
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": workload.GetResourceVersion(),
+			"annotations":     map[string]interface{}{mutatedAnnotation: "true"},
+		},
+	}
+	if err := unstructured.SetNestedField(patch, tags, append(annotationFields, extraStatTagsAnnotation)...); err != nil {
+		return nil, err
+	}
+	return json.Marshal(patch)
+}
+
+// saveBackfillReport returns a func saving the report to the ConfigMap name in namespace.
+func saveBackfillReport(client kubernetes.Interface, namespace, name string) func(context.Context, *backfillReport) error {
+	return func(ctx context.Context, report *backfillReport) error {
+		data, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		cm := &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Labels: map[string]string{"app": "cost-analyzer"}},
+			Data:       map[string]string{"report": string(data)},
+		}
+		_, err = client.CoreV1().ConfigMaps(namespace).Update(ctx, cm, metav1.UpdateOptions{})
+		if apierrors.IsNotFound(err) {
+			_, err = client.CoreV1().ConfigMaps(namespace).Create(ctx, cm, metav1.CreateOptions{})
+		}
+		return err
+	}
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func TestMaintenanceWindow(t *testing.T) {
+	tests := []struct {
+		name    string
+		window  string
+		at      string
+		want    bool
+		wantErr bool
+	}{
+		{name: "any time", window: "", at: "12:00", want: true},
+		{name: "in", window: "01:00-05:00", at: "03:30", want: true},
+		{name: "at the start", window: "01:00-05:00", at: "01:00", want: true},
+		{name: "at the end", window: "01:00-05:00", at: "05:00", want: false},
+		{name: "over midnight, before", window: "22:00-04:00", at: "23:15", want: true},
+		{name: "over midnight, after", window: "22:00-04:00", at: "02:00", want: true},
+		{name: "over midnight, out", window: "22:00-04:00", at: "12:00", want: false},
+		{name: "invalid", window: "22:00", wantErr: true},
+		{name: "invalid time", window: "25:00-04:00", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w, err := parseMaintenanceWindow(tt.window)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			at, err := time.Parse("15:04", tt.at)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, w.contains(at))
+		})
+	}
+}
+
+func deployment(name string, annotations, labels, templateAnnotations map[string]string, updated int64) *unstructured.Unstructured {
+	d := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       "Deployment",
+		"spec": map[string]interface{}{
+			"replicas": int64(1),
+			"template": map[string]interface{}{"spec": map[string]interface{}{}},
+		},
+		"status": map[string]interface{}{"replicas": int64(1), "updatedReplicas": updated, "availableReplicas": int64(1)},
+	}}
+	d.SetName(name)
+	d.SetNamespace("default")
+	d.SetAnnotations(annotations)
+	d.SetLabels(labels)
+	if templateAnnotations != nil {
+		_ = unstructured.SetNestedStringMap(d.Object, templateAnnotations, "spec", "template", "metadata", "annotations")
+	}
+	return d
+}
+
+func TestBackfiller(t *testing.T) {
+	tests := []struct {
+		name      string
+		workloads []runtime.Object
+		batchSize int
+		window    string
+		wantErr   bool
+		want      map[string]string
+		// wantTags are the stats tags of workloads, if not only destination_locality
+		wantTags map[string]string
+	}{
+		{
+			name: "restarts a batch at a time",
+			workloads: []runtime.Object{
+				deployment("a", nil, nil, nil, 1),
+				deployment("b", nil, nil, map[string]string{"prometheus.io/scrape": "true"}, 1),
+				deployment("c", nil, nil, nil, 1),
+			},
+			batchSize: 2,
+			want:      map[string]string{"a": outcomeRestarted, "b": outcomeRestarted, "c": outcomeRestarted},
+		},
+		{
+			name: "skips opted out, excluded and tagged workloads",
+			workloads: []runtime.Object{
+				deployment("opted-out", map[string]string{backfillAnnotation: "false"}, nil, nil, 1),
+				deployment("excluded", nil, map[string]string{excludeLabel: "true"}, nil, 1),
+				deployment("tagged", nil, nil, map[string]string{"sidecar.istio.io/extraStatTags": "destination_locality"}, 1),
+				deployment("a", nil, nil, nil, 1),
+			},
+			batchSize: 1,
+			want:      map[string]string{"opted-out": outcomeSkipped, "excluded": outcomeSkipped, "tagged": outcomeSkipped, "a": outcomeRestarted},
+		},
+		{
+			name: "stops when a rollout doesn't complete",
+			workloads: []runtime.Object{
+				deployment("a", nil, nil, nil, 1),
+				deployment("stuck", nil, nil, nil, 0),
+				deployment("then", nil, nil, nil, 1),
+			},
+			batchSize: 1,
+			wantErr:   true,
+			want:      map[string]string{"a": outcomeRestarted, "stuck": outcomeFailed, "then": outcomePending},
+		},
+		{
+			name:      "waits for the maintenance window",
+			workloads: []runtime.Object{deployment("a", nil, nil, nil, 1)},
+			batchSize: 1,
+			window:    "02:00-03:00",
+			want:      map[string]string{"a": outcomeRestarted},
+		},
+		{
+			name:      "keeps existing stats tags",
+			workloads: []runtime.Object{deployment("a", nil, nil, map[string]string{"sidecar.istio.io/extraStatTags": "request_host,foo"}, 1)},
+			batchSize: 1,
+			want:      map[string]string{"a": outcomeRestarted},
+			wantTags:  map[string]string{"a": "request_host,foo,destination_locality"},
+		},
+	}
+	deploymentKind := testWorkloadKinds(t)[0]
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{deploymentKind.groupVersionResource(): "DeploymentList"}, tt.workloads...)
+			window, err := parseMaintenanceWindow(tt.window)
+			require.NoError(t, err)
+			// starts at midnight, and sleeping moves the clock
+			now := time.Date(2022, 6, 1, 0, 0, 0, 0, time.UTC)
+			saved := 0
+			b := &backfiller{
+				client:     client,
+				kinds:      []workloadKind{deploymentKind},
+				namespaces: []string{"default"},
+				config:     backfillConfig{batchSize: tt.batchSize, rolloutTimeout: time.Minute, window: window, pollInterval: 10 * time.Second},
+				skip: func(namespace string, labels map[string]string) string {
+					if labels[excludeLabel] == "true" {
+						return "excluded"
+					}
+					return ""
+				},
+				save: func(ctx context.Context, report *backfillReport) error {
+					saved++
+					return nil
+				},
+				now: func() time.Time { return now },
+				sleep: func(ctx context.Context, d time.Duration) error {
+					now = now.Add(d)
+					return nil
+				},
+			}
+			report, err := b.run(context.Background())
+			if tt.wantErr {
+				require.Error(t, err)
+			} else {
+				require.NoError(t, err)
+			}
+			outcomes := make(map[string]string)
+			for _, r := range report.Results {
+				outcomes[r.Workload[len("deployment default/"):]] = r.Outcome
+			}
+			assert.Equal(t, tt.want, outcomes)
+			assert.NotNil(t, report.Finished)
+			assert.NotZero(t, saved)
+			if window != nil {
+				assert.True(t, window.contains(now))
+			}
+			// restarted workloads are tagged and marked
+			for name, outcome := range tt.want {
+				d, err := client.Resource(deploymentKind.groupVersionResource()).Namespace("default").Get(context.Background(), name, metav1.GetOptions{})
+				require.NoError(t, err)
+				annotations, _, _ := unstructured.NestedStringMap(d.Object, "spec", "template", "metadata", "annotations")
+				tags, ok := tt.wantTags[name]
+				if !ok {
+					tags = "destination_locality"
+				}
+				tagged := outcome == outcomeRestarted || outcome == outcomeFailed || name == "tagged"
+				assert.Equal(t, tagged, annotations["sidecar.istio.io/extraStatTags"] == tags, name)
+				assert.Equal(t, outcome == outcomeRestarted || outcome == outcomeFailed, d.GetAnnotations()[mutatedAnnotation] == "true", name)
+			}
+		})
+	}
+}
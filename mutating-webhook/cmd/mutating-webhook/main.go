@@ -7,33 +7,59 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	v1 "k8s.io/api/apps/v1"
-	runtime2 "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
 	"log"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	admissionv1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+
+	"github.com/tetratelabs/istio-cost-analyzer/mutating-webhook/certs"
 )
 
 var (
 	codecs    = serializer.NewCodecFactory(runtime.NewScheme())
 	logger    = log.New(os.Stdout, "", log.LstdFlags)
-	clientset *kubernetes.Clientset
-	cloud     = os.Getenv("CLOUD")
+	clientset kubernetes.Interface
+	cloud     = strings.ToLower(os.Getenv("CLOUD"))
 	//namespace  = os.Getenv("NAMESPACE")
 	namespaces = strings.Split(os.Getenv("NAMESPACE"), ",")
 )
 
+var (
+	// dynamicClient reads and updates workloads of any kind.
+	dynamicClient dynamic.Interface
+	// workloadKinds are the kinds of workloads the webhook handles.
+	workloadKinds []workloadKind
+	// namespaceLister and nodeLister get namespaces and nodes from the informer caches
+	// startListers fills.
+	namespaceLister corelisters.NamespaceLister
+	nodeLister      corelisters.NodeLister
+)
+
+// mutatedAnnotation marks the workloads and pods the webhook changed, so destroy can
+// revert them. It must match pkg.MutatedAnnotation in the cli.
+const mutatedAnnotation = "cost-analyzer.tetrate.io/mutated"
+
+// excludeLabel on a workload or pod, and exemptAnnotation on a namespace, set to true,
+// have the webhook leave them alone. They must match pkg.ExcludeLabel and
+// pkg.ExemptAnnotation in the cli.
+const (
+	excludeLabel     = "cost-analyzer.tetrate.io/exclude"
+	exemptAnnotation = "cost-analyzer.tetrate.io/exempt"
+)
+
 func main() {
 	// assume defaults
 	if cloud == "" {
@@ -53,73 +79,94 @@ func main() {
 	if err != nil {
 		panic(err.Error())
 	}
+	dynamicClient, err = dynamic.NewForConfig(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	workloadKinds, err = loadWorkloadKinds(os.Getenv("WORKLOAD_KINDS"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(workloadKinds) == 0 {
+		log.Println("WORKLOAD_KINDS isn't set, only labelling pods; deploy the webhook with setup to annotate workloads")
+	}
 	stopCh := make(chan struct{})
+	startListers(clientset, stopCh)
 	//concurrently watch for pod creation and label the pod with the node locality
 	go watchAndLabelPods(stopCh)
-	//annotate existing deployments with stats tags
-	if err = annotateExistingDeployments(); err != nil {
+	//annotate existing workloads with stats tags, if enabled
+	backfill, err := loadBackfillConfig(os.Getenv)
+	if err != nil {
 		log.Fatal(err)
 	}
+	if backfill.enabled {
+		go runBackfill(context.Background(), backfill)
+	} else {
+		log.Println("backfill disabled, only new workloads are annotated")
+	}
 
-	if err = runWebhookServer(*tlsCert, *tlsKey, *port); err != nil {
+	getCertificate, err := servingCertificate(*tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err = runWebhookServer(getCertificate, *port); err != nil {
 		log.Fatal(err)
 	}
 }
 
-// annotateExistingDeployments annotates existing deployments with stats tags.
-func annotateExistingDeployments() error {
-	log.Println("fetching deployments...")
-	for _, ns := range namespaces {
-		depl, err := clientset.AppsV1().Deployments(ns).List(context.TODO(), metav1.ListOptions{})
-		if err != nil {
-			return err
-		}
-		log.Printf("annotating %v deployments in %v\n", len(depl.Items), ns)
-		for _, d := range depl.Items {
-			if d.Spec.Template.Annotations == nil {
-				d.Spec.Template.Annotations = make(map[string]string)
-			}
-			if v, ok := d.Spec.Template.Annotations["sidecar.istio.io/extraStatTags"]; ok && v == "destination_locality" {
-				log.Printf("skipping deployment %v/%v\n", d.Name, d.Namespace)
-				continue
-			}
-			log.Printf("annotating deployment %v/%v\n", d.Name, d.Namespace)
-			d.Spec.Template.Annotations["sidecar.istio.io/extraStatTags"] = "destination_locality"
-			_, err = clientset.AppsV1().Deployments(ns).Update(context.TODO(), &d, metav1.UpdateOptions{})
-			if err != nil {
-				logger.Printf("error in updating deployment, skipping...: %v\n", err)
-			}
-		}
+// servingCertificate returns how the webhook gets the certificate it serves. With
+// cert-manager, or without a secret to keep it in, it's the one in certFile and keyFile,
+// reloaded when they change. Otherwise, it's the one in the secret, which the webhook
+// rotates before it expires, patching the caBundle of its MutatingWebhookConfiguration.
+func servingCertificate(certFile, keyFile string) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	secret := os.Getenv("CERT_SECRET")
+	if os.Getenv("CERT_MODE") == "cert-manager" || secret == "" {
+		files := &certs.Files{CertFile: certFile, KeyFile: keyFile}
+		return files.GetCertificate, nil
+	}
+	keeper := &certs.Keeper{
+		Store:                certs.Store{Client: clientset, Namespace: os.Getenv("WEBHOOK_NAMESPACE"), Name: secret},
+		DNSNames:             certs.DNSNames(os.Getenv("WEBHOOK_SERVICE"), os.Getenv("WEBHOOK_NAMESPACE")),
+		WebhookConfiguration: os.Getenv("MUTATE_CONFIG"),
 	}
-	return nil
+	if err := keeper.Sync(context.Background(), time.Now()); err != nil {
+		return nil, err
+	}
+	go keeper.Run(context.Background(), time.Hour)
+	return keeper.GetCertificate, nil
 }
 
-func addPodEventHandler(obj interface{}) {
-	pod := obj.(*corev1.Pod)
-	log.Printf("updating pod %v\n", pod.Name)
-	// Get the node locality
-	locality, err := getNodeLocality(pod.Spec.NodeName, cloud)
-	if err != nil {
-		log.Printf("error in getting node locality: %v\n", err)
-		return
-	}
-	// Label the pod with the node locality
-	pod.ObjectMeta.Labels["locality"] = locality
-	// annotate the pod with destination_locality tag
-	if pod.Annotations == nil {
-		pod.Annotations = make(map[string]string)
+// startListers starts the informers caching the namespaces and nodes the webhook looks up,
+// so admission requests and pod updates don't each get them from the API server. It returns
+// once the caches are synced.
+func startListers(client kubernetes.Interface, stopCh <-chan struct{}) {
+	factory := informers.NewSharedInformerFactory(client, 0)
+	namespaceLister = factory.Core().V1().Namespaces().Lister()
+	nodeLister = factory.Core().V1().Nodes().Lister()
+	factory.Start(stopCh)
+	factory.WaitForCacheSync(stopCh)
+}
+
+// skipReason returns why the webhook leaves alone an object with labels in namespace, or ""
+// if it doesn't: the object is labelled with excludeLabel, or the namespace is annotated
+// with exemptAnnotation.
+func skipReason(namespace string, labels map[string]string) string {
+	if labels[excludeLabel] == "true" {
+		return "labelled " + excludeLabel
 	}
-	pod.Annotations["sidecar.istio.io/extraStatTags"] = "destination_locality"
-	// Update the pod
-	_, err = clientset.CoreV1().Pods(pod.Namespace).Update(context.TODO(), pod, metav1.UpdateOptions{})
+	ns, err := namespaceLister.Get(namespace)
 	if err != nil {
-		log.Printf("error in updating pod: %v\n", err)
-		return
+		log.Printf("error in getting namespace %v: %v\n", namespace, err)
+		return ""
 	}
-	log.Printf("Pod %v updated\n", pod.Name)
+	if ns.Annotations[exemptAnnotation] == "true" {
+		return "namespace annotated " + exemptAnnotation
+	}
+	return ""
 }
 
-// watchAndLabelPod watches for pod creation and labels the pod with the node locality.
+// watchAndLabelPods watches pods, and labels them with the locality of their node once
+// they're scheduled.
 func watchAndLabelPods(stopCh <-chan struct{}) {
 	log.Printf("labeling pods in namespaces %v...", namespaces)
 	informerIndex := map[string]cache.SharedInformer{}
@@ -132,11 +179,12 @@ func watchAndLabelPods(stopCh <-chan struct{}) {
 	}
 	for _, informer := range informerIndex {
 		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
-			AddFunc: addPodEventHandler,
+			AddFunc: handlePod,
+			// pods are usually created before they're scheduled
+			UpdateFunc: func(_, obj interface{}) { handlePod(obj) },
 		})
-		informer.Run(stopCh)
+		go informer.Run(stopCh)
 	}
-	defer runtime2.HandleCrash()
 }
 
 var deserializer = codecs.UniversalDeserializer()
@@ -169,61 +217,101 @@ func mutatePod(w http.ResponseWriter, r *http.Request) {
 	//podResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "pods"}
 	//deploymentResource := metav1.GroupVersionResource{Group: "", Version: "v1", Resource: "deployments"}
 	resourceType := admissionReviewRequest.Request.Resource
-	if resourceType.Resource != "deployments" && resourceType.Resource != "pods" {
-		logger.Printf("unexpected resource of type %q, expected a pod/deployment", admissionReviewRequest.Request.Resource.Resource)
+	kind, isWorkload := workloadKindOf(workloadKinds, resourceType)
+	if !isWorkload && resourceType.Resource != "pods" {
+		logger.Printf("unexpected resource of type %q, expected a pod or workload", admissionReviewRequest.Request.Resource.Resource)
 		http.Error(w, "unexpected resource", http.StatusBadRequest)
 		return
 	}
 
-	// Decode AdmissionReview to pod or deployment.
+	// Decode AdmissionReview to pod or workload.
 	raw := admissionReviewRequest.Request.Object.Raw
-	var admissionReviewResponse admissionv1.AdmissionReview
 	admissionResponse := &admissionv1.AdmissionResponse{
 		Allowed: true,
 	}
-	var patch string
+	var patch []jsonPatchOp
 	// todo this should probably be deleted at some point
 	if resourceType.Resource == "pods" {
-		pod := corev1.Pod{}
-		if _, _, err := deserializer.Decode(raw, nil, &pod); err != nil {
+		pod := &corev1.Pod{}
+		if _, _, err := deserializer.Decode(raw, nil, pod); err != nil {
 			logger.Printf("decoding raw pod: %v", err)
 			http.Error(w, "failed to decode pod", http.StatusInternalServerError)
 			return
 		}
-		// todo custom configure cloud
-		podLocality, err := getNodeLocality(pod.Spec.NodeName, "gcp")
-		if err != nil {
+		if reason := skipReason(admissionReviewRequest.Request.Namespace, pod.Labels); reason != "" {
+			log.Printf("skipping pod %v: %v", pod.Name, reason)
+			writeAdmissionResponse(w, admissionReviewRequest, admissionResponse)
+			return
+		}
+		// pods are usually scheduled after they're created, and labelled then by the pod
+		// informer. Those created on a node already are labelled here.
+		if pod.Spec.NodeName == "" {
+			log.Printf("pod %v isn't scheduled yet, it's labelled once it is", pod.Name)
+			writeAdmissionResponse(w, admissionReviewRequest, admissionResponse)
+			return
+		}
+		podLocality, err := getNodeLocality(pod.Spec.NodeName, cloud)
+		if err != nil || podLocality == "" {
 			logger.Printf("unable to get locality from node info for pod %v, skipping patching locality\n", pod.Name)
+			writeAdmissionResponse(w, admissionReviewRequest, admissionResponse)
+			return
+		}
+		object := map[string]interface{}{}
+		if err := json.Unmarshal(raw, &object); err != nil {
+			logger.Printf("decoding raw pod: %v", err)
+			http.Error(w, "failed to decode pod", http.StatusInternalServerError)
+			return
 		}
 		log.Printf("editing pod %v for locality %v", pod.Name, podLocality)
-		patch = fmt.Sprintf(`[
-{"op":"add",
-"path":"/metadata/labels/locality","value": "%v"}
-]`, podLocality)
+		tags, _ := mergeStatTags(pod.Annotations[extraStatTagsAnnotation])
+		patch = setPatch(object, []string{"metadata", "labels"}, map[string]string{localityLabel: podLocality})
+		patch = append(patch, setPatch(object, []string{"metadata", "annotations"}, map[string]string{extraStatTagsAnnotation: tags, mutatedAnnotation: "true"})...)
 	} else {
-		// handle deployments
-		deployment := v1.Deployment{}
-		if _, _, err := deserializer.Decode(raw, nil, &deployment); err != nil {
-			logger.Printf("decoding raw deployment: %v", err)
-			http.Error(w, "failed to decode deployment", http.StatusInternalServerError)
+		// handle workloads
+		workload := &unstructured.Unstructured{}
+		if err := workload.UnmarshalJSON(raw); err != nil {
+			logger.Printf("decoding raw %v: %v", kind.Resource, err)
+			http.Error(w, "failed to decode "+kind.Resource, http.StatusInternalServerError)
+			return
+		}
+		if reason := skipReason(admissionReviewRequest.Request.Namespace, workload.GetLabels()); reason != "" {
+			log.Printf("skipping %v %v: %v", kind.Resource, workload.GetName(), reason)
+			writeAdmissionResponse(w, admissionReviewRequest, admissionResponse)
+			return
+		}
+		if _, ok, _ := unstructured.NestedMap(workload.Object, kind.templateFields()...); !ok {
+			// like a rollout referencing the template of another workload
+			log.Printf("skipping %v %v: no pod template at %v", kind.Resource, workload.GetName(), kind.TemplatePath)
+			writeAdmissionResponse(w, admissionReviewRequest, admissionResponse)
+			return
 		}
-		log.Printf("editing deployment %v, adding destination_pod...", deployment.Name)
-		// we need to add the metadata/annotations key if it doesn't exist.
-		annotationPatch := ""
-		if len(deployment.Spec.Template.Annotations) == 0 {
-			annotationPatch = `{"op":"add","path":"/spec/template/metadata/annotations","value":{}},`
+		annotationFields := append(kind.templateFields(), "metadata", "annotations")
+		annotations, _, _ := unstructured.NestedStringMap(workload.Object, annotationFields...)
+		// keep the tags already there
+		tags, changed := mergeStatTags(annotations[extraStatTagsAnnotation])
+		if !changed {
+			log.Printf("skipping %v %v: already tagged", kind.Resource, workload.GetName())
+			writeAdmissionResponse(w, admissionReviewRequest, admissionResponse)
+			return
 		}
-		log.Printf("annotationPatch: %v", annotationPatch)
-		patch = fmt.Sprintf(`[%v
-{"op":"add",
-"path":"/spec/template/metadata/annotations/sidecar.istio.io~1extraStatTags","value": "destination_locality"}]`, annotationPatch)
+		log.Printf("editing %v %v, adding %v...", kind.Resource, workload.GetName(), localityTag)
+		patch = setPatch(workload.Object, annotationFields, map[string]string{extraStatTagsAnnotation: tags})
+		// and mark the workload, for destroy
+		patch = append(patch, setPatch(workload.Object, []string{"metadata", "annotations"}, map[string]string{mutatedAnnotation: "true"})...)
 	}
 
 	// Construct response
-	patchType := admissionv1.PatchTypeJSONPatch
-	admissionResponse.PatchType = &patchType
-	admissionResponse.Patch = []byte(patch)
+	if len(patch) > 0 {
+		patchType := admissionv1.PatchTypeJSONPatch
+		admissionResponse.PatchType = &patchType
+		admissionResponse.Patch = marshalPatch(patch)
+	}
+	writeAdmissionResponse(w, admissionReviewRequest, admissionResponse)
+}
 
+// writeAdmissionResponse writes the review of request with response.
+func writeAdmissionResponse(w http.ResponseWriter, admissionReviewRequest *admissionv1.AdmissionReview, admissionResponse *admissionv1.AdmissionResponse) {
+	var admissionReviewResponse admissionv1.AdmissionReview
 	admissionReviewResponse.Response = admissionResponse
 	admissionReviewResponse.SetGroupVersionKind(admissionReviewRequest.GroupVersionKind())
 	admissionReviewResponse.Response.UID = admissionReviewRequest.Request.UID
@@ -262,7 +350,7 @@ func getNodeLocality(name, cloud string) (string, error) {
 
 // getNodeLabel returns the value of the label on the node with the given name.
 func getNodeLabel(name, label string) (string, error) {
-	node, err := clientset.CoreV1().Nodes().Get(context.TODO(), name, metav1.GetOptions{})
+	node, err := nodeLister.Get(name)
 	if err != nil {
 		fmt.Printf("error in getting node %v: %v\n", name, err)
 		return "", err
@@ -270,21 +358,16 @@ func getNodeLabel(name, label string) (string, error) {
 	return node.Labels[label], nil
 }
 
-func runWebhookServer(certFile, keyFile string, port int) error {
-	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
-	if err != nil {
-		return err
-	}
-
+func runWebhookServer(getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error), port int) error {
 	http.HandleFunc("/mutate", mutatePod)
 
 	server := http.Server{
 		Addr: fmt.Sprintf(":%d", port),
 		TLSConfig: &tls.Config{
-			Certificates: []tls.Certificate{cert},
+			GetCertificate: getCertificate,
 		},
 		ErrorLog: logger,
 	}
 
-	return server.ListenAndServeTLS(certFile, keyFile)
+	return server.ListenAndServeTLS("", "")
 }
@@ -3,19 +3,50 @@ package main
 import (
 	"bytes"
 	_ "embed"
+	"encoding/json"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	jsonpatch "github.com/evanphx/json-patch"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
 )
 
 //go:embed testdata/admission-webhook.json
 var reqBody string
 
+// workloadKindsConfig is WORKLOAD_KINDS as setup sets it for the default kinds. The cli's
+// tests check it still matches them.
+//
+//go:embed testdata/workload-kinds.json
+var workloadKindsConfig string
+
+// testWorkloadKinds returns the default kinds, loaded like the webhook does.
+func testWorkloadKinds(t *testing.T) []workloadKind {
+	kinds, err := loadWorkloadKinds(workloadKindsConfig)
+	require.NoError(t, err)
+	return kinds
+}
+
+// setClientset has the webhook use a fake clientset with objects, and listers of them.
+func setClientset(t *testing.T, objects ...runtime.Object) {
+	clientset = fake.NewSimpleClientset(objects...)
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	startListers(clientset, stopCh)
+}
+
 func TestServer(t *testing.T) {
+	setClientset(t, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}})
 	srv := httptest.NewServer(http.HandlerFunc(mutatePod))
 	defer srv.Close()
 
@@ -29,3 +60,288 @@ func TestServer(t *testing.T) {
 	t.Logf("Response body: %s\n", body)
 	assert.Equal(t, http.StatusOK, res.StatusCode)
 }
+
+// review returns an admission review of creating obj, a resource in namespace.
+func review(t *testing.T, resource metav1.GroupVersionResource, namespace string, obj map[string]interface{}) []byte {
+	raw, err := json.Marshal(obj)
+	require.NoError(t, err)
+	body, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "1234",
+			Resource:  resource,
+			Namespace: namespace,
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	require.NoError(t, err)
+	return body
+}
+
+func TestMutatePod_Workloads(t *testing.T) {
+	deployments := metav1.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	cronJobs := metav1.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"}
+	workload := func(kind string, labels map[string]interface{}, template map[string]interface{}) map[string]interface{} {
+		obj := map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       kind,
+			"metadata":   map[string]interface{}{"name": "reviews", "labels": labels},
+			"spec":       map[string]interface{}{"template": template},
+		}
+		if kind == "CronJob" {
+			obj["apiVersion"] = "batch/v1"
+			obj["spec"] = map[string]interface{}{"jobTemplate": map[string]interface{}{"spec": map[string]interface{}{"template": template}}}
+		}
+		return obj
+	}
+	withAnnotations := func(annotations map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"metadata": map[string]interface{}{"annotations": annotations}, "spec": map[string]interface{}{}}
+	}
+	tests := []struct {
+		name      string
+		resource  metav1.GroupVersionResource
+		namespace string
+		object    map[string]interface{}
+		// wantTags is the extraStatTags annotation after the patch, empty for no patch
+		wantTags string
+		// wantOps is how many operations the patch has
+		wantOps int
+	}{
+		{
+			name:      "no annotations",
+			resource:  deployments,
+			namespace: "default",
+			object:    workload("Deployment", nil, map[string]interface{}{"metadata": map[string]interface{}{"labels": map[string]interface{}{"app": "reviews"}}}),
+			wantTags:  "destination_locality",
+			wantOps:   2,
+		},
+		{
+			name:      "no template metadata",
+			resource:  deployments,
+			namespace: "default",
+			object:    workload("Deployment", nil, map[string]interface{}{"spec": map[string]interface{}{}}),
+			wantTags:  "destination_locality",
+			wantOps:   2,
+		},
+		{
+			name:      "other annotations",
+			resource:  deployments,
+			namespace: "default",
+			object:    workload("Deployment", nil, withAnnotations(map[string]interface{}{"prometheus.io/scrape": "true"})),
+			wantTags:  "destination_locality",
+			wantOps:   2,
+		},
+		{
+			name:      "other tags are kept",
+			resource:  deployments,
+			namespace: "default",
+			object:    workload("Deployment", nil, withAnnotations(map[string]interface{}{extraStatTagsAnnotation: "request_host, upstream_cluster"})),
+			wantTags:  "request_host,upstream_cluster,destination_locality",
+			wantOps:   2,
+		},
+		{
+			name:      "already tagged",
+			resource:  deployments,
+			namespace: "default",
+			object:    workload("Deployment", nil, withAnnotations(map[string]interface{}{extraStatTagsAnnotation: "request_host,destination_locality"})),
+		},
+		{
+			name:      "cron job",
+			resource:  cronJobs,
+			namespace: "default",
+			object:    workload("CronJob", nil, map[string]interface{}{"spec": map[string]interface{}{}}),
+			wantTags:  "destination_locality",
+			wantOps:   2,
+		},
+		{
+			name:      "excluded",
+			resource:  deployments,
+			namespace: "default",
+			object:    workload("Deployment", map[string]interface{}{excludeLabel: "true"}, map[string]interface{}{"spec": map[string]interface{}{}}),
+		},
+		{
+			name:      "exempt namespace",
+			resource:  deployments,
+			namespace: "exempt",
+			object:    workload("Deployment", nil, map[string]interface{}{"spec": map[string]interface{}{}}),
+		},
+	}
+	setClientset(t,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "exempt", Annotations: map[string]string{exemptAnnotation: "true"}}},
+	)
+	workloadKinds = testWorkloadKinds(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/mutate", bytes.NewReader(review(t, tt.resource, tt.namespace, tt.object)))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			mutatePod(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+			res := admissionv1.AdmissionReview{}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+			assert.True(t, res.Response.Allowed)
+			assert.Equal(t, types.UID("1234"), res.Response.UID)
+			if tt.wantTags == "" {
+				assert.Empty(t, res.Response.Patch)
+				return
+			}
+			ops := make([]jsonPatchOp, 0)
+			require.NoError(t, json.Unmarshal(res.Response.Patch, &ops))
+			assert.Len(t, ops, tt.wantOps)
+
+			patch, err := jsonpatch.DecodePatch(res.Response.Patch)
+			require.NoError(t, err)
+			raw, _ := json.Marshal(tt.object)
+			patched, err := patch.Apply(raw)
+			require.NoError(t, err)
+			obj := &unstructured.Unstructured{}
+			require.NoError(t, obj.UnmarshalJSON(patched))
+			kind, _ := workloadKindOf(workloadKinds, tt.resource)
+			annotations, _, _ := unstructured.NestedStringMap(obj.Object, append(kind.templateFields(), "metadata", "annotations")...)
+			assert.Equal(t, tt.wantTags, annotations[extraStatTagsAnnotation])
+			// other annotations are kept
+			original, _, _ := unstructured.NestedStringMap(tt.object, append(kind.templateFields(), "metadata", "annotations")...)
+			for k, v := range original {
+				if k != extraStatTagsAnnotation {
+					assert.Equal(t, v, annotations[k])
+				}
+			}
+			assert.Equal(t, "true", obj.GetAnnotations()[mutatedAnnotation])
+		})
+	}
+}
+
+func TestSetPatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		obj    string
+		fields []string
+		values map[string]string
+		want   string
+	}{
+		{
+			name:   "missing parent",
+			obj:    `{"spec":{}}`,
+			fields: []string{"spec", "template", "metadata", "annotations"},
+			values: map[string]string{"a/b": "c"},
+			want:   `[{"op":"add","path":"/spec/template","value":{"metadata":{"annotations":{"a/b":"c"}}}}]`,
+		},
+		{
+			name:   "missing map",
+			obj:    `{"metadata":{}}`,
+			fields: []string{"metadata", "labels"},
+			values: map[string]string{"locality": "us-west1-a"},
+			want:   `[{"op":"add","path":"/metadata/labels","value":{"locality":"us-west1-a"}}]`,
+		},
+		{
+			name:   "escaped keys",
+			obj:    `{"metadata":{"annotations":{"x~y/z":"1"}}}`,
+			fields: []string{"metadata", "annotations"},
+			values: map[string]string{"x~y/z": "2", "cost-analyzer.tetrate.io/mutated": "true"},
+			want:   `[{"op":"add","path":"/metadata/annotations/cost-analyzer.tetrate.io~1mutated","value":"true"},{"op":"replace","path":"/metadata/annotations/x~0y~1z","value":"2"}]`,
+		},
+		{
+			name:   "empty value",
+			obj:    `{"metadata":{"annotations":{"a":"b"}}}`,
+			fields: []string{"metadata", "annotations"},
+			values: map[string]string{"a": ""},
+			want:   `[{"op":"replace","path":"/metadata/annotations/a","value":""}]`,
+		},
+		{
+			name:   "empty map",
+			obj:    `{"metadata":{}}`,
+			fields: []string{"metadata", "annotations"},
+			values: map[string]string{},
+			want:   `[{"op":"add","path":"/metadata/annotations","value":{}}]`,
+		},
+		{
+			name:   "unchanged",
+			obj:    `{"metadata":{"labels":{"locality":"us-west1-a"}}}`,
+			fields: []string{"metadata", "labels"},
+			values: map[string]string{"locality": "us-west1-a"},
+			want:   `[]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			obj := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal([]byte(tt.obj), &obj))
+			assert.JSONEq(t, tt.want, string(marshalPatch(setPatch(obj, tt.fields, tt.values))))
+		})
+	}
+}
+
+func TestMergeStatTags(t *testing.T) {
+	tests := []struct {
+		tags        string
+		want        string
+		wantChanged bool
+	}{
+		{tags: "", want: "destination_locality", wantChanged: true},
+		{tags: "request_host", want: "request_host,destination_locality", wantChanged: true},
+		{tags: " request_host , ,upstream_cluster", want: "request_host,upstream_cluster,destination_locality", wantChanged: true},
+		{tags: "destination_locality", want: "destination_locality"},
+		{tags: "request_host, destination_locality", want: "request_host, destination_locality"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.tags, func(t *testing.T) {
+			got, changed := mergeStatTags(tt.tags)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.wantChanged, changed)
+		})
+	}
+}
+
+func TestMutatePod_Pods(t *testing.T) {
+	pods := metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
+	pod := func(nodeName string) map[string]interface{} {
+		return map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"metadata":   map[string]interface{}{"name": "reviews-1"},
+			"spec":       map[string]interface{}{"nodeName": nodeName},
+		}
+	}
+	tests := []struct {
+		name         string
+		object       map[string]interface{}
+		wantLocality string
+	}{
+		{name: "not scheduled", object: pod("")},
+		{name: "scheduled", object: pod("node-1"), wantLocality: "us-west1-a"},
+		{name: "unknown node", object: pod("node-2")},
+	}
+	setClientset(t,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}},
+		&corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{"topology.kubernetes.io/zone": "us-west1-a"}}},
+	)
+	cloud = "gcp"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/mutate", bytes.NewReader(review(t, pods, "default", tt.object)))
+			req.Header.Set("Content-Type", "application/json")
+			rec := httptest.NewRecorder()
+			mutatePod(rec, req)
+			require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+
+			res := admissionv1.AdmissionReview{}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &res))
+			if tt.wantLocality == "" {
+				assert.Empty(t, res.Response.Patch)
+				return
+			}
+			patch, err := jsonpatch.DecodePatch(res.Response.Patch)
+			require.NoError(t, err)
+			raw, _ := json.Marshal(tt.object)
+			patched, err := patch.Apply(raw)
+			require.NoError(t, err)
+			obj := &unstructured.Unstructured{}
+			require.NoError(t, obj.UnmarshalJSON(patched))
+			assert.Equal(t, tt.wantLocality, obj.GetLabels()[localityLabel])
+			assert.Equal(t, localityTag, obj.GetAnnotations()[extraStatTagsAnnotation])
+		})
+	}
+}
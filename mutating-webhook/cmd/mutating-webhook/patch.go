@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+const (
+	// extraStatTagsAnnotation lists the tags the sidecar adds to istio's metrics, separated
+	// by commas.
+	extraStatTagsAnnotation = "sidecar.istio.io/extraStatTags"
+	localityTag             = "destination_locality"
+)
+
+// mergeStatTags appends destination_locality to the comma-separated tags, unless they
+// already have it. It returns whether they changed.
+func mergeStatTags(tags string) (string, bool) {
+	merged := make([]string, 0)
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			if tag == localityTag {
+				return tags, false
+			}
+			merged = append(merged, tag)
+		}
+	}
+	return strings.Join(append(merged, localityTag), ","), true
+}
+
+// hasLocalityTag returns whether the comma-separated tags have destination_locality.
+func hasLocalityTag(tags string) bool {
+	_, changed := mergeStatTags(tags)
+	return !changed
+}
+
+// jsonPatchOp is an add or replace operation of a JSON patch. Both need a value, so it's
+// sent even when empty.
+type jsonPatchOp struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+func marshalPatch(patch []jsonPatchOp) []byte {
+	data, _ := json.Marshal(patch)
+	return data
+}
+
+// escapeJSONPointer escapes a map key, like an annotation, for a JSON pointer.
+func escapeJSONPointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// jsonPointer returns the JSON pointer to fields.
+func jsonPointer(fields ...string) string {
+	escaped := make([]string, 0, len(fields))
+	for _, f := range fields {
+		escaped = append(escaped, escapeJSONPointer(f))
+	}
+	return "/" + strings.Join(escaped, "/")
+}
+
+// setPatch returns the patch setting the keys in values of the map at fields of obj, like
+// the labels in an object's metadata, only adding what's missing: the map, or the object
+// holding it, if they don't exist, and keys that don't have the value.
+func setPatch(obj map[string]interface{}, fields []string, values map[string]string) []jsonPatchOp {
+	// the deepest of fields that exists
+	parent := obj
+	for i, f := range fields {
+		child, ok := parent[f].(map[string]interface{})
+		if !ok {
+			// add it, with what's under it
+			var value interface{} = stringMap(values)
+			for j := len(fields) - 1; j > i; j-- {
+				value = map[string]interface{}{fields[j]: value}
+			}
+			return []jsonPatchOp{{Op: "add", Path: jsonPointer(fields[:i+1]...), Value: value}}
+		}
+		parent = child
+	}
+	patch := make([]jsonPatchOp, 0, len(values))
+	for _, key := range sortedKeys(values) {
+		current, ok := parent[key]
+		if ok && current == values[key] {
+			continue
+		}
+		op := "add"
+		if ok {
+			op = "replace"
+		}
+		path := jsonPointer(fields...) + "/" + escapeJSONPointer(key)
+		patch = append(patch, jsonPatchOp{Op: op, Path: path, Value: values[key]})
+	}
+	return patch
+}
+
+func stringMap(values map[string]string) map[string]interface{} {
+	m := make(map[string]interface{}, len(values))
+	for k, v := range values {
+		m[k] = v
+	}
+	return m
+}
+
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
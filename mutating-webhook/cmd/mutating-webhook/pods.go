@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// localityLabel is the label with the locality of the node a pod runs on.
+const localityLabel = "locality"
+
+// podLabelled returns whether pod has the locality label and stats tag already.
+func podLabelled(pod *corev1.Pod) bool {
+	return pod.Labels[localityLabel] != "" && hasLocalityTag(pod.Annotations[extraStatTagsAnnotation])
+}
+
+// nodesWithoutLocality holds the names of the nodes found without a locality, so the
+// pods on them are only reported once.
+var nodesWithoutLocality sync.Map
+
+// handlePod labels pod once it's scheduled, for the pod informer.
+func handlePod(obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok || pod.Spec.NodeName == "" || podLabelled(pod) {
+		// not scheduled yet, or done
+		return
+	}
+	if locality, err := getNodeLocality(pod.Spec.NodeName, cloud); err != nil || locality == "" {
+		if _, reported := nodesWithoutLocality.LoadOrStore(pod.Spec.NodeName, true); !reported {
+			log.Printf("node %v has no locality, not labelling its pods...\n", pod.Spec.NodeName)
+		}
+		return
+	}
+	if reason := skipReason(pod.Namespace, pod.Labels); reason != "" {
+		log.Printf("skipping pod %v/%v: %v\n", pod.Namespace, pod.Name, reason)
+		return
+	}
+	if err := labelPod(context.TODO(), clientset, pod.Namespace, pod.Name); err != nil {
+		log.Printf("error in labelling pod %v/%v: %v\n", pod.Namespace, pod.Name, err)
+	}
+}
+
+// labelPod labels the pod name in namespace with the locality of its node, and annotates it
+// with the stats tag, with a patch that's retried if the pod changed meanwhile.
+func labelPod(ctx context.Context, client kubernetes.Interface, namespace, name string) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pod, err := client.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		patch, err := podPatch(pod)
+		if err != nil || patch == nil {
+			return err
+		}
+		log.Printf("labelling pod %v/%v\n", namespace, name)
+		_, err = client.CoreV1().Pods(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{})
+		return err
+	})
+}
+
+// podPatch returns the merge patch labelling pod with the locality of its node, or nil if
+// it isn't scheduled, its node has no locality, or it's labelled already. The patch has the
+// resourceVersion of pod, so it conflicts if the pod changed since.
+func podPatch(pod *corev1.Pod) ([]byte, error) {
+	if pod.Spec.NodeName == "" || podLabelled(pod) {
+		return nil, nil
+	}
+	locality, err := getNodeLocality(pod.Spec.NodeName, cloud)
+	if err != nil {
+		return nil, err
+	}
+	if locality == "" {
+		log.Printf("node %v of pod %v/%v has no locality, skipping...\n", pod.Spec.NodeName, pod.Namespace, pod.Name)
+		return nil, nil
+	}
+	// keep the tags already there
+	tags, _ := mergeStatTags(pod.Annotations[extraStatTagsAnnotation])
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": pod.ResourceVersion,
+			"labels":          map[string]string{localityLabel: locality},
+			"annotations":     map[string]string{extraStatTagsAnnotation: tags, mutatedAnnotation: "true"},
+		},
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestLabelPod(t *testing.T) {
+	node := &corev1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node-1", Labels: map[string]string{
+		"topology.kubernetes.io/zone":   "us-west1-a",
+		"topology.kubernetes.io/region": "us-west1",
+	}}}
+	tests := []struct {
+		name         string
+		cloud        string
+		pod          *corev1.Pod
+		conflicts    int
+		wantLocality string
+		wantTags     string
+		wantPatches  int
+	}{
+		{
+			name:         "no labels or annotations",
+			cloud:        "gcp",
+			pod:          &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "reviews-1", Namespace: "default"}, Spec: corev1.PodSpec{NodeName: "node-1"}},
+			wantLocality: "us-west1-a",
+			wantTags:     "destination_locality",
+			wantPatches:  1,
+		},
+		{
+			name:  "region on aws, keeping other labels and tags",
+			cloud: "aws",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "reviews-1",
+					Namespace:   "default",
+					Labels:      map[string]string{"app": "reviews"},
+					Annotations: map[string]string{extraStatTagsAnnotation: "request_host"},
+				},
+				Spec: corev1.PodSpec{NodeName: "node-1"},
+			},
+			wantLocality: "us-west1",
+			wantTags:     "request_host,destination_locality",
+			wantPatches:  1,
+		},
+		{
+			name:  "not scheduled",
+			cloud: "gcp",
+			pod:   &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "reviews-1", Namespace: "default"}},
+		},
+		{
+			name:  "already labelled",
+			cloud: "gcp",
+			pod: &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "reviews-1",
+					Namespace:   "default",
+					Labels:      map[string]string{localityLabel: "us-west1-b"},
+					Annotations: map[string]string{extraStatTagsAnnotation: "destination_locality"},
+				},
+				Spec: corev1.PodSpec{NodeName: "node-1"},
+			},
+			wantLocality: "us-west1-b",
+			wantTags:     "destination_locality",
+		},
+		{
+			name:         "retried on conflict",
+			cloud:        "gcp",
+			pod:          &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "reviews-1", Namespace: "default"}, Spec: corev1.PodSpec{NodeName: "node-1"}},
+			conflicts:    2,
+			wantLocality: "us-west1-a",
+			wantTags:     "destination_locality",
+			wantPatches:  3,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setClientset(t, node, tt.pod)
+			client := clientset.(*fake.Clientset)
+			patches := 0
+			client.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				patches++
+				if patches <= tt.conflicts {
+					return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "pods"}, tt.pod.Name, nil)
+				}
+				return false, nil, nil
+			})
+			cloud = tt.cloud
+			require.NoError(t, labelPod(context.Background(), client, tt.pod.Namespace, tt.pod.Name))
+
+			pod, err := client.CoreV1().Pods(tt.pod.Namespace).Get(context.Background(), tt.pod.Name, metav1.GetOptions{})
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantPatches, patches)
+			assert.Equal(t, tt.wantLocality, pod.Labels[localityLabel])
+			assert.Equal(t, tt.wantTags, pod.Annotations[extraStatTagsAnnotation])
+			for k, v := range tt.pod.Labels {
+				if k != localityLabel {
+					assert.Equal(t, v, pod.Labels[k])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// workloadKind is a kind of workload with a pod template. It must match pkg.WorkloadKind
+// in the cli, which passes the kinds to handle in the WORKLOAD_KINDS environment variable.
+type workloadKind struct {
+	Group    string `json:"group,omitempty"`
+	Version  string `json:"version"`
+	Kind     string `json:"kind"`
+	Resource string `json:"resource"`
+	// TemplatePath is the dot-separated path of the pod template, like spec.template.
+	TemplatePath string `json:"templatePath"`
+	// Immutable kinds can't have their pod template changed once created, so existing ones
+	// aren't annotated.
+	Immutable bool `json:"immutable,omitempty"`
+}
+
+// loadWorkloadKinds parses the kinds in config, a JSON list. The kinds are only ever taken
+// from setup, so they can't drift from the ones the webhook configuration routes here; if
+// config is empty, no workloads are handled and only pods are labelled.
+func loadWorkloadKinds(config string) ([]workloadKind, error) {
+	if config == "" {
+		return nil, nil
+	}
+	kinds := make([]workloadKind, 0)
+	if err := json.Unmarshal([]byte(config), &kinds); err != nil {
+		return nil, fmt.Errorf("invalid WORKLOAD_KINDS: %v", err)
+	}
+	return kinds, nil
+}
+
+// workloadKindOf returns the kind of resource among kinds.
+func workloadKindOf(kinds []workloadKind, resource metav1.GroupVersionResource) (workloadKind, bool) {
+	for _, k := range kinds {
+		if k.Group == resource.Group && k.Resource == resource.Resource {
+			return k, true
+		}
+	}
+	return workloadKind{}, false
+}
+
+func (k workloadKind) groupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: k.Group, Version: k.Version, Resource: k.Resource}
+}
+
+// templateFields returns the fields of the pod template in objects of the kind.
+func (k workloadKind) templateFields() []string {
+	return strings.Split(k.TemplatePath, ".")
+}
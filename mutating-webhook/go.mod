@@ -3,6 +3,7 @@ module github.com/tetratelabs/istio-cost-analyzer/mutating-webhook
 go 1.17
 
 require (
+	github.com/evanphx/json-patch v4.12.0+incompatible
 	github.com/stretchr/testify v1.7.0
 	k8s.io/api v0.23.5
 	k8s.io/apimachinery v0.23.5
@@ -14,7 +15,6 @@ require (
 	github.com/beorn7/perks v1.0.1 // indirect
 	github.com/cespare/xxhash/v2 v2.1.1 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
-	github.com/evanphx/json-patch v4.12.0+incompatible // indirect
 	github.com/fsnotify/fsnotify v1.5.1 // indirect
 	github.com/go-logr/logr v1.2.0 // indirect
 	github.com/gogo/protobuf v1.3.2 // indirect
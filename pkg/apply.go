@@ -0,0 +1,86 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// FieldManager is the field manager setup applies objects with, so the fields it sets are
+// owned by it rather than by whoever else edits the objects.
+const FieldManager = "istio-cost-analyzer"
+
+// ApplyManifest server-side applies a manifest, creating the object or updating the fields
+// the manifest sets. Fields owned by other field managers are taken over, so changes made
+// to them outside setup are reverted.
+func (k *KubeClient) ApplyManifest(m Manifest) error {
+	data, err := json.Marshal(m.Object)
+	if err != nil {
+		return err
+	}
+	force := true
+	_, err = k.dynamic.Resource(m.Resource).Namespace(m.Object.GetNamespace()).Patch(context.TODO(), m.Object.GetName(), types.ApplyPatchType, data, metav1.PatchOptions{
+		FieldManager: FieldManager,
+		Force:        &force,
+	})
+	return err
+}
+
+// DeleteObject deletes an object setup created.
+func (k *KubeClient) DeleteObject(ref ObjectRef) error {
+	return k.dynamic.Resource(ref.GroupVersionResource()).Namespace(ref.Namespace).Delete(context.TODO(), ref.Name, metav1.DeleteOptions{})
+}
+
+// Stale returns the objects a previous setup created that aren't in manifests anymore,
+// like the roles of namespaces that aren't targeted anymore.
+func (r *SetupRecord) Stale(manifests []Manifest) []ObjectRef {
+	desired := make(map[ObjectRef]bool, len(manifests))
+	for _, m := range manifests {
+		desired[RefOf(m)] = true
+	}
+	stale := make([]ObjectRef, 0)
+	for _, ref := range r.Created {
+		if !desired[ref] {
+			stale = append(stale, ref)
+		}
+	}
+	return stale
+}
+
+// manifestHash is a hash of what a manifest sets.
+func manifestHash(m Manifest) string {
+	data, _ := json.Marshal(m.Object)
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// SetApplied records that setup applied a manifest.
+func (r *SetupRecord) SetApplied(m Manifest) {
+	if r.Applied == nil {
+		r.Applied = make(map[string]string)
+	}
+	r.Applied[RefOf(m).String()] = manifestHash(m)
+}
+
+// Drifted returns whether a change is to revert edits made outside setup: the object
+// differs from the manifest, but the manifest is the one setup last applied.
+func (r *SetupRecord) Drifted(c ManifestChange) bool {
+	return c.Exists && c.Diff != "" && r.Applied[RefOf(c.Manifest).String()] == manifestHash(c.Manifest)
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// applyReactor handles server-side apply patches, which the fake client doesn't support,
+// by replacing the object with the patch.
+func applyReactor(client *dynamicfake.FakeDynamicClient) k8stesting.ReactionFunc {
+	return func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patch := action.(k8stesting.PatchAction)
+		if patch.GetPatchType() != types.ApplyPatchType {
+			return false, nil, nil
+		}
+		obj := &unstructured.Unstructured{}
+		if err := obj.UnmarshalJSON(patch.GetPatch()); err != nil {
+			return true, nil, err
+		}
+		err := client.Tracker().Create(action.GetResource(), obj, action.GetNamespace())
+		if apierrors.IsAlreadyExists(err) {
+			err = client.Tracker().Update(action.GetResource(), obj, action.GetNamespace())
+		}
+		return true, obj, err
+	}
+}
+
+func TestKubeClient_ApplyManifest(t *testing.T) {
+	manifestsFor := func(targets ...string) []Manifest {
+		objects, err := NewSetupObjects(SetupConfig{AnalyzerNamespace: "istio-system", TargetNamespaces: targets})
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifests, err := objects.Manifests()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return []Manifest{manifestOf(t, manifests, "Deployment")}
+	}
+	client := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	client.PrependReactor("patch", "*", applyReactor(client))
+	k := &KubeClient{dynamic: client}
+	record := &SetupRecord{}
+	deployment := manifestsFor("default")[0]
+	if err := k.ApplyManifest(deployment); err != nil {
+		t.Fatal(err)
+	}
+	record.SetApplied(deployment)
+
+	// scaled down outside setup
+	live := deployment.Object.DeepCopy()
+	_ = unstructured.SetNestedField(live.Object, int64(0), "spec", "replicas")
+	if err := client.Tracker().Update(deployment.Resource, live, "istio-system"); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name        string
+		manifests   []Manifest
+		wantDrifted bool
+	}{
+		{
+			name:        "same options",
+			manifests:   manifestsFor("default"),
+			wantDrifted: true,
+		},
+		{
+			name:      "new target namespaces",
+			manifests: manifestsFor("default", "shop"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changes, err := k.PlanManifests(tt.manifests)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !changes[0].Exists || changes[0].Diff == "" {
+				t.Fatalf("exists = %v, diff = %q, want changed", changes[0].Exists, changes[0].Diff)
+			}
+			if got := record.Drifted(changes[0]); got != tt.wantDrifted {
+				t.Errorf("Drifted() = %v, want %v", got, tt.wantDrifted)
+			}
+		})
+	}
+
+	if err := k.ApplyManifest(deployment); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := k.PlanManifests([]Manifest{deployment})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes[0].Diff != "" {
+		t.Errorf("diff after apply = %q, want none", changes[0].Diff)
+	}
+}
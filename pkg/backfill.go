@@ -0,0 +1,178 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	v13 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+const (
+	// BackfillAnnotation on a workload, set to false, opts it out of the backfill.
+	BackfillAnnotation = "cost-analyzer.tetrate.io/backfill"
+	// BackfillRoleName is the role letting the webhook hold BackfillLeaseName and save its
+	// report to BackfillReportName.
+	BackfillRoleName = "cost-analyzer-backfill"
+	// BackfillLeaseName is the Lease in the analyzer namespace the webhook replica doing the
+	// backfill holds, so only one does.
+	BackfillLeaseName = "cost-analyzer-backfill"
+	// BackfillReportName is the ConfigMap in the analyzer namespace the webhook saves the
+	// report of the backfill to.
+	BackfillReportName = "cost-analyzer-backfill-report"
+)
+
+// BackfillValues configure the webhook annotating the workloads that exist when it starts,
+// which restarts their pods. It's off by default.
+type BackfillValues struct {
+	Enabled bool `json:"enabled,omitempty"`
+	// BatchSize is how many workloads are restarted at a time. Their rollouts are waited for
+	// before the next ones are restarted. It defaults to 1.
+	BatchSize int32 `json:"batchSize,omitempty"`
+	// RolloutTimeout is how long a rollout is waited for. If one doesn't complete, the
+	// backfill stops. It defaults to 10m.
+	RolloutTimeout *metav1.Duration `json:"rolloutTimeout,omitempty"`
+	// Window is the daily maintenance window workloads are restarted in, in UTC, like
+	// 22:00-04:00. They're restarted at any time if it's empty. It's parsed by the webhook,
+	// which doesn't start with an invalid one.
+	Window string `json:"window,omitempty"`
+}
+
+// Override sets the fields set in o.
+func (v *BackfillValues) Override(o BackfillValues) {
+	if o.Enabled {
+		v.Enabled = true
+	}
+	if o.BatchSize != 0 {
+		v.BatchSize = o.BatchSize
+	}
+	if o.RolloutTimeout != nil {
+		v.RolloutTimeout = o.RolloutTimeout
+	}
+	if o.Window != "" {
+		v.Window = o.Window
+	}
+}
+
+func (v BackfillValues) validate() error {
+	if v.BatchSize < 0 {
+		return fmt.Errorf("backfill batchSize must be positive, got %v", v.BatchSize)
+	}
+	if v.RolloutTimeout != nil && v.RolloutTimeout.Duration <= 0 {
+		return fmt.Errorf("backfill rolloutTimeout must be positive, got %v", v.RolloutTimeout.Duration)
+	}
+	return nil
+}
+
+// backfillRules let the webhook hold BackfillLeaseName and save BackfillReportName.
+var backfillRules = []v13.PolicyRule{
+	{APIGroups: []string{"coordination.k8s.io"}, Resources: []string{"leases"}, Verbs: []string{"create"}},
+	{APIGroups: []string{"coordination.k8s.io"}, Resources: []string{"leases"}, Verbs: []string{"get", "update"}, ResourceNames: []string{BackfillLeaseName}},
+	{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"create"}},
+	{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"get", "update"}, ResourceNames: []string{BackfillReportName}},
+}
+
+// setBackfill passes the backfill values to the webhook, if it's enabled.
+func (s *SetupObjects) setBackfill(v BackfillValues) {
+	if !v.Enabled {
+		return
+	}
+	s.backfill = true
+	env := []v1.EnvVar{{Name: "BACKFILL", Value: "true"}}
+	if v.BatchSize != 0 {
+		env = append(env, v1.EnvVar{Name: "BACKFILL_BATCH_SIZE", Value: strconv.Itoa(int(v.BatchSize))})
+	}
+	if v.RolloutTimeout != nil {
+		env = append(env, v1.EnvVar{Name: "BACKFILL_ROLLOUT_TIMEOUT", Value: v.RolloutTimeout.Duration.String()})
+	}
+	if v.Window != "" {
+		env = append(env, v1.EnvVar{Name: "BACKFILL_WINDOW", Value: v.Window})
+	}
+	container := &s.Deployment.Spec.Template.Spec.Containers[0]
+	container.Env = append(container.Env, env...)
+}
+
+// BackfillResult is what the webhook's backfill did with a workload: restarted, skipped,
+// failed or pending.
+type BackfillResult struct {
+	Workload string `json:"workload"`
+	Outcome  string `json:"outcome"`
+	Detail   string `json:"detail,omitempty"`
+}
+
+// BackfillReport is the report the webhook saves as it backfills. Finished is nil while
+// it's backfilling.
+type BackfillReport struct {
+	Started  time.Time        `json:"started"`
+	Finished *time.Time       `json:"finished,omitempty"`
+	Results  []BackfillResult `json:"results"`
+}
+
+// GetBackfillReport returns the report of the webhook's backfill in namespace, or nil if
+// there's none.
+func (k *KubeClient) GetBackfillReport(namespace string) (*BackfillReport, error) {
+	cm, err := k.clientSet.CoreV1().ConfigMaps(namespace).Get(context.TODO(), BackfillReportName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	report := &BackfillReport{}
+	if err := json.Unmarshal([]byte(cm.Data["report"]), report); err != nil {
+		fmt.Printf("unable to unmarshal backfill report: %v", err)
+		return nil, err
+	}
+	return report, nil
+}
+
+// CheckBackfill checks the webhook's backfill in namespace restarted all the workloads it
+// didn't skip. It's passed if there was no backfill.
+func (k *KubeClient) CheckBackfill(namespace string) Check {
+	report, err := k.GetBackfillReport(namespace)
+	if err != nil {
+		return Check{Name: "backfill", Detail: err.Error()}
+	}
+	if report == nil {
+		return Check{Name: "backfill", Passed: true, Detail: "disabled, only new workloads are annotated"}
+	}
+	counts := make(map[string]int)
+	failed := make([]string, 0)
+	for _, r := range report.Results {
+		counts[r.Outcome]++
+		if r.Outcome == "failed" && len(failed) < maxExamples {
+			failed = append(failed, r.Workload+": "+r.Detail)
+		}
+	}
+	state := "finished"
+	if report.Finished == nil {
+		state = "running"
+	}
+	check := Check{
+		Name:   "backfill",
+		Passed: counts["failed"] == 0,
+		Detail: fmt.Sprintf("%v: %v restarted, %v skipped, %v failed, %v pending", state, counts["restarted"], counts["skipped"], counts["failed"], counts["pending"]),
+		Hint:   fmt.Sprintf("%v; see kubectl -n %v get configmap %v -o jsonpath='{.data.report}'", strings.Join(failed, ", "), namespace, BackfillReportName),
+	}
+	return check
+}
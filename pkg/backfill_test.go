@@ -0,0 +1,135 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestSetupObjects_Backfill(t *testing.T) {
+	tests := []struct {
+		name          string
+		backfill      BackfillValues
+		wantEnv       map[string]string
+		wantRole      bool
+		wantGenerated int
+		wantErr       bool
+	}{
+		{
+			name:          "disabled",
+			backfill:      BackfillValues{BatchSize: 3},
+			wantEnv:       map[string]string{},
+			wantGenerated: 1,
+		},
+		{
+			name:          "defaults",
+			backfill:      BackfillValues{Enabled: true},
+			wantEnv:       map[string]string{"BACKFILL": "true"},
+			wantRole:      true,
+			wantGenerated: 3,
+		},
+		{
+			name:          "batches in a window",
+			backfill:      BackfillValues{Enabled: true, BatchSize: 5, RolloutTimeout: &metav1.Duration{Duration: 5 * time.Minute}, Window: "22:00-04:00"},
+			wantEnv:       map[string]string{"BACKFILL": "true", "BACKFILL_BATCH_SIZE": "5", "BACKFILL_ROLLOUT_TIMEOUT": "5m0s", "BACKFILL_WINDOW": "22:00-04:00"},
+			wantRole:      true,
+			wantGenerated: 3,
+		},
+		{
+			name:     "negative batch size",
+			backfill: BackfillValues{Enabled: true, BatchSize: -1},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, err := NewSetupObjects(SetupConfig{AnalyzerNamespace: "istio-system", TargetNamespaces: []string{"default"}, Webhook: WebhookValues{Backfill: tt.backfill}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSetupObjects() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			env := make(map[string]string)
+			for _, e := range objects.Deployment.Spec.Template.Spec.Containers[0].Env {
+				if strings.HasPrefix(e.Name, "BACKFILL") {
+					env[e.Name] = e.Value
+				}
+			}
+			if !reflect.DeepEqual(env, tt.wantEnv) {
+				t.Errorf("env = %v, want %v", env, tt.wantEnv)
+			}
+			role := false
+			for _, r := range objects.Roles {
+				role = role || (r.Name == BackfillRoleName && r.Namespace == "istio-system")
+			}
+			if role != tt.wantRole {
+				t.Errorf("backfill role = %v, want %v", role, tt.wantRole)
+			}
+			if got := len(objects.Generated()); got != tt.wantGenerated {
+				t.Errorf("%v generated objects, want %v", got, tt.wantGenerated)
+			}
+		})
+	}
+}
+
+func TestKubeClient_CheckBackfill(t *testing.T) {
+	report := func(data string) *v1.ConfigMap {
+		return &v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: BackfillReportName, Namespace: "istio-system"}, Data: map[string]string{"report": data}}
+	}
+	tests := []struct {
+		name       string
+		report     *v1.ConfigMap
+		wantPassed bool
+		wantDetail string
+	}{
+		{
+			name:       "disabled",
+			wantPassed: true,
+			wantDetail: "disabled",
+		},
+		{
+			name:       "running",
+			report:     report(`{"started":"2022-06-01T00:00:00Z","results":[{"workload":"deployment default/a","outcome":"restarted"},{"workload":"deployment default/b","outcome":"pending"}]}`),
+			wantPassed: true,
+			wantDetail: "running: 1 restarted, 0 skipped, 0 failed, 1 pending",
+		},
+		{
+			name:       "failed rollout",
+			report:     report(`{"started":"2022-06-01T00:00:00Z","finished":"2022-06-01T00:10:00Z","results":[{"workload":"deployment default/a","outcome":"failed","detail":"rollout didn't complete"},{"workload":"deployment default/b","outcome":"skipped"}]}`),
+			wantDetail: "finished: 0 restarted, 1 skipped, 1 failed, 0 pending",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientSet := fake.NewSimpleClientset()
+			if tt.report != nil {
+				clientSet = fake.NewSimpleClientset(tt.report)
+			}
+			k := &KubeClient{clientSet: clientSet}
+			check := k.CheckBackfill("istio-system")
+			if check.Passed != tt.wantPassed || !strings.HasPrefix(check.Detail, tt.wantDetail) {
+				t.Errorf("CheckBackfill() = %+v, want passed %v and detail %q", check, tt.wantPassed, tt.wantDetail)
+			}
+		})
+	}
+}
@@ -20,58 +20,297 @@ import (
 	"math"
 	"os"
 	"sort"
+	"strings"
+	"time"
 )
 
+// CallKind distinguishes traffic that is priced differently.
+type CallKind string
+
+const (
+	// MeshCall is traffic between two workloads in the mesh.
+	MeshCall CallKind = ""
+	// InternetCall is traffic leaving the mesh to the internet. Its To is InternetDestination.
+	InternetCall CallKind = "internet"
+	// EgressGatewayCall is the hop from a workload to an egress gateway, on the way
+	// to the internet. Its To is the gateway's locality.
+	EgressGatewayCall CallKind = "egress-gateway"
+	// IngressGatewayCall is the hop from an ingress gateway to a workload, for traffic
+	// entering the mesh. Its Host is the public host the traffic was addressed to.
+	IngressGatewayCall CallKind = "ingress-gateway"
+	// EastWestGatewayCall is the hop from the east-west gateway of a remote cluster to the
+	// destination workload, for traffic between clusters.
+	EastWestGatewayCall CallKind = "east-west-gateway"
+)
+
+// InternetDestination is the destination locality of InternetCalls.
+const InternetDestination = "internet"
+
+// Call is the traffic over a link between two workloads, or a workload and the internet,
+// and what it costs. Its JSON form is part of the CostReport.
 type Call struct {
-	From         string
-	FromWorkload string
-	To           string
-	ToWorkload   string
-	CallCost     float64
-	CallSize     uint64
+	From         string  `json:"from"`
+	FromWorkload string  `json:"fromWorkload"`
+	To           string  `json:"to"`
+	ToWorkload   string  `json:"toWorkload"`
+	CallCost     float64 `json:"cost"`
+	// ListCost is the cost at the sheet's list rates, before any negotiated overlay.
+	ListCost float64 `json:"listCost"`
+	// ProcessingCost is the part of CallCost charged per GB by a NAT or load balancer
+	// the traffic went through.
+	ProcessingCost float64 `json:"processingCost,omitempty"`
+	CallSize       uint64  `json:"bytes"`
+	// Day is the UTC day the traffic was sent on, if the call only covers one day
+	// of the analysis window. It is zero otherwise.
+	Day  time.Time `json:"-"`
+	Kind CallKind  `json:"kind,omitempty"`
+	// Host is the public host traffic entering through an ingress gateway was addressed to.
+	Host string `json:"host,omitempty"`
+	// FromNamespace and ToNamespace are the namespaces of the source and destination
+	// workloads, if Istio reports them.
+	FromNamespace string `json:"fromNamespace,omitempty"`
+	ToNamespace   string `json:"toNamespace,omitempty"`
+	// FromCluster and ToCluster are the mesh clusters of the source and destination, if
+	// Istio reports them.
+	FromCluster string `json:"fromCluster,omitempty"`
+	ToCluster   string `json:"toCluster,omitempty"`
+	// Reporter is the sidecar that reported the call, "source" or "destination". Istio
+	// reports in-mesh calls from both sides, so it's cleared once MergeClusterCalls has
+	// counted each call once.
+	Reporter string `json:"-"`
+	// Estimated is set if To wasn't reported, but inferred from where the destination
+	// workload's replicas run.
+	Estimated bool `json:"estimated,omitempty"`
 }
 
 func (c *Call) String() string {
 	return fmt.Sprintf("%v (%v)->%v (%v) : %v", c.FromWorkload, c.From, c.ToWorkload, c.To, c.CallSize)
 }
 
-func (c *Call) StringCost() string {
-	return fmt.Sprintf("%v (%v)->%v (%v) : $%v", c.FromWorkload, c.From, c.ToWorkload, c.To, c.CallCost)
+// StringCost describes the call with its cost, formatted in currency.
+func (c *Call) StringCost(currency Currency) string {
+	return fmt.Sprintf("%v (%v)->%v (%v) : %v", c.FromWorkload, c.From, c.ToWorkload, c.To, currency.Format(c.CallCost))
+}
+
+// CollapseDays merges per-day calls into one call per link, summing their size and cost.
+func CollapseDays(calls []*Call) []*Call {
+	collapsed := make([]*Call, 0)
+	links := make(map[Call]*Call)
+	for _, v := range calls {
+		key := *v
+		key.Day, key.CallSize, key.CallCost, key.ListCost, key.ProcessingCost = time.Time{}, 0, 0, 0, 0
+		if c, ok := links[key]; ok {
+			c.CallSize += v.CallSize
+			c.CallCost += v.CallCost
+			c.ListCost += v.ListCost
+			c.ProcessingCost += v.ProcessingCost
+			continue
+		}
+		link := key
+		link.CallSize, link.CallCost, link.ListCost, link.ProcessingCost = v.CallSize, v.CallCost, v.ListCost, v.ProcessingCost
+		links[key] = &link
+		collapsed = append(collapsed, &link)
+	}
+	return collapsed
 }
 
-func PrintCostTable(calls []*Call, total float64, details bool) {
+// PrintCostTable prints the total cost and a table of costs per source workload, or per
+// link if details is set. Traffic entering the mesh through an ingress gateway is listed
+// separately, per public host, and so is traffic leaving the mesh, including the hop to an
+// egress gateway, per destination host. Amounts are formatted in the given currency.
+func PrintCostTable(calls []*Call, total float64, currency Currency, details bool) {
+	mesh, ingress, internet := make([]*Call, 0), make([]*Call, 0), make([]*Call, 0)
+	for _, v := range calls {
+		switch v.Kind {
+		case InternetCall, EgressGatewayCall:
+			internet = append(internet, v)
+		case IngressGatewayCall:
+			ingress = append(ingress, v)
+		default:
+			mesh = append(mesh, v)
+		}
+	}
+	// only show list prices if an overlay changed them
+	_, listTotal := sumCosts(calls)
+	discounted := math.Abs(listTotal-total) > 1e-9
 	// print total
-	fmt.Printf("\nTotal: %s\n\n", transformCost(total))
+	if discounted {
+		fmt.Printf("\nTotal: %s (list: %s)\n", currency.Format(total), currency.Format(listTotal))
+	} else {
+		fmt.Printf("\nTotal: %s\n", currency.Format(total))
+	}
+	if len(ingress) > 0 || len(internet) > 0 {
+		meshTotal, _ := sumCosts(mesh)
+		breakdown := []string{fmt.Sprintf("Mesh: %s", currency.Format(meshTotal))}
+		if len(ingress) > 0 {
+			ingressTotal, _ := sumCosts(ingress)
+			breakdown = append(breakdown, fmt.Sprintf("Ingress: %s", currency.Format(ingressTotal)))
+		}
+		if len(internet) > 0 {
+			internetTotal, _ := sumCosts(internet)
+			breakdown = append(breakdown, fmt.Sprintf("Internet egress: %s", currency.Format(internetTotal)))
+		}
+		fmt.Println(strings.Join(breakdown, ", "))
+	}
+	fmt.Println()
 	if !details {
-		printMinifiedCostTable(calls)
-		return
+		printMinifiedCostTable(mesh, currency, discounted)
+	} else {
+		printDetailedCostTable(mesh, currency, discounted)
+	}
+	if len(ingress) > 0 {
+		fmt.Printf("Ingress:\n\n")
+		printIngressCostTable(ingress, currency, discounted)
+	}
+	if len(internet) > 0 {
+		fmt.Printf("Internet egress:\n\n")
+		printInternetCostTable(internet, currency, discounted)
 	}
+	for _, v := range calls {
+		if v.Estimated {
+			fmt.Printf("Destination localities marked (estimated) are inferred from where the destination workloads' " +
+				"replicas run, assuming requests are spread evenly across them; their costs are estimates.\n")
+			break
+		}
+	}
+}
+
+// toLocality returns the destination locality to show in a report.
+func (c *Call) toLocality() string {
+	if c.Estimated {
+		return c.To + " (estimated)"
+	}
+	return c.To
+}
+
+// sumCosts returns the total cost and list cost of calls.
+func sumCosts(calls []*Call) (float64, float64) {
+	cost, list := 0.0, 0.0
+	for _, v := range calls {
+		cost += v.CallCost
+		list += v.ListCost
+	}
+	return cost, list
+}
+
+func printDetailedCostTable(calls []*Call, currency Currency, discounted bool) {
 	// sort by cost
 	sort.Slice(calls, func(i, j int) bool {
 		return calls[i].CallCost > calls[j].CallCost
 	})
 	table := tablewriter.NewWriter(os.Stdout)
-	headers := []string{"Source Service", "Source Locality", "Destination Service", "Destination Locality", "Transferred (MB)", "Cost"}
-	table.SetHeader(headers)
+	headers := []string{"Source Service", "Source Locality", "Destination Service", "Destination Locality", "Transferred (MB)"}
+	if discounted {
+		headers = append(headers, "List Cost")
+	}
+	table.SetHeader(append(headers, "Cost"))
 	for _, v := range calls {
-		values := []string{v.FromWorkload, v.From, v.ToWorkload, v.To, fmt.Sprintf("%f", float64(v.CallSize)/math.Pow(10, 6)), transformCost(v.CallCost)}
-		table.Append(values)
+		values := []string{v.FromWorkload, v.From, v.ToWorkload, v.toLocality(), fmt.Sprintf("%f", float64(v.CallSize)/math.Pow(10, 6))}
+		if discounted {
+			values = append(values, currency.Format(v.ListCost))
+		}
+		table.Append(append(values, currency.Format(v.CallCost)))
 	}
 	kubernetesify(table)
 	table.Render()
 	fmt.Println()
 }
 
-func printMinifiedCostTable(calls []*Call) {
-	callBySource := make(map[string]Call)
-	for i, v := range calls {
+func printInternetCostTable(calls []*Call, currency Currency, discounted bool) {
+	sort.Slice(calls, func(i, j int) bool {
+		return calls[i].CallCost > calls[j].CallCost
+	})
+	// only show processing charges if there are any
+	processing := false
+	for _, v := range calls {
+		processing = processing || v.ProcessingCost != 0
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	headers := []string{"Source Service", "Source Locality", "Destination Host", "Transferred (MB)"}
+	if discounted {
+		headers = append(headers, "List Cost")
+	}
+	if processing {
+		headers = append(headers, "Processing")
+	}
+	table.SetHeader(append(headers, "Cost"))
+	for _, v := range calls {
+		destination := v.ToWorkload
+		if v.Kind == EgressGatewayCall {
+			destination = fmt.Sprintf("%v (%v)", v.ToWorkload, v.toLocality())
+		}
+		values := []string{v.FromWorkload, v.From, destination, fmt.Sprintf("%f", float64(v.CallSize)/math.Pow(10, 6))}
+		if discounted {
+			values = append(values, currency.Format(v.ListCost))
+		}
+		if processing {
+			values = append(values, currency.Format(v.ProcessingCost))
+		}
+		table.Append(append(values, currency.Format(v.CallCost)))
+	}
+	kubernetesify(table)
+	table.Render()
+	fmt.Println()
+}
+
+// printIngressCostTable prints the cost of ingress traffic per public host, which is what
+// the hop from the ingress gateway to the backend is attributed to.
+func printIngressCostTable(calls []*Call, currency Currency, discounted bool) {
+	callByHost := make(map[string]*Call)
+	hosts := make([]*Call, 0)
+	processing := false
+	for _, v := range calls {
+		processing = processing || v.ProcessingCost != 0
+		if hostCall, ok := callByHost[v.Host]; ok {
+			hostCall.CallSize += v.CallSize
+			hostCall.CallCost += v.CallCost
+			hostCall.ListCost += v.ListCost
+			hostCall.ProcessingCost += v.ProcessingCost
+			continue
+		}
+		c := *v
+		callByHost[v.Host] = &c
+		hosts = append(hosts, &c)
+	}
+	sort.SliceStable(hosts, func(i, j int) bool {
+		return hosts[i].CallCost > hosts[j].CallCost
+	})
+	table := tablewriter.NewWriter(os.Stdout)
+	headers := []string{"Host", "Transferred (MB)"}
+	if discounted {
+		headers = append(headers, "List Cost")
+	}
+	if processing {
+		headers = append(headers, "Processing")
+	}
+	table.SetHeader(append(headers, "Cost"))
+	for _, v := range hosts {
+		values := []string{v.Host, fmt.Sprintf("%f", float64(v.CallSize)/math.Pow(10, 6))}
+		if discounted {
+			values = append(values, currency.Format(v.ListCost))
+		}
+		if processing {
+			values = append(values, currency.Format(v.ProcessingCost))
+		}
+		table.Append(append(values, currency.Format(v.CallCost)))
+	}
+	kubernetesify(table)
+	table.Render()
+	fmt.Println()
+}
+
+func printMinifiedCostTable(calls []*Call, currency Currency, discounted bool) {
+	callBySource := make(map[string]*Call)
+	for _, v := range calls {
 		if srcCall, ok := callBySource[v.FromWorkload]; !ok {
-			callBySource[v.FromWorkload] = *calls[i]
+			c := *v
+			callBySource[v.FromWorkload] = &c
 		} else {
-			srcCall.CallCost += callBySource[v.FromWorkload].CallCost
+			srcCall.CallCost += v.CallCost
+			srcCall.ListCost += v.ListCost
 		}
 	}
-	callSlice := make([]Call, 0)
+	callSlice := make([]*Call, 0)
 	for _, v := range callBySource {
 		callSlice = append(callSlice, v)
 	}
@@ -81,28 +320,23 @@ func printMinifiedCostTable(calls []*Call) {
 	})
 	// print
 	table := tablewriter.NewWriter(os.Stdout)
-	headers := []string{"Source Service", "Source Locality", "Cost"}
-	table.SetHeader(headers)
+	headers := []string{"Source Service", "Source Locality"}
+	if discounted {
+		headers = append(headers, "List Cost")
+	}
+	table.SetHeader(append(headers, "Cost"))
 	for _, v := range callSlice {
-		values := []string{v.FromWorkload, v.From, transformCost(v.CallCost)}
-		table.Append(values)
+		values := []string{v.FromWorkload, v.From}
+		if discounted {
+			values = append(values, currency.Format(v.ListCost))
+		}
+		table.Append(append(values, currency.Format(v.CallCost)))
 	}
 	kubernetesify(table)
 	table.Render()
 	fmt.Println()
 }
 
-func transformCost(cost float64) string {
-	costStr := fmt.Sprintf("$%.2f", cost)
-	if cost < 0.01 {
-		costStr = "<$0.01"
-	}
-	if cost == 0 {
-		costStr = "-"
-	}
-	return costStr
-}
-
 func kubernetesify(table *tablewriter.Table) {
 	table.SetAutoWrapText(false)
 	table.SetAutoFormatHeaders(true)
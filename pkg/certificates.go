@@ -0,0 +1,137 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	v13 "k8s.io/api/rbac/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// CertSecretName is the Secret in the analyzer namespace holding the webhook's serving
+	// certificate. The webhook keeps it, or cert-manager issues it.
+	CertSecretName = "cost-analyzer-mutating-webhook-certs"
+	// CertSecretRoleName is the role letting the webhook keep CertSecretName.
+	CertSecretRoleName = "cost-analyzer-webhook-certs"
+	// CertManagerIssuerName is the self-signed Issuer setup creates when no issuer is given.
+	CertManagerIssuerName = "cost-analyzer-selfsigned"
+	// CertManagerInjectAnnotation has cert-manager's CA injector fill in the caBundle of the
+	// MutatingWebhookConfiguration from a Certificate.
+	CertManagerInjectAnnotation = "cert-manager.io/inject-ca-from"
+)
+
+var (
+	certManagerIssuerResource      = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "issuers"}
+	certManagerCertificateResource = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+)
+
+// certSecretRules let the webhook create CertSecretName, and rotate it.
+var certSecretRules = []v13.PolicyRule{
+	{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"create"}},
+	{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get", "update"}, ResourceNames: []string{CertSecretName}},
+}
+
+// setCertificates sets how the webhook gets its serving certificate. By default, its init
+// container generates one into CertSecretName, and the webhook rotates it before it
+// expires, patching the caBundle. With cert-manager, a Certificate is issued into
+// CertSecretName and mounted, and the CA injector fills in the caBundle.
+func (s *SetupObjects) setCertificates(cfg SetupConfig) error {
+	spec := &s.Deployment.Spec.Template.Spec
+	if !cfg.CertManager {
+		for _, c := range []*v1.Container{&spec.InitContainers[0], &spec.Containers[0]} {
+			c.Env = append(c.Env, v1.EnvVar{Name: "CERT_SECRET", Value: CertSecretName})
+		}
+		return nil
+	}
+	kind := cfg.CertManagerIssuerKind
+	if kind == "" {
+		kind = "Issuer"
+	}
+	if kind != "Issuer" && kind != "ClusterIssuer" {
+		return fmt.Errorf("unknown cert-manager issuer kind %q, must be Issuer or ClusterIssuer", kind)
+	}
+	issuer := cfg.CertManagerIssuer
+	if issuer == "" {
+		issuer, kind = CertManagerIssuerName, "Issuer"
+		s.Issuer = &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "cert-manager.io/v1",
+			"kind":       "Issuer",
+			"metadata":   map[string]interface{}{"name": CertManagerIssuerName, "namespace": cfg.AnalyzerNamespace},
+			"spec":       map[string]interface{}{"selfSigned": map[string]interface{}{}},
+		}}
+	}
+	dnsNames := make([]interface{}, 0)
+	for _, name := range webhookDNSNames(cfg.AnalyzerNamespace) {
+		dnsNames = append(dnsNames, name)
+	}
+	s.Certificate = &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "cert-manager.io/v1",
+		"kind":       "Certificate",
+		"metadata":   map[string]interface{}{"name": WebhookName, "namespace": cfg.AnalyzerNamespace},
+		"spec": map[string]interface{}{
+			"secretName": CertSecretName,
+			"dnsNames":   dnsNames,
+			"issuerRef":  map[string]interface{}{"name": issuer, "kind": kind},
+		},
+	}}
+	s.WebhookConfiguration.Annotations = map[string]string{CertManagerInjectAnnotation: cfg.AnalyzerNamespace + "/" + WebhookName}
+
+	// the certificate is issued before the webhook starts, so there's nothing to generate
+	spec.InitContainers = nil
+	spec.Containers[0].Env = append(spec.Containers[0].Env, v1.EnvVar{Name: "CERT_MODE", Value: "cert-manager"})
+	for i := range spec.Volumes {
+		if spec.Volumes[i].Name == "certs" {
+			spec.Volumes[i].VolumeSource = v1.VolumeSource{Secret: &v1.SecretVolumeSource{SecretName: CertSecretName}}
+		}
+	}
+	return nil
+}
+
+// webhookDNSNames are the names the certificate of the webhook service in namespace is for.
+// They must match those the webhook generates its certificate for.
+func webhookDNSNames(namespace string) []string {
+	return []string{WebhookName, WebhookName + "." + namespace, WebhookName + "." + namespace + ".svc"}
+}
+
+// Generated returns the objects that aren't applied by setup but created for it at
+// runtime, by the webhook or cert-manager: the Secret holding the webhook's certificate,
+// and the Lease and report of the backfill.
+func (s *SetupObjects) Generated() []ObjectRef {
+	refs := []ObjectRef{{
+		Version:   "v1",
+		Resource:  "secrets",
+		Namespace: s.Deployment.Namespace,
+		Name:      CertSecretName,
+	}}
+	if s.backfill {
+		refs = append(refs, ObjectRef{
+			Group:     "coordination.k8s.io",
+			Version:   "v1",
+			Resource:  "leases",
+			Namespace: s.Deployment.Namespace,
+			Name:      BackfillLeaseName,
+		}, ObjectRef{
+			Version:   "v1",
+			Resource:  "configmaps",
+			Namespace: s.Deployment.Namespace,
+			Name:      BackfillReportName,
+		})
+	}
+	return refs
+}
@@ -0,0 +1,118 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestSetupObjects_Certificates(t *testing.T) {
+	tests := []struct {
+		name       string
+		cfg        SetupConfig
+		wantNames  []string
+		wantIssuer map[string]interface{}
+		wantErr    bool
+	}{
+		{
+			name: "self-managed",
+			cfg:  SetupConfig{AnalyzerNamespace: "istio-system"},
+		},
+		{
+			name: "cert-manager with a self-signed issuer",
+			cfg:  SetupConfig{AnalyzerNamespace: "istio-system", CertManager: true},
+			wantNames: []string{
+				"issuer istio-system/cost-analyzer-selfsigned",
+				"certificate istio-system/cost-analyzer-mutating-webhook",
+			},
+			wantIssuer: map[string]interface{}{"name": CertManagerIssuerName, "kind": "Issuer"},
+		},
+		{
+			name:       "cert-manager with a cluster issuer",
+			cfg:        SetupConfig{AnalyzerNamespace: "istio-system", CertManager: true, CertManagerIssuer: "letsencrypt", CertManagerIssuerKind: "ClusterIssuer"},
+			wantNames:  []string{"certificate istio-system/cost-analyzer-mutating-webhook"},
+			wantIssuer: map[string]interface{}{"name": "letsencrypt", "kind": "ClusterIssuer"},
+		},
+		{
+			name:    "unknown issuer kind",
+			cfg:     SetupConfig{AnalyzerNamespace: "istio-system", CertManager: true, CertManagerIssuer: "ca", CertManagerIssuerKind: "Vault"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, err := NewSetupObjects(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSetupObjects() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			manifests, err := objects.Manifests()
+			if err != nil {
+				t.Fatal(err)
+			}
+			names := make([]string, 0)
+			for _, m := range manifests {
+				if m.Resource.Group == "cert-manager.io" {
+					names = append(names, m.String())
+				}
+			}
+			if len(tt.wantNames) == 0 {
+				tt.wantNames = []string{}
+			}
+			if !reflect.DeepEqual(names, tt.wantNames) {
+				t.Errorf("cert-manager manifests = %v, want %v", names, tt.wantNames)
+			}
+
+			spec := objects.Deployment.Spec.Template.Spec
+			env := map[string]string{}
+			for _, e := range spec.Containers[0].Env {
+				env[e.Name] = e.Value
+			}
+			secretRole := false
+			for _, r := range objects.Roles {
+				secretRole = secretRole || r.Name == CertSecretRoleName
+			}
+			annotation := objects.WebhookConfiguration.Annotations[CertManagerInjectAnnotation]
+			if !tt.cfg.CertManager {
+				if len(spec.InitContainers) != 1 || env["CERT_SECRET"] != CertSecretName || !secretRole || annotation != "" {
+					t.Errorf("self-managed webhook: init containers %v, env %v, secret role %v, annotation %q", len(spec.InitContainers), env, secretRole, annotation)
+				}
+				return
+			}
+			if len(spec.InitContainers) != 0 || env["CERT_MODE"] != "cert-manager" || secretRole {
+				t.Errorf("cert-manager webhook: init containers %v, env %v, secret role %v", len(spec.InitContainers), env, secretRole)
+			}
+			if spec.Volumes[0].Secret == nil || spec.Volumes[0].Secret.SecretName != CertSecretName {
+				t.Errorf("certs volume = %+v, want secret %v", spec.Volumes[0].VolumeSource, CertSecretName)
+			}
+			if annotation != "istio-system/"+WebhookName {
+				t.Errorf("%v = %q, want the certificate", CertManagerInjectAnnotation, annotation)
+			}
+			issuer, _, _ := unstructured.NestedMap(objects.Certificate.Object, "spec", "issuerRef")
+			if !reflect.DeepEqual(issuer, tt.wantIssuer) {
+				t.Errorf("issuerRef = %v, want %v", issuer, tt.wantIssuer)
+			}
+			dnsNames, _, _ := unstructured.NestedStringSlice(objects.Certificate.Object, "spec", "dnsNames")
+			if want := webhookDNSNames("istio-system"); !reflect.DeepEqual(dnsNames, want) {
+				t.Errorf("dnsNames = %v, want %v", dnsNames, want)
+			}
+		})
+	}
+}
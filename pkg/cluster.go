@@ -0,0 +1,131 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	k8Yaml "k8s.io/apimachinery/pkg/util/yaml"
+	"os"
+)
+
+// Cluster is one cluster of a multi-cluster mesh.
+type Cluster struct {
+	// Context is the kubeconfig context of the cluster. Empty is the current context.
+	Context string `json:"context"`
+	// PrometheusNamespace is the namespace Prometheus runs in. If empty, the default is used.
+	PrometheusNamespace string `json:"prometheusNamespace,omitempty"`
+	// ClusterID is the cluster's name in the mesh, as reported in source_cluster and
+	// destination_cluster. If empty, it's looked up from istiod.
+	ClusterID string `json:"clusterID,omitempty"`
+}
+
+// clusterList is the format of a cluster list file.
+type clusterList struct {
+	Clusters []Cluster `json:"clusters"`
+}
+
+// LoadClusters reads a cluster list file, in yaml or json, like:
+//
+//	clusters:
+//	- context: us-west
+//	- context: europe-west
+//	  prometheusNamespace: monitoring
+func LoadClusters(path string) ([]Cluster, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("unable to read file %v: %v", path, err)
+		return nil, err
+	}
+	defer f.Close()
+	list := &clusterList{}
+	if err := k8Yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(list); err != nil {
+		fmt.Printf("unable to unmarshal cluster list: %v", err)
+		return nil, err
+	}
+	if len(list.Clusters) == 0 {
+		return nil, fmt.Errorf("no clusters in %v", path)
+	}
+	return list.Clusters, nil
+}
+
+// MergeClusterCalls merges the calls gathered from each cluster's Prometheus. Calls for the
+// same link from one cluster and reporter are summed, but a link reported by both its source
+// and destination sidecars, or by several clusters (on both sides of a cross-cluster call,
+// or by federated Prometheus instances), is only counted once. The merged calls have no
+// Reporter.
+func MergeClusterCalls(clusterCalls [][]*Call) []*Call {
+	merged := make([]*Call, 0)
+	links := make(map[Call]*Call)
+	for _, calls := range clusterCalls {
+		// sizes by link and reporter
+		reported := make(map[Call]uint64)
+		for _, v := range calls {
+			key := *v
+			key.CallSize, key.CallCost, key.ListCost, key.ProcessingCost = 0, 0, 0, 0
+			reported[key] += v.CallSize
+			key.Reporter = ""
+			if _, ok := links[key]; !ok {
+				link := key
+				links[key] = &link
+				merged = append(merged, &link)
+			}
+		}
+		for key, size := range reported {
+			key.Reporter = ""
+			if size > links[key].CallSize {
+				links[key].CallSize = size
+			}
+		}
+	}
+	return merged
+}
+
+// SplitEastWestCalls adds the hop through the destination cluster's east-west gateway to
+// calls between clusters. Istio reports these from the source to the final destination,
+// so each is split into the call from the source to the gateway, and an EastWestGatewayCall
+// from the gateway to the destination. gatewayLocalities holds the gateway's pod counts by
+// locality, by cluster ID. Calls to clusters whose gateway localities are unknown are kept
+// as they are.
+func SplitEastWestCalls(calls []*Call, gateway string, gatewayLocalities map[string]map[string]int) []*Call {
+	split := make([]*Call, 0, len(calls))
+	for _, c := range calls {
+		if c.Kind != MeshCall || c.FromCluster == "" || c.ToCluster == "" || c.FromCluster == c.ToCluster {
+			split = append(split, c)
+			continue
+		}
+		localities := gatewayLocalities[c.ToCluster]
+		if len(localities) == 0 {
+			fmt.Printf("unable to find east-west gateway of cluster %v, pricing %v without it...\n", c.ToCluster, c)
+			split = append(split, c)
+			continue
+		}
+		for _, toGateway := range splitByLocality(c, localities, true) {
+			toGateway.ToWorkload = gateway
+			fromGateway := &Call{
+				From:         toGateway.To,
+				FromWorkload: gateway,
+				To:           c.To,
+				ToWorkload:   c.ToWorkload,
+				CallSize:     toGateway.CallSize,
+				Day:          c.Day,
+				Kind:         EastWestGatewayCall,
+				FromCluster:  c.ToCluster,
+				ToCluster:    c.ToCluster,
+			}
+			split = append(split, toGateway, fromGateway)
+		}
+	}
+	return split
+}
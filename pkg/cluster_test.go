@@ -0,0 +1,89 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLoadClusters(t *testing.T) {
+	clusters, err := LoadClusters("testdata/clusters.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []Cluster{
+		{Context: "us-west"},
+		{Context: "europe-west", PrometheusNamespace: "monitoring", ClusterID: "europe"},
+	}
+	if !reflect.DeepEqual(clusters, expected) {
+		t.Errorf("LoadClusters() = %v, want %v", clusters, expected)
+	}
+	if _, err := LoadClusters("testdata/im_not_json.json"); err == nil {
+		t.Errorf("expected error loading invalid cluster list")
+	}
+}
+
+func TestMergeClusterCalls(t *testing.T) {
+	crossCluster := Call{From: "us-west1-b", FromWorkload: "a", To: "europe-west1-b", ToWorkload: "b", FromCluster: "us", ToCluster: "europe"}
+	local := Call{From: "us-west1-b", FromWorkload: "a", To: "us-west1-c", ToWorkload: "c", FromCluster: "us", ToCluster: "us"}
+	withSize := func(c Call, size uint64) *Call {
+		c.CallSize = size
+		return &c
+	}
+	reportedBy := func(c Call, reporter string, size uint64) *Call {
+		c.Reporter = reporter
+		return withSize(c, size)
+	}
+	merged := MergeClusterCalls([][]*Call{
+		// two series for the same link in one cluster are summed
+		{withSize(crossCluster, 100), withSize(crossCluster, 50), withSize(local, 10)},
+		// but the same link reported by another cluster is counted once
+		{withSize(crossCluster, 150)},
+	})
+	expected := []*Call{withSize(crossCluster, 150), withSize(local, 10)}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("MergeClusterCalls() = %v, want %v", merged, expected)
+	}
+	merged = MergeClusterCalls([][]*Call{
+		// a link reported by both sidecars is counted once
+		{reportedBy(local, "source", 10), reportedBy(local, "source", 5), reportedBy(local, "destination", 15)},
+	})
+	expected = []*Call{withSize(local, 15)}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("MergeClusterCalls() = %v, want %v", merged, expected)
+	}
+}
+
+func TestSplitEastWestCalls(t *testing.T) {
+	calls := []*Call{
+		{From: "us-west1-b", FromWorkload: "a", To: "europe-west1-b", ToWorkload: "b", CallSize: 100, FromCluster: "us", ToCluster: "europe"},
+		{From: "us-west1-b", FromWorkload: "a", To: "us-west1-c", ToWorkload: "c", CallSize: 10, FromCluster: "us", ToCluster: "us"},
+		// no known gateway in asia
+		{From: "us-west1-b", FromWorkload: "a", To: "asia-east1-a", ToWorkload: "d", CallSize: 10, FromCluster: "us", ToCluster: "asia"},
+	}
+	split := SplitEastWestCalls(calls, "istio-eastwestgateway", map[string]map[string]int{
+		"europe": {"europe-west1-c": 1},
+	})
+	expected := []*Call{
+		{From: "us-west1-b", FromWorkload: "a", To: "europe-west1-c", ToWorkload: "istio-eastwestgateway", CallSize: 100, FromCluster: "us", ToCluster: "europe"},
+		{From: "europe-west1-c", FromWorkload: "istio-eastwestgateway", To: "europe-west1-b", ToWorkload: "b", CallSize: 100, Kind: EastWestGatewayCall, FromCluster: "europe", ToCluster: "europe"},
+		calls[1],
+		calls[2],
+	}
+	if !reflect.DeepEqual(split, expected) {
+		t.Errorf("SplitEastWestCalls() = %v, want %v", split, expected)
+	}
+}
@@ -16,33 +16,106 @@ package pkg
 
 import (
 	"fmt"
-	"io"
 	"k8s.io/apimachinery/pkg/util/json"
 	"math"
-	"net/http"
 	"net/url"
 	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/istio-cost-analyzer/pricing"
 )
 
 type CostAnalysis struct {
 	priceSheetPath string
 	pricing        Pricing
+	// internet and processing hold internet egress rates and processing charges for
+	// sheets without rate sets.
+	internet   map[string]float64
+	processing map[string]float64
+	// natGateway is whether internet traffic leaves through a cloud NAT.
+	natGateway bool
+	// loadBalancer is whether ingress traffic enters through a cloud load balancer.
+	loadBalancer bool
+	// rateSets is only set for time-versioned price sheets, sorted by effective date.
+	// When it is set, pricing holds the latest rate set.
+	rateSets []RateSet
+	// version and date identify the price sheet, if known.
+	version string
+	date    string
+	// overlay holds negotiated rates applied on top of the sheet, if any.
+	overlay     *PriceOverlay
+	overlayPath string
+	// sheetCurrency is the currency rates are in, and currency is the one costs are
+	// reported in. Both default to USD.
+	sheetCurrency Currency
+	currency      Currency
+	// exchangeRate converts sheetCurrency amounts to currency. Zero means no conversion.
+	exchangeRate  float64
+	exchangeRates *ExchangeRates
 }
 
 type Pricing map[string]map[string]float64
 
+// PriceSheet is the time-versioned price sheet format. Each rate set applies from its
+// effective date until the next one's, so historical windows are priced with the rates
+// in effect at the time. Sheets in the flat Pricing format are still supported.
+type PriceSheet struct {
+	Version string `json:"version,omitempty"`
+	Date    string `json:"date,omitempty"`
+	// Currency of all rates in the sheet. Defaults to USD.
+	Currency Currency  `json:"currency,omitempty"`
+	RateSets []RateSet `json:"rateSets"`
+}
+
+// RateSet is a set of rates that applies from EffectiveFrom (YYYY-MM-DD, UTC) onwards.
+type RateSet struct {
+	EffectiveFrom string  `json:"effectiveFrom"`
+	Pricing       Pricing `json:"pricing"`
+	// Internet holds $/GB rates for traffic leaving the mesh to the internet, by source
+	// locality or region. "*" is the rate for any other source.
+	Internet map[string]float64 `json:"internet,omitempty"`
+	// Processing holds $/GB charges of network services traffic goes through, by
+	// service, like NATProcessing.
+	Processing map[string]float64 `json:"processing,omitempty"`
+	from       time.Time
+}
+
+// NATProcessing is the processing charge of a cloud NAT, applied to internet egress
+// when the cluster uses one.
+const NATProcessing = "nat"
+
+// LoadBalancerProcessing is the processing charge of a cloud load balancer, applied to
+// traffic entering through an ingress gateway when the cluster is behind one.
+const LoadBalancerProcessing = "loadBalancer"
+
+// internetRate returns the internet egress rate for traffic from locality.
+func (rs RateSet) internetRate(locality string) (float64, bool) {
+	for _, key := range []string{locality, localityRegion(locality), "*"} {
+		if rate, ok := rs.Internet[key]; ok {
+			return rate, true
+		}
+	}
+	return 0, false
+}
+
+// dateLayout is the layout of the dates in price sheets.
+const dateLayout = "2006-01-02"
+
+// NewCostAnalysis creates a CostAnalysis from the price sheet at priceSheetLocation,
+// which is either a local path or a URL, using DefaultPriceSheetOptions.
 func NewCostAnalysis(priceSheetLocation string) (*CostAnalysis, error) {
-	pricing := Pricing{}
+	return NewCostAnalysisWithOptions(priceSheetLocation, DefaultPriceSheetOptions())
+}
+
+// NewCostAnalysisWithOptions creates a CostAnalysis from the price sheet at priceSheetLocation,
+// fetching, caching and verifying it according to opts.
+func NewCostAnalysisWithOptions(priceSheetLocation string, opts PriceSheetOptions) (*CostAnalysis, error) {
 	var data []byte
 	var err error
 	if isValidUrl(priceSheetLocation) {
-		resp, err := http.Get(priceSheetLocation)
-		if err != nil {
-			fmt.Println(err)
-			return nil, err
-		}
-		defer resp.Body.Close()
-		data, err = io.ReadAll(resp.Body)
+		data, err = fetchPriceSheet(priceSheetLocation, opts)
 		if err != nil {
 			fmt.Println(err)
 			return nil, err
@@ -54,38 +127,330 @@ func NewCostAnalysis(priceSheetLocation string) (*CostAnalysis, error) {
 			return nil, err
 		}
 	}
-	err = json.Unmarshal(data, &pricing)
+	if err = verifyPriceSheet(priceSheetLocation, data, opts.SHA256); err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	ca, err := newCostAnalysis(priceSheetLocation, data)
+	if err != nil {
+		return nil, err
+	}
+	return ca, ca.applyOptions(opts)
+}
+
+// applyOptions merges the overlay in opts, if any, into the CostAnalysis, and sets
+// up conversion to the requested currency.
+func (c *CostAnalysis) applyOptions(opts PriceSheetOptions) error {
+	if opts.OverlayPath != "" {
+		overlay, err := loadPriceOverlay(opts.OverlayPath)
+		if err != nil {
+			return err
+		}
+		c.overlay, c.overlayPath = overlay, opts.OverlayPath
+	}
+	c.natGateway, c.loadBalancer = opts.NATGateway, opts.LoadBalancer
+	target := Currency(strings.ToUpper(string(opts.Currency)))
+	if target == "" || target == c.SheetCurrency() {
+		return nil
+	}
+	if opts.ExchangeRatesPath == "" {
+		return fmt.Errorf("price sheet is in %v, an exchange rate file is needed to report in %v", c.SheetCurrency(), target)
+	}
+	rates, err := loadExchangeRates(opts.ExchangeRatesPath)
+	if err != nil {
+		return err
+	}
+	rate, err := rates.convert(c.SheetCurrency(), target)
 	if err != nil {
+		return err
+	}
+	c.currency, c.exchangeRate, c.exchangeRates = target, rate, rates
+	return nil
+}
+
+// Sections of a flat price sheet that aren't source localities: they hold the internet
+// egress rates and processing charges, like the fields of a RateSet.
+const (
+	internetSection   = "internet"
+	processingSection = "processing"
+)
+
+// newCostAnalysis parses data as either a time-versioned PriceSheet or flat Pricing.
+// Flat sheets can carry internet egress rates and processing charges in their internet
+// and processing sections.
+func newCostAnalysis(priceSheetLocation string, data []byte) (*CostAnalysis, error) {
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
 		fmt.Printf("unable to unmarshal json into object: %v", err)
 		return nil, err
 	}
+	if _, ok := fields["rateSets"]; !ok {
+		pricing := Pricing{}
+		if err := json.Unmarshal(data, &pricing); err != nil {
+			fmt.Printf("unable to unmarshal json into object: %v", err)
+			return nil, err
+		}
+		internet, processing := pricing[internetSection], pricing[processingSection]
+		delete(pricing, internetSection)
+		delete(pricing, processingSection)
+		return &CostAnalysis{
+			priceSheetPath: priceSheetLocation,
+			pricing:        pricing,
+			internet:       internet,
+			processing:     processing,
+		}, nil
+	}
+	sheet := PriceSheet{}
+	if err := json.Unmarshal(data, &sheet); err != nil {
+		fmt.Printf("unable to unmarshal json into object: %v", err)
+		return nil, err
+	}
+	if len(sheet.RateSets) == 0 {
+		return nil, fmt.Errorf("price sheet %v has no rate sets", priceSheetLocation)
+	}
+	for i := range sheet.RateSets {
+		from, err := time.Parse(dateLayout, sheet.RateSets[i].EffectiveFrom)
+		if err != nil {
+			return nil, fmt.Errorf("invalid effectiveFrom in price sheet %v: %w", priceSheetLocation, err)
+		}
+		sheet.RateSets[i].from = from
+	}
+	sort.Slice(sheet.RateSets, func(i, j int) bool {
+		return sheet.RateSets[i].from.Before(sheet.RateSets[j].from)
+	})
 	return &CostAnalysis{
 		priceSheetPath: priceSheetLocation,
-		pricing:        pricing,
+		pricing:        sheet.RateSets[len(sheet.RateSets)-1].Pricing,
+		rateSets:       sheet.RateSets,
+		version:        sheet.Version,
+		date:           sheet.Date,
+		sheetCurrency:  Currency(strings.ToUpper(string(sheet.Currency))),
 	}, nil
 }
 
+// NewEmbeddedCostAnalysis creates a CostAnalysis from the price sheet compiled into
+// the binary for the given cloud, so no network access is needed. The options in opts
+// for remote sheets (CacheDir, Timeout, MaxAge and SHA256) are ignored. The embedded
+// internet rates and processing charges are used unless the sheet has its own.
+func NewEmbeddedCostAnalysis(cloud Cloud, opts PriceSheetOptions) (*CostAnalysis, error) {
+	sheet, ok := pricing.Embedded(string(cloud))
+	if !ok {
+		return nil, fmt.Errorf("no embedded price sheet for cloud %q", cloud)
+	}
+	ca, err := newCostAnalysis("embedded:"+sheet.Cloud, sheet.Data)
+	if err != nil {
+		return nil, err
+	}
+	if ca.version == "" {
+		ca.version, ca.date = sheet.Version, sheet.Date
+	}
+	if len(ca.rateSets) == 0 && len(ca.internet) == 0 {
+		ca.internet = sheet.Internet
+	}
+	if len(ca.rateSets) == 0 && len(ca.processing) == 0 {
+		ca.processing = sheet.Processing
+	}
+	return ca, ca.applyOptions(opts)
+}
+
+// SheetInfo describes the price sheet in use, including its version and date when known.
+func (c *CostAnalysis) SheetInfo() string {
+	version, date := c.version, c.date
+	if version == "" {
+		version = "unversioned"
+	}
+	if date == "" {
+		date = "unknown date"
+	}
+	info := fmt.Sprintf("%v (version %v, %v)", c.priceSheetPath, version, date)
+	if c.overlay != nil {
+		info += fmt.Sprintf(" with overlay %v", c.overlayPath)
+	}
+	return info
+}
+
+// SheetCurrency returns the currency of the price sheet's rates.
+func (c *CostAnalysis) SheetCurrency() Currency {
+	if c.sheetCurrency == "" {
+		return USD
+	}
+	return c.sheetCurrency
+}
+
+// Currency returns the currency costs are reported in.
+func (c *CostAnalysis) Currency() Currency {
+	if c.currency == "" {
+		return c.SheetCurrency()
+	}
+	return c.currency
+}
+
+// CurrencyInfo describes the reporting currency, and the exchange rate used if costs
+// were converted from the sheet's currency.
+func (c *CostAnalysis) CurrencyInfo() string {
+	if c.exchangeRates == nil {
+		return string(c.Currency())
+	}
+	info := fmt.Sprintf("%v (1 %v = %v %v, from %v", c.Currency(), c.SheetCurrency(), c.exchangeRate, c.Currency(), c.exchangeRates.path)
+	if c.exchangeRates.Date != "" {
+		info += " as of " + c.exchangeRates.Date
+	}
+	return info + ")"
+}
+
+// CostReport is the result of an analysis, for tools to read.
+type CostReport struct {
+	PriceSheet string `json:"priceSheet"`
+	// Currency is the currency every cost is in.
+	Currency Currency `json:"currency"`
+	// ExchangeRate is how costs were converted from the sheet's currency, if they were.
+	ExchangeRate *ExchangeRateSource `json:"exchangeRate,omitempty"`
+	Total        float64             `json:"total"`
+	ListTotal    float64             `json:"listTotal"`
+	Calls        []*Call             `json:"calls"`
+}
+
+// ExchangeRateSource is the exchange rate costs were converted with, and where it's from.
+type ExchangeRateSource struct {
+	From Currency `json:"from"`
+	To   Currency `json:"to"`
+	Rate float64  `json:"rate"`
+	// File is the exchange rate file, and Date the date it gives for its rates.
+	File string `json:"file"`
+	Date string `json:"date,omitempty"`
+}
+
+// Report returns the CostReport of calls priced with CalculateEgress, costing total.
+func (c *CostAnalysis) Report(calls []*Call, total float64) *CostReport {
+	_, listTotal := sumCosts(calls)
+	report := &CostReport{
+		PriceSheet: c.SheetInfo(),
+		Currency:   c.Currency(),
+		Total:      total,
+		ListTotal:  listTotal,
+		Calls:      calls,
+	}
+	if c.exchangeRates != nil {
+		report.ExchangeRate = &ExchangeRateSource{
+			From: c.SheetCurrency(),
+			To:   c.Currency(),
+			Rate: c.exchangeRate,
+			File: c.exchangeRates.path,
+			Date: c.exchangeRates.Date,
+		}
+	}
+	return report
+}
+
+// TimeVersioned returns whether the price sheet has more than one rate set, so
+// traffic needs to be split by day to be priced correctly.
+func (c *CostAnalysis) TimeVersioned() bool {
+	return len(c.rateSets) > 1
+}
+
+// rateSetAt returns the rates in effect on the given day. A zero day means the
+// rates in effect now. Days before the first rate set use the first rate set.
+func (c *CostAnalysis) rateSetAt(day time.Time) RateSet {
+	if len(c.rateSets) == 0 {
+		return RateSet{Pricing: c.pricing, Internet: c.internet, Processing: c.processing}
+	}
+	if day.IsZero() {
+		day = time.Now()
+	}
+	rateSet := c.rateSets[0]
+	for _, rs := range c.rateSets {
+		if rs.from.After(day) {
+			break
+		}
+		rateSet = rs
+	}
+	return rateSet
+}
+
 // CalculateEgress calculates the total egress costs based on the pricing structure
 // in the CostAnalysis object. It stores the individual call prices in the calls object,
 // along with returning a total cost as a float64. If an entry in calls doesn't correspond to
 // the actual pricing structure, the function just skips that entry, instead of returning an error.
+// Calls with a Day are priced with the rates in effect on that day. If there is an overlay,
+// CallCost is the effective cost after the overlay and ListCost is the cost at list rates.
+// Costs are in c.Currency(). InternetCalls are priced with the internet egress rate for
+// their source, plus the NAT processing charge if the cluster uses a cloud NAT.
+// EgressGatewayCalls and IngressGatewayCalls are priced like any other link, with the
+// gateway's locality, plus the load balancer processing charge for IngressGatewayCalls if
+// the cluster is behind a cloud load balancer. Internet traffic the sheet has no rate for is
+// reported once per source, since it's missing from the total.
 func (c *CostAnalysis) CalculateEgress(calls []*Call) (float64, error) {
 	totalCost := 0.00
+	// bytes of internet traffic without a rate, by source locality
+	unpriced := make(map[string]uint64)
+	fx := 1.0
+	if c.exchangeRate != 0 {
+		fx = c.exchangeRate
+	}
 	fmt.Printf("calculating egress costs for %v call links\n", len(calls))
 	for i, v := range calls {
-		rate, ok := c.pricing[v.From][v.To]
-		if !ok {
-			fmt.Printf("unable to find rate for link between %v and %v, skipping...\n", v.From, v.To)
-			continue
+		rateSet := c.rateSetAt(v.Day)
+		listRate, listOk := rateSet.Pricing[v.From][v.To]
+		if v.Kind == InternetCall {
+			listRate, listOk = rateSet.internetRate(v.From)
 		}
+		rate, ok := c.overlay.apply(v.From, v.To, listRate, listOk)
 		// 1 byte = 10^-9 gb
-		cost := rate * (float64(v.CallSize) * math.Pow(10, -9))
+		gb := float64(v.CallSize) * math.Pow(10, -9)
+		processing := c.processingRate(v, rateSet) * gb * fx
+		if !ok {
+			if v.Kind == InternetCall {
+				unpriced[v.From] += v.CallSize
+			} else {
+				fmt.Printf("unable to find rate for link between %v and %v, skipping...\n", v.From, v.To)
+			}
+			if processing == 0 {
+				continue
+			}
+			// the link itself is free (e.g. within a zone), but the traffic was still processed
+			rate, listRate, listOk = 0, 0, true
+		}
+		if !listOk {
+			// only negotiated, so the list price is the negotiated one
+			listRate = rate
+		}
+		cost := rate*gb*fx + processing
 		calls[i].CallCost = cost
+		calls[i].ListCost = listRate*gb*fx + processing
+		calls[i].ProcessingCost = processing
 		totalCost += cost
 	}
+	sources := make([]string, 0, len(unpriced))
+	for from := range unpriced {
+		sources = append(sources, from)
+	}
+	sort.Strings(sources)
+	for _, from := range sources {
+		fmt.Printf("no internet egress rate for %v in price sheet %v, %.3f GB of internet traffic from it is not priced: add it to the sheet's %q rates\n",
+			from, c.priceSheetPath, float64(unpriced[from])*math.Pow(10, -9), internetSection)
+	}
 	return totalCost, nil
 }
 
+// processingRate returns the $/GB processing charge of the network services a call
+// went through, if the cluster is configured to use them.
+func (c *CostAnalysis) processingRate(v *Call, rateSet RateSet) float64 {
+	var service string
+	switch {
+	case v.Kind == InternetCall && c.natGateway:
+		service = NATProcessing
+	case v.Kind == IngressGatewayCall && c.loadBalancer:
+		service = LoadBalancerProcessing
+	default:
+		return 0
+	}
+	fee, ok := rateSet.Processing[service]
+	if !ok {
+		fmt.Printf("no %v processing charge in price sheet, skipping for %v...\n", service, v.FromWorkload)
+	}
+	return fee
+}
+
 func isValidUrl(toTest string) bool {
 	_, err := url.ParseRequestURI(toTest)
 	if err != nil {
@@ -18,6 +18,7 @@ import (
 	"math"
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestNewCostAnalysis(t *testing.T) {
@@ -131,12 +132,14 @@ func TestCostAnalysis_CalculateEgress(t *testing.T) {
 					To:       "us-east1-b",
 					CallSize: uint64(math.Pow(10, 9)),
 					CallCost: 0.9,
+					ListCost: 0.9,
 				},
 				{
 					From:     "us-west1-b",
 					To:       "us-west1-c",
 					CallSize: uint64(math.Pow(10, 9)),
 					CallCost: 0.5,
+					ListCost: 0.5,
 				},
 			},
 			expectedTotal: 1.4,
@@ -157,6 +160,7 @@ func TestCostAnalysis_CalculateEgress(t *testing.T) {
 			for _, v := range tt.callsWithPrice {
 				stripped := *v
 				stripped.CallCost = 0.00
+				stripped.ListCost = 0.00
 				strippedCalls = append(strippedCalls, &stripped)
 			}
 			total, err := ca.CalculateEgress(strippedCalls)
@@ -168,3 +172,277 @@ func TestCostAnalysis_CalculateEgress(t *testing.T) {
 		})
 	}
 }
+
+func TestNewEmbeddedCostAnalysis(t *testing.T) {
+	tests := []struct {
+		name             string
+		cloud            Cloud
+		link             [2]string
+		expectedRate     float64
+		expectedInternet float64
+		expectedError    bool
+	}{
+		{
+			name:             "gcp",
+			cloud:            GCP,
+			link:             [2]string{"us-west1-a", "us-west1-b"},
+			expectedRate:     0.01,
+			expectedInternet: 0.12,
+			expectedError:    false,
+		},
+		{
+			name:             "aws",
+			cloud:            AWS,
+			link:             [2]string{"af-south-1", "ap-east-1"},
+			expectedRate:     0.147,
+			expectedInternet: 0.154,
+			expectedError:    false,
+		},
+		{
+			name:          "unknown cloud",
+			cloud:         Unknown,
+			expectedError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ca, err := NewEmbeddedCostAnalysis(tt.cloud, DefaultPriceSheetOptions())
+			if (err != nil) != tt.expectedError {
+				t.Fatalf("expected error existence: %v => (%v)", tt.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+			if rate := ca.pricing[tt.link[0]][tt.link[1]]; rate != tt.expectedRate {
+				t.Errorf("expected rate %v for %v => (%v)", tt.expectedRate, tt.link, rate)
+			}
+			if rate, _ := ca.rateSetAt(time.Time{}).internetRate(tt.link[0]); rate != tt.expectedInternet {
+				t.Errorf("expected internet rate %v from %v => (%v)", tt.expectedInternet, tt.link[0], rate)
+			}
+			if ca.version == "" || ca.date == "" {
+				t.Errorf("expected embedded sheet to carry a version and date, got %q", ca.SheetInfo())
+			}
+		})
+	}
+}
+
+func TestCostAnalysis_CalculateEgressVersioned(t *testing.T) {
+	ca, err := NewCostAnalysis("testdata/versioned_pricing.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ca.TimeVersioned() || ca.version != "2024.1" || ca.date != "2024-02-01" {
+		t.Fatalf("expected time-versioned sheet 2024.1 (2024-02-01) => (%v)", ca.SheetInfo())
+	}
+	gb := uint64(math.Pow(10, 9))
+	day := func(s string) time.Time {
+		d, _ := time.Parse(dateLayout, s)
+		return d
+	}
+	calls := []*Call{
+		{From: "us-west1-a", To: "us-west1-b", CallSize: gb, Day: day("2021-06-01")},
+		{From: "us-west1-a", To: "us-west1-b", CallSize: gb, Day: day("2024-01-31")},
+		{From: "us-west1-a", To: "us-west1-b", CallSize: gb, Day: day("2024-02-01")},
+		{From: "us-west1-a", To: "us-west1-b", CallSize: gb},
+	}
+	expected := []float64{0.01, 0.01, 0.02, 0.02}
+	total, err := ca.CalculateEgress(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range calls {
+		if math.Abs(v.CallCost-expected[i]) > 1e-9 {
+			t.Errorf("call %v: expected cost %v => (%v)", i, expected[i], v.CallCost)
+		}
+	}
+	if math.Abs(total-0.06) > 1e-9 {
+		t.Errorf("expected total 0.06 => (%v)", total)
+	}
+	collapsed := CollapseDays(calls)
+	if len(collapsed) != 1 || collapsed[0].CallSize != 4*gb || math.Abs(collapsed[0].CallCost-0.06) > 1e-9 {
+		t.Errorf("expected one collapsed call of 4GB costing 0.06 => (%v)", collapsed)
+	}
+}
+
+func TestCostAnalysis_CalculateEgressOverlay(t *testing.T) {
+	opts := DefaultPriceSheetOptions()
+	opts.OverlayPath = "testdata/overlay.json"
+	loaded, err := NewCostAnalysisWithOptions("testdata/valid_pricing.json", opts)
+	if err != nil {
+		t.Fatalf("unable to load overlay: %v", err)
+	}
+	ca := &CostAnalysis{
+		pricing: Pricing{
+			"us-west1-b": {
+				"us-west1-c":     0.5,
+				"us-east1-b":     0.9,
+				"europe-west1-b": 0.8,
+			},
+		},
+		overlay: loaded.overlay,
+	}
+	gb := uint64(math.Pow(10, 9))
+	tests := []struct {
+		name             string
+		to               string
+		expectedCost     float64
+		expectedListCost float64
+	}{
+		{name: "discounted", to: "us-west1-c", expectedCost: 0.45, expectedListCost: 0.5},
+		{name: "per-pair override", to: "us-east1-b", expectedCost: 0.02, expectedListCost: 0.9},
+		// the class rate wins over the sheet's rate
+		{name: "per-class over listed", to: "europe-west1-b", expectedCost: 0.05, expectedListCost: 0.8},
+		{name: "per-class only", to: "asia-east1-a", expectedCost: 0.05, expectedListCost: 0.05},
+		{name: "negotiated only", to: "us-central1-a", expectedCost: 0.03, expectedListCost: 0.03},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := []*Call{{From: "us-west1-b", To: tt.to, CallSize: gb}}
+			if _, err := ca.CalculateEgress(calls); err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(calls[0].CallCost-tt.expectedCost) > 1e-9 || math.Abs(calls[0].ListCost-tt.expectedListCost) > 1e-9 {
+				t.Errorf("expected cost (list) %v (%v) => %v (%v)", tt.expectedCost, tt.expectedListCost, calls[0].CallCost, calls[0].ListCost)
+			}
+		})
+	}
+}
+
+func TestClassifyLink(t *testing.T) {
+	tests := []struct {
+		from, to string
+		expected LinkClass
+	}{
+		{"us-west1-b", "us-west1-b", IntraZone},
+		{"us-west1-b", "us-west1-c", InterZoneIntraRegion},
+		{"us-west1-b", "us-east1-b", InterRegionIntraContinent},
+		{"us-west1-b", "europe-west1-b", InterContinent},
+		{"us-west-2", "us-east-1", InterRegionIntraContinent},
+		{"us-west-2", "eu-west-1", InterContinent},
+		{"us-east-1", "ca-central-1", InterRegionIntraContinent},
+		{"us-central1-a", "northamerica-northeast1-a", InterRegionIntraContinent},
+		{"me-south-1", "il-central-1", InterRegionIntraContinent},
+		{"ap-southeast-1", "ap-southeast-2", InterContinent},
+		{"af-south-1", "eu-west-1", InterContinent},
+		// regions missing from the tables are a continent of their own
+		{"us-north9", "us-west1", InterContinent},
+	}
+	for _, tt := range tests {
+		if got := ClassifyLink(tt.from, tt.to); got != tt.expected {
+			t.Errorf("ClassifyLink(%v, %v) = %v, want %v", tt.from, tt.to, got, tt.expected)
+		}
+	}
+}
+
+func TestCostAnalysis_CalculateEgressInternet(t *testing.T) {
+	ca := &CostAnalysis{
+		pricing:  Pricing{},
+		internet: map[string]float64{"us-west1": 0.2, "*": 0.1},
+	}
+	gb := uint64(math.Pow(10, 9))
+	calls := []*Call{
+		{From: "us-west1-b", To: InternetDestination, CallSize: gb, Kind: InternetCall},
+		{From: "europe-west1-b", To: InternetDestination, CallSize: gb, Kind: InternetCall},
+		// a mesh call to a locality named like the internet isn't priced as internet
+		{From: "us-west1-b", To: InternetDestination, CallSize: gb},
+	}
+	total, err := ca.CalculateEgress(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(calls[0].CallCost-0.2) > 1e-9 || math.Abs(calls[1].CallCost-0.1) > 1e-9 || calls[2].CallCost != 0 {
+		t.Errorf("expected costs 0.2, 0.1, 0 => (%v, %v, %v)", calls[0].CallCost, calls[1].CallCost, calls[2].CallCost)
+	}
+	if math.Abs(total-0.3) > 1e-9 {
+		t.Errorf("expected total 0.3 => (%v)", total)
+	}
+}
+
+func TestCostAnalysis_CalculateEgressFlatInternet(t *testing.T) {
+	ca, err := NewCostAnalysis("testdata/internet_pricing.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the sections aren't source localities
+	if _, ok := ca.pricing[internetSection]; ok {
+		t.Errorf("expected internet section out of the link rates => (%v)", ca.pricing)
+	}
+	ca.natGateway = true
+	gb := uint64(math.Pow(10, 9))
+	calls := []*Call{
+		{From: "us-west1-a", To: InternetDestination, CallSize: gb, Kind: InternetCall},
+		// no rate for europe, so it's only charged the nat processing
+		{From: "europe-west1-b", To: InternetDestination, CallSize: gb, Kind: InternetCall},
+	}
+	total, err := ca.CalculateEgress(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(calls[0].CallCost-0.165) > 1e-9 || math.Abs(calls[1].CallCost-0.045) > 1e-9 {
+		t.Errorf("expected costs 0.165, 0.045 => (%v, %v)", calls[0].CallCost, calls[1].CallCost)
+	}
+	if math.Abs(total-0.21) > 1e-9 {
+		t.Errorf("expected total 0.21 => (%v)", total)
+	}
+}
+
+func TestCostAnalysis_CalculateEgressNAT(t *testing.T) {
+	ca := &CostAnalysis{
+		pricing: Pricing{
+			"us-west1-b": {"us-west1-c": 0.01},
+		},
+		internet:   map[string]float64{"*": 0.1},
+		processing: map[string]float64{NATProcessing: 0.05},
+		natGateway: true,
+	}
+	gb := uint64(math.Pow(10, 9))
+	calls := []*Call{
+		{From: "us-west1-b", FromWorkload: "a", To: "us-west1-c", ToWorkload: "istio-egressgateway", CallSize: gb, Kind: EgressGatewayCall},
+		{From: "us-west1-c", FromWorkload: "istio-egressgateway", To: InternetDestination, ToWorkload: "example.com", CallSize: gb, Kind: InternetCall},
+	}
+	total, err := ca.CalculateEgress(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the gateway hop is priced as a mesh call, without processing
+	if math.Abs(calls[0].CallCost-0.01) > 1e-9 || calls[0].ProcessingCost != 0 {
+		t.Errorf("expected gateway hop cost 0.01 without processing => (%v, %v)", calls[0].CallCost, calls[0].ProcessingCost)
+	}
+	if math.Abs(calls[1].CallCost-0.15) > 1e-9 || math.Abs(calls[1].ProcessingCost-0.05) > 1e-9 {
+		t.Errorf("expected internet cost 0.15 with processing 0.05 => (%v, %v)", calls[1].CallCost, calls[1].ProcessingCost)
+	}
+	if math.Abs(total-0.16) > 1e-9 {
+		t.Errorf("expected total 0.16 => (%v)", total)
+	}
+}
+
+func TestCostAnalysis_CalculateEgressLoadBalancer(t *testing.T) {
+	ca := &CostAnalysis{
+		pricing: Pricing{
+			"us-west1-a": {"us-west1-b": 0.01},
+		},
+		processing:   map[string]float64{LoadBalancerProcessing: 0.008},
+		loadBalancer: true,
+	}
+	gb := uint64(math.Pow(10, 9))
+	calls := []*Call{
+		{From: "us-west1-a", FromWorkload: "istio-ingressgateway", To: "us-west1-b", ToWorkload: "productpage-v1", CallSize: gb, Kind: IngressGatewayCall},
+		// no rate within a zone, but the traffic still went through the load balancer
+		{From: "us-west1-b", FromWorkload: "istio-ingressgateway", To: "us-west1-b", ToWorkload: "productpage-v1", CallSize: gb, Kind: IngressGatewayCall},
+		// mesh traffic doesn't go through the load balancer
+		{From: "us-west1-a", FromWorkload: "reviews-v1", To: "us-west1-b", ToWorkload: "productpage-v1", CallSize: gb},
+	}
+	total, err := ca.CalculateEgress(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []float64{0.018, 0.008, 0.01}
+	for i, c := range calls {
+		if math.Abs(c.CallCost-expected[i]) > 1e-9 {
+			t.Errorf("expected cost %v for call %v => (%v)", expected[i], i, c.CallCost)
+		}
+	}
+	if math.Abs(total-0.036) > 1e-9 {
+		t.Errorf("expected total 0.036 => (%v)", total)
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/util/json"
+	"math"
+	"os"
+	"strings"
+)
+
+// Currency is an ISO 4217 currency code, like USD.
+type Currency string
+
+// USD is the currency of price sheets that don't set one.
+const USD Currency = "USD"
+
+var currencySymbols = map[Currency]string{
+	"USD": "$",
+	"EUR": "€",
+	"GBP": "£",
+	"JPY": "¥",
+	"CNY": "¥",
+	"INR": "₹",
+	"KRW": "₩",
+}
+
+// currencyDecimals holds the currencies that don't have two minor digits.
+var currencyDecimals = map[Currency]int{
+	"JPY": 0,
+	"KRW": 0,
+}
+
+// Format formats an amount in the currency, like $1.50 or ¥150. Zero is formatted as
+// "-", and amounts smaller than the currency's minor unit as "<$0.01".
+func (c Currency) Format(amount float64) string {
+	decimals, ok := currencyDecimals[c]
+	if !ok {
+		decimals = 2
+	}
+	format := func(v float64) string {
+		if symbol, ok := currencySymbols[c]; ok {
+			return fmt.Sprintf("%v%.*f", symbol, decimals, v)
+		}
+		return fmt.Sprintf("%.*f %v", decimals, v, c)
+	}
+	if amount == 0 {
+		return "-"
+	}
+	if minor := math.Pow(10, -float64(decimals)); amount < minor {
+		return "<" + format(minor)
+	}
+	return format(amount)
+}
+
+// ExchangeRates is a local exchange rate file. Each rate is the amount of that currency
+// one unit of Base buys.
+type ExchangeRates struct {
+	Base  Currency             `json:"base"`
+	Date  string               `json:"date,omitempty"`
+	Rates map[Currency]float64 `json:"rates"`
+	path  string
+}
+
+// loadExchangeRates reads the exchange rate file at path.
+func loadExchangeRates(path string) (*ExchangeRates, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("unable to read file %v: %v", path, err)
+		return nil, err
+	}
+	rates := &ExchangeRates{}
+	if err := json.Unmarshal(data, rates); err != nil {
+		fmt.Printf("unable to unmarshal json into object: %v", err)
+		return nil, err
+	}
+	if rates.Base == "" {
+		return nil, fmt.Errorf("exchange rate file %v has no base currency", path)
+	}
+	rates.Base = Currency(strings.ToUpper(string(rates.Base)))
+	normalized := make(map[Currency]float64, len(rates.Rates))
+	for c, r := range rates.Rates {
+		if r <= 0 {
+			return nil, fmt.Errorf("exchange rate for %v in %v must be positive, got %v", c, path, r)
+		}
+		normalized[Currency(strings.ToUpper(string(c)))] = r
+	}
+	rates.Rates = normalized
+	rates.path = path
+	return rates, nil
+}
+
+// convert returns how many units of to one unit of from buys.
+func (r *ExchangeRates) convert(from, to Currency) (float64, error) {
+	rate := func(c Currency) (float64, error) {
+		if c == r.Base {
+			return 1, nil
+		}
+		if v, ok := r.Rates[c]; ok {
+			return v, nil
+		}
+		return 0, fmt.Errorf("no exchange rate for %v in %v", c, r.path)
+	}
+	fromRate, err := rate(from)
+	if err != nil {
+		return 0, err
+	}
+	toRate, err := rate(to)
+	if err != nil {
+		return 0, err
+	}
+	return toRate / fromRate, nil
+}
@@ -0,0 +1,131 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestCurrency_Format(t *testing.T) {
+	tests := []struct {
+		currency Currency
+		amount   float64
+		expected string
+	}{
+		{USD, 0, "-"},
+		{USD, 0.001, "<$0.01"},
+		{USD, 1.5, "$1.50"},
+		{"EUR", 1.5, "€1.50"},
+		{"JPY", 0.5, "<¥1"},
+		{"JPY", 150.4, "¥150"},
+		{"CHF", 2, "2.00 CHF"},
+	}
+	for _, tt := range tests {
+		if got := tt.currency.Format(tt.amount); got != tt.expected {
+			t.Errorf("%v.Format(%v) = %v, want %v", tt.currency, tt.amount, got, tt.expected)
+		}
+	}
+}
+
+func TestCostAnalysis_Currency(t *testing.T) {
+	tests := []struct {
+		name          string
+		currency      Currency
+		ratesPath     string
+		expectedCost  float64
+		expectedError bool
+	}{
+		{
+			name:         "sheet currency",
+			currency:     "",
+			expectedCost: 0.01,
+		},
+		{
+			name:         "explicit sheet currency",
+			currency:     "usd",
+			expectedCost: 0.01,
+		},
+		{
+			name:         "base currency",
+			currency:     "EUR",
+			ratesPath:    "testdata/exchange_rates.json",
+			expectedCost: 0.008,
+		},
+		{
+			name:         "cross rate",
+			currency:     "jpy",
+			ratesPath:    "testdata/exchange_rates.json",
+			expectedCost: 1.2,
+		},
+		{
+			name:          "no rates file",
+			currency:      "EUR",
+			expectedError: true,
+		},
+		{
+			name:          "missing rate",
+			currency:      "GBP",
+			ratesPath:     "testdata/exchange_rates.json",
+			expectedError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultPriceSheetOptions()
+			opts.Currency, opts.ExchangeRatesPath = tt.currency, tt.ratesPath
+			ca, err := NewCostAnalysisWithOptions("testdata/valid_pricing.json", opts)
+			if (err != nil) != tt.expectedError {
+				t.Fatalf("expected error existence: %v => (%v)", tt.expectedError, err)
+			}
+			if err != nil {
+				return
+			}
+			calls := []*Call{{From: "us-west1-a", To: "us-west1-b", CallSize: uint64(math.Pow(10, 9))}}
+			if _, err := ca.CalculateEgress(calls); err != nil {
+				t.Fatal(err)
+			}
+			if math.Abs(calls[0].CallCost-tt.expectedCost) > 1e-9 {
+				t.Errorf("expected cost %v => (%v) [%v]", tt.expectedCost, calls[0].CallCost, ca.CurrencyInfo())
+			}
+		})
+	}
+}
+
+func TestCostAnalysis_Report(t *testing.T) {
+	opts := DefaultPriceSheetOptions()
+	opts.Currency, opts.ExchangeRatesPath = "EUR", "testdata/exchange_rates.json"
+	ca, err := NewCostAnalysisWithOptions("testdata/valid_pricing.json", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls := []*Call{{From: "us-west1-a", To: "us-west1-b", CallSize: uint64(math.Pow(10, 9))}}
+	total, err := ca.CalculateEgress(calls)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report := ca.Report(calls, total)
+	if report.Currency != "EUR" || math.Abs(report.Total-0.008) > 1e-9 || len(report.Calls) != 1 {
+		t.Errorf("expected a report of 0.008 EUR for one call => (%+v)", report)
+	}
+	expected := &ExchangeRateSource{From: USD, To: "EUR", Rate: 0.8, File: "testdata/exchange_rates.json", Date: "2024-05-01"}
+	if !reflect.DeepEqual(report.ExchangeRate, expected) {
+		t.Errorf("expected exchange rate %+v => (%+v)", expected, report.ExchangeRate)
+	}
+	if got := calls[0].StringCost(report.Currency); got != " (us-west1-a)-> (us-west1-b) : <€0.01" {
+		t.Errorf("unexpected StringCost() %q", got)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// Reverted is the outcome of reverting one change setup or the webhook made.
+type Reverted struct {
+	Change string
+	// Gone is whether there was nothing left to revert, like an object already deleted.
+	Gone bool
+	Err  error
+}
+
+// PrintReverted prints what was reverted, and returns how many changes failed to be.
+func PrintReverted(w io.Writer, results []Reverted) int {
+	failed, gone := 0, 0
+	for _, r := range results {
+		switch {
+		case r.Err != nil:
+			fmt.Fprintf(w, "[FAIL] %v: %v\n", r.Change, r.Err)
+			failed++
+		case r.Gone:
+			fmt.Fprintf(w, "[GONE] %v\n", r.Change)
+			gone++
+		default:
+			fmt.Fprintf(w, "[DONE] %v\n", r.Change)
+		}
+	}
+	fmt.Fprintf(w, "%v reverted, %v already gone, %v failed\n", len(results)-failed-gone, gone, failed)
+	return failed
+}
+
+func reverted(change string, err error) Reverted {
+	if apierrors.IsNotFound(err) {
+		return Reverted{Change: change, Gone: true}
+	}
+	return Reverted{Change: change, Err: err}
+}
+
+// LegacySetupRecord is the record of a setup that didn't keep one: everything setup may
+// have created, and the namespaces the webhook in namespace was set up for.
+func (k *KubeClient) LegacySetupRecord(namespace, istioNamespace string) (*SetupRecord, error) {
+	objects, err := NewSetupObjects(SetupConfig{AnalyzerNamespace: namespace, TelemetryNamespace: istioNamespace})
+	if err != nil {
+		return nil, err
+	}
+	manifests, err := objects.Manifests()
+	if err != nil {
+		return nil, err
+	}
+	record := &SetupRecord{}
+	for _, m := range manifests {
+		record.AddCreated(RefOf(m))
+	}
+	_, targets := k.CheckWebhook(namespace)
+	for _, ns := range targets {
+		record.AddLabelledNamespace(ns)
+	}
+	return record, nil
+}
+
+// RevertSetup reverts the changes in record, and those the webhook made to workloads and
+// pods. If all of them are reverted, the record in namespace is deleted.
+func (k *KubeClient) RevertSetup(namespace string, record *SetupRecord) []Reverted {
+	results := make([]Reverted, 0)
+	// in reverse, so the webhook configuration is deleted before the webhook
+	for i := len(record.Created) - 1; i >= 0; i-- {
+		ref := record.Created[i]
+		results = append(results, reverted("delete "+ref.String(), k.DeleteObject(ref)))
+	}
+	for _, ref := range record.Generated {
+		results = append(results, reverted("delete "+ref.String(), k.DeleteObject(ref)))
+	}
+	results = append(results, k.revertWorkloads(WorkloadKinds(record.WorkloadKinds))...)
+	for _, ns := range record.LabelledNamespaces {
+		err := k.UnlabelNamespace(ns, AnalysisEnabledLabel)
+		results = append(results, reverted(fmt.Sprintf("remove label %v from namespace %v", AnalysisEnabledLabel, ns), err))
+	}
+	if op := record.Operator; op != nil {
+		err := k.DeleteOperatorConfig(op.Name, op.Namespace)
+		results = append(results, reverted(fmt.Sprintf("remove %v from istio operator %v/%v", localityTag, op.Namespace, op.Name), err))
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			// keep the record, to retry what failed
+			return results
+		}
+	}
+	return append(results, reverted("delete setup record "+namespace+"/"+SetupRecordName, k.DeleteSetupRecord(namespace)))
+}
+
+// revertWorkloads removes what the webhook added to the workloads of kinds and pods it
+// marked. Immutable kinds can't be changed, so only their pods are reverted.
+func (k *KubeClient) revertWorkloads(kinds []WorkloadKind) []Reverted {
+	results := make([]Reverted, 0)
+	for _, kind := range kinds {
+		if kind.Immutable {
+			continue
+		}
+		workloads, err := k.dynamic.Resource(kind.GroupVersionResource()).Namespace("").List(context.TODO(), metav1.ListOptions{})
+		if apierrors.IsNotFound(err) {
+			// a custom resource that isn't installed
+			continue
+		}
+		if err != nil {
+			results = append(results, Reverted{Change: "list " + kind.Resource, Err: err})
+			continue
+		}
+		for _, w := range workloads.Items {
+			if _, ok := w.GetAnnotations()[MutatedAnnotation]; !ok {
+				continue
+			}
+			annotations, _, _ := unstructured.NestedStringMap(w.Object, kind.annotationFields()...)
+			patch := []jsonPatchOp{removeOp("/metadata/annotations/" + escapeJSONPointer(MutatedAnnotation))}
+			patch = append(patch, statTagsPatch("/"+strings.Join(kind.annotationFields(), "/")+"/", annotations)...)
+			_, err := k.dynamic.Resource(kind.GroupVersionResource()).Namespace(w.GetNamespace()).Patch(context.TODO(), w.GetName(), types.JSONPatchType, marshalPatch(patch), metav1.PatchOptions{})
+			results = append(results, reverted(fmt.Sprintf("remove %v from %v %v/%v (restarts its pods)", extraStatTagsAnnotation, strings.ToLower(kind.Kind), w.GetNamespace(), w.GetName()), err))
+		}
+	}
+	pods, err := k.clientSet.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return append(results, Reverted{Change: "list pods", Err: err})
+	}
+	for _, p := range pods.Items {
+		if _, ok := p.Annotations[MutatedAnnotation]; !ok {
+			continue
+		}
+		patch := []jsonPatchOp{removeOp("/metadata/annotations/" + escapeJSONPointer(MutatedAnnotation))}
+		if _, ok := p.Labels["locality"]; ok {
+			patch = append(patch, removeOp("/metadata/labels/locality"))
+		}
+		patch = append(patch, statTagsPatch("/metadata/annotations/", p.Annotations)...)
+		_, err := k.clientSet.CoreV1().Pods(p.Namespace).Patch(context.TODO(), p.Name, types.JSONPatchType, marshalPatch(patch), metav1.PatchOptions{})
+		results = append(results, reverted(fmt.Sprintf("remove locality label from pod %v/%v", p.Namespace, p.Name), err))
+	}
+	return results
+}
+
+type jsonPatchOp struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value string `json:"value,omitempty"`
+}
+
+func removeOp(path string) jsonPatchOp {
+	return jsonPatchOp{Op: "remove", Path: path}
+}
+
+func marshalPatch(patch []jsonPatchOp) []byte {
+	data, _ := json.Marshal(patch)
+	return data
+}
+
+// escapeJSONPointer escapes a map key, like an annotation, for a JSON pointer.
+func escapeJSONPointer(key string) string {
+	return strings.NewReplacer("~", "~0", "/", "~1").Replace(key)
+}
+
+// statTagsPatch removes destination_locality from the extraStatTags annotation in
+// annotations, at the prefix path, leaving any other tags.
+func statTagsPatch(prefix string, annotations map[string]string) []jsonPatchOp {
+	value, ok := annotations[extraStatTagsAnnotation]
+	if !ok {
+		return nil
+	}
+	path := prefix + escapeJSONPointer(extraStatTagsAnnotation)
+	tags := make([]string, 0)
+	for _, tag := range strings.Split(value, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" && tag != localityTag {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) == 0 {
+		return []jsonPatchOp{removeOp(path)}
+	}
+	return []jsonPatchOp{{Op: "replace", Path: path, Value: strings.Join(tags, ",")}}
+}
@@ -0,0 +1,219 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestKubeClient_SetupRecord(t *testing.T) {
+	k := &KubeClient{clientSet: fake.NewSimpleClientset()}
+	record, err := k.LoadSetupRecord("istio-system")
+	if err != nil || record != nil {
+		t.Fatalf("LoadSetupRecord() = %v, %v, want none", record, err)
+	}
+	want := &SetupRecord{LabelledNamespaces: []string{"default"}}
+	want.AddCreated(ObjectRef{Version: "v1", Resource: "serviceaccounts", Namespace: "istio-system", Name: ServiceAccountName})
+	want.AddCreated(ObjectRef{Version: "v1", Resource: "serviceaccounts", Namespace: "istio-system", Name: ServiceAccountName})
+	want.AddLabelledNamespace("default")
+	// saved twice, to update it
+	for i := 0; i < 2; i++ {
+		if err := k.SaveSetupRecord("istio-system", want); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := k.LoadSetupRecord("istio-system")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("LoadSetupRecord() = %+v, want %+v", got, want)
+	}
+}
+
+func TestStatTagsPatch(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        []jsonPatchOp
+	}{
+		{
+			name: "not annotated",
+		},
+		{
+			name:        "only ours",
+			annotations: map[string]string{extraStatTagsAnnotation: localityTag},
+			want:        []jsonPatchOp{{Op: "remove", Path: "/metadata/annotations/sidecar.istio.io~1extraStatTags"}},
+		},
+		{
+			name:        "others",
+			annotations: map[string]string{extraStatTagsAnnotation: "request_host, destination_locality,source_port"},
+			want:        []jsonPatchOp{{Op: "replace", Path: "/metadata/annotations/sidecar.istio.io~1extraStatTags", Value: "request_host,source_port"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := statTagsPatch("/metadata/annotations/", tt.annotations); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("statTagsPatch() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeClient_RevertSetup(t *testing.T) {
+	objects, err := NewSetupObjects(SetupConfig{AnalyzerNamespace: "istio-system", TargetNamespaces: []string{"default"}, TelemetryNamespace: "istio-system"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := objects.Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &SetupRecord{LabelledNamespaces: []string{"default"}}
+	live := make([]runtime.Object, 0)
+	for _, m := range manifests {
+		switch m.Object.GetKind() {
+		case "Namespace":
+		case "ServiceAccount":
+			// existed before setup, so it isn't recorded
+			live = append(live, m.Object)
+		case "Telemetry":
+			// recorded, but already deleted
+			record.AddCreated(RefOf(m))
+		default:
+			record.AddCreated(RefOf(m))
+			live = append(live, m.Object)
+		}
+	}
+	// created by the webhook
+	for _, ref := range objects.Generated() {
+		record.AddGenerated(ref)
+		live = append(live, &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Secret",
+			"metadata":   map[string]interface{}{"name": ref.Name, "namespace": ref.Namespace},
+		}})
+	}
+	marked := map[string]string{MutatedAnnotation: "true"}
+	deployment := &appsv1.Deployment{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "Deployment"},
+		ObjectMeta: metav1.ObjectMeta{Name: "reviews-v1", Namespace: "default", Annotations: marked},
+		Spec: appsv1.DeploymentSpec{Template: v1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{extraStatTagsAnnotation: "request_host,destination_locality"},
+		}}},
+	}
+	statefulSet := &appsv1.StatefulSet{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "apps/v1", Kind: "StatefulSet"},
+		ObjectMeta: metav1.ObjectMeta{Name: "kafka", Namespace: "default", Annotations: marked},
+		Spec: appsv1.StatefulSetSpec{Template: v1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{extraStatTagsAnnotation: localityTag},
+		}}},
+	}
+	for _, w := range []runtime.Object{deployment, statefulSet} {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		live = append(live, &unstructured.Unstructured{Object: obj})
+	}
+	listKinds := map[schema.GroupVersionResource]string{}
+	for _, kind := range DefaultWorkloadKinds {
+		listKinds[kind.GroupVersionResource()] = kind.Kind + "List"
+	}
+	pod := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "reviews-v1-1", Namespace: "default",
+		Labels:      map[string]string{"app": "reviews", "locality": "us-west1-a"},
+		Annotations: map[string]string{MutatedAnnotation: "true", extraStatTagsAnnotation: localityTag},
+	}}
+	// not changed by the webhook, so left alone
+	unmarked := &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Name: "ratings-v1-1", Namespace: "default",
+		Labels:      map[string]string{"locality": "us-west1-a"},
+		Annotations: map[string]string{extraStatTagsAnnotation: localityTag},
+	}}
+	namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: map[string]string{AnalysisEnabledLabel: "true", "team": "shop"}}}
+	clientSet := fake.NewSimpleClientset(pod, unmarked, namespace)
+	k := &KubeClient{clientSet: clientSet, dynamic: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), listKinds, live...)}
+	if err := k.SaveSetupRecord("istio-system", record); err != nil {
+		t.Fatal(err)
+	}
+
+	results := k.RevertSetup("istio-system", record)
+	out := &bytes.Buffer{}
+	if failed := PrintReverted(out, results); failed != 0 {
+		t.Fatalf("RevertSetup() failed:\n%v", out)
+	}
+	if !strings.Contains(out.String(), "[GONE] delete telemetries istio-system/"+LocalityTelemetryName) {
+		t.Errorf("deleted telemetry not reported as gone:\n%v", out)
+	}
+
+	for _, m := range manifests {
+		_, err := k.dynamic.Resource(m.Resource).Namespace(m.Object.GetNamespace()).Get(context.TODO(), m.Object.GetName(), metav1.GetOptions{})
+		if exists := !apierrors.IsNotFound(err); exists != (m.Object.GetKind() == "ServiceAccount") {
+			t.Errorf("%v exists = %v after destroy", m, exists)
+		}
+	}
+	for _, ref := range record.Generated {
+		if _, err := k.dynamic.Resource(ref.GroupVersionResource()).Namespace(ref.Namespace).Get(context.TODO(), ref.Name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+			t.Errorf("%v exists after destroy", ref)
+		}
+	}
+	for _, tt := range []struct {
+		kind     WorkloadKind
+		name     string
+		wantTags string
+	}{
+		{DefaultWorkloadKinds[0], "reviews-v1", "request_host"},
+		{DefaultWorkloadKinds[1], "kafka", ""},
+	} {
+		got, err := k.dynamic.Resource(tt.kind.GroupVersionResource()).Namespace("default").Get(context.TODO(), tt.name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		annotations, _, _ := unstructured.NestedStringMap(got.Object, tt.kind.annotationFields()...)
+		if _, ok := got.GetAnnotations()[MutatedAnnotation]; ok || annotations[extraStatTagsAnnotation] != tt.wantTags {
+			t.Errorf("%v %v not reverted: %v, %v", tt.kind.Kind, tt.name, got.GetAnnotations(), annotations)
+		}
+	}
+	gotPod, _ := clientSet.CoreV1().Pods("default").Get(context.TODO(), "reviews-v1-1", metav1.GetOptions{})
+	if len(gotPod.Annotations) != 0 || !reflect.DeepEqual(gotPod.Labels, map[string]string{"app": "reviews"}) {
+		t.Errorf("pod not reverted: %v, %v", gotPod.Labels, gotPod.Annotations)
+	}
+	gotUnmarked, _ := clientSet.CoreV1().Pods("default").Get(context.TODO(), "ratings-v1-1", metav1.GetOptions{})
+	if !reflect.DeepEqual(gotUnmarked.Labels, unmarked.Labels) {
+		t.Errorf("unmarked pod changed: %v", gotUnmarked.Labels)
+	}
+	gotNamespace, _ := clientSet.CoreV1().Namespaces().Get(context.TODO(), "default", metav1.GetOptions{})
+	if !reflect.DeepEqual(gotNamespace.Labels, map[string]string{"team": "shop"}) {
+		t.Errorf("namespace labels = %v, want the analysis label removed", gotNamespace.Labels)
+	}
+	if got, _ := k.LoadSetupRecord("istio-system"); got != nil {
+		t.Errorf("setup record not deleted: %+v", got)
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"sigs.k8s.io/yaml"
+)
+
+// ManifestChange is what applying a manifest would change in the cluster.
+type ManifestChange struct {
+	Manifest Manifest
+	// Exists is whether the object is already in the cluster.
+	Exists bool
+	// Diff is a line diff from the fields the manifest sets as they are in the cluster,
+	// to the manifest. It's empty if nothing would change.
+	Diff string
+}
+
+// PlanManifests compares manifests to the cluster, without changing anything.
+func (k *KubeClient) PlanManifests(manifests []Manifest) ([]ManifestChange, error) {
+	changes := make([]ManifestChange, 0, len(manifests))
+	for _, m := range manifests {
+		live, err := k.dynamic.Resource(m.Resource).Namespace(m.Object.GetNamespace()).Get(context.TODO(), m.Object.GetName(), metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			diff, err := yamlDiff(nil, m.Object.Object)
+			if err != nil {
+				return nil, err
+			}
+			changes = append(changes, ManifestChange{Manifest: m, Diff: diff})
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to get %v: %w", m, err)
+		}
+		diff, err := yamlDiff(project(live.Object, m.Object.Object), m.Object.Object)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, ManifestChange{Manifest: m, Exists: true, Diff: diff})
+	}
+	return changes, nil
+}
+
+// PlanIstioOperator returns a diff of the telemetry config EditIstioOperator would change,
+// or an empty string if it's already set up.
+func (k *KubeClient) PlanIstioOperator(opName, opNamespace string) (string, error) {
+	res, err := k.dynamic.Resource(iopResource).Namespace(opNamespace).Get(context.TODO(), opName, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	before, _, err := unstructured.NestedSlice(res.Object, outboundMetricsPath...)
+	if err != nil {
+		return "", err
+	}
+	if _, err := normalizeOperator(res); err != nil {
+		return "", err
+	}
+	after, _, _ := unstructured.NestedSlice(res.Object, outboundMetricsPath...)
+	return yamlDiff(before, after)
+}
+
+// project returns the parts of live that desired sets, so fields defaulted or added by the
+// server or other tools don't show up as changes.
+func project(live, desired interface{}) interface{} {
+	switch d := desired.(type) {
+	case map[string]interface{}:
+		l, ok := live.(map[string]interface{})
+		if !ok {
+			return live
+		}
+		projected := make(map[string]interface{}, len(d))
+		for k, v := range d {
+			if lv, ok := l[k]; ok {
+				projected[k] = project(lv, v)
+			}
+		}
+		return projected
+	case []interface{}:
+		l, ok := live.([]interface{})
+		if !ok || len(l) != len(d) {
+			return live
+		}
+		projected := make([]interface{}, len(l))
+		for i := range l {
+			projected[i] = project(l[i], d[i])
+		}
+		return projected
+	}
+	return live
+}
+
+// yamlDiff renders a line diff between from and to as yaml. It returns an empty string if
+// they're the same.
+func yamlDiff(from, to interface{}) (string, error) {
+	fromLines, err := yamlLines(from)
+	if err != nil {
+		return "", err
+	}
+	toLines, err := yamlLines(to)
+	if err != nil {
+		return "", err
+	}
+	return lineDiff(fromLines, toLines), nil
+}
+
+// yamlLines renders v as yaml lines, or none if v is nil.
+func yamlLines(v interface{}) ([]string, error) {
+	if v == nil {
+		return nil, nil
+	}
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"), nil
+}
+
+// lineDiff returns the lines of from and to, prefixed with "- " if they were removed, "+ "
+// if they were added and "  " if they're in both, or an empty string if there's no change.
+func lineDiff(from, to []string) string {
+	// longest common subsequence, from the end
+	lcs := make([][]int, len(from)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(to)+1)
+	}
+	for i := len(from) - 1; i >= 0; i-- {
+		for j := len(to) - 1; j >= 0; j-- {
+			switch {
+			case from[i] == to[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var out strings.Builder
+	changed := false
+	i, j := 0, 0
+	for i < len(from) || j < len(to) {
+		switch {
+		case i < len(from) && j < len(to) && from[i] == to[j]:
+			out.WriteString("  " + from[i] + "\n")
+			i, j = i+1, j+1
+		case j == len(to) || (i < len(from) && lcs[i+1][j] >= lcs[i][j+1]):
+			out.WriteString("- " + from[i] + "\n")
+			i, changed = i+1, true
+		default:
+			out.WriteString("+ " + to[j] + "\n")
+			j, changed = j+1, true
+		}
+	}
+	if !changed {
+		return ""
+	}
+	return out.String()
+}
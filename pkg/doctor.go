@@ -0,0 +1,295 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// extraStatTagsAnnotation is the annotation the webhook adds to pods, for their sidecar to
+// report the destination_locality tag.
+const extraStatTagsAnnotation = "sidecar.istio.io/extraStatTags"
+
+// maxExamples is how many failing objects a check names.
+const maxExamples = 3
+
+// Check is the result of one of the checks of the analyzer's prerequisites.
+type Check struct {
+	Name   string
+	Passed bool
+	// Detail is what was found.
+	Detail string
+	// Hint is how to fix a failed check.
+	Hint string
+}
+
+// PrintChecks prints checks, with the hints of those that failed. It returns how many failed.
+func PrintChecks(w io.Writer, checks []Check) int {
+	failed := 0
+	for _, c := range checks {
+		status := "PASS"
+		if !c.Passed {
+			status = "FAIL"
+			failed++
+		}
+		fmt.Fprintf(w, "[%v] %v: %v\n", status, c.Name, c.Detail)
+		if !c.Passed && c.Hint != "" {
+			fmt.Fprintf(w, "       hint: %v\n", c.Hint)
+		}
+	}
+	return failed
+}
+
+// CheckWebhook checks the webhook's Deployment is ready, its Service has endpoints and its
+// MutatingWebhookConfiguration has a caBundle. It also returns the namespaces the webhook
+// was set up for, which are empty for all namespaces.
+func (k *KubeClient) CheckWebhook(namespace string) ([]Check, []string) {
+	setupHint := "run istio-cost-analyzer setup, with --analyzerNamespace if it's not istio-system"
+	checks := make([]Check, 0, 3)
+	var targets []string
+	deployment, err := k.clientSet.AppsV1().Deployments(namespace).Get(context.TODO(), WebhookName, metav1.GetOptions{})
+	switch {
+	case err != nil:
+		checks = append(checks, Check{Name: "webhook deployment", Detail: err.Error(), Hint: setupHint})
+	case deployment.Status.AvailableReplicas == 0:
+		checks = append(checks, Check{
+			Name:   "webhook deployment",
+			Detail: fmt.Sprintf("%v/%v has no available replicas", namespace, WebhookName),
+			Hint:   fmt.Sprintf("kubectl -n %v describe deployment %v, and check its pods' init container logs", namespace, WebhookName),
+		})
+	default:
+		checks = append(checks, Check{
+			Name:   "webhook deployment",
+			Passed: true,
+			Detail: fmt.Sprintf("%v/%v has %v available replicas", namespace, WebhookName, deployment.Status.AvailableReplicas),
+		})
+	}
+	if err == nil && len(deployment.Spec.Template.Spec.Containers) > 0 {
+		for _, env := range deployment.Spec.Template.Spec.Containers[0].Env {
+			if env.Name == "NAMESPACE" && env.Value != "" {
+				targets = strings.Split(env.Value, ",")
+			}
+		}
+	}
+
+	endpoints, err := k.clientSet.CoreV1().Endpoints(namespace).Get(context.TODO(), WebhookName, metav1.GetOptions{})
+	addresses := 0
+	if err == nil {
+		for _, subset := range endpoints.Subsets {
+			addresses += len(subset.Addresses)
+		}
+	}
+	switch {
+	case apierrors.IsNotFound(err):
+		checks = append(checks, Check{Name: "webhook service", Detail: fmt.Sprintf("%v/%v not found", namespace, WebhookName), Hint: setupHint})
+	case err != nil:
+		checks = append(checks, Check{Name: "webhook service", Detail: err.Error()})
+	case addresses == 0:
+		checks = append(checks, Check{
+			Name:   "webhook service",
+			Detail: fmt.Sprintf("%v/%v has no ready endpoints", namespace, WebhookName),
+			Hint:   "the webhook deployment's pods aren't ready",
+		})
+	default:
+		checks = append(checks, Check{Name: "webhook service", Passed: true, Detail: fmt.Sprintf("%v/%v has %v ready endpoints", namespace, WebhookName, addresses)})
+	}
+
+	config, err := k.clientSet.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(context.TODO(), WebhookConfigurationName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		checks = append(checks, Check{
+			Name:   "mutating webhook configuration",
+			Detail: fmt.Sprintf("%v not found", WebhookConfigurationName),
+			Hint:   "it's applied by setup; run setup again",
+		})
+	case err != nil:
+		checks = append(checks, Check{Name: "mutating webhook configuration", Detail: err.Error()})
+	default:
+		check := Check{Name: "mutating webhook configuration", Passed: true, Detail: fmt.Sprintf("%v has a caBundle", WebhookConfigurationName)}
+		for _, w := range config.Webhooks {
+			if len(w.ClientConfig.CABundle) == 0 {
+				check = Check{
+					Name:   "mutating webhook configuration",
+					Detail: fmt.Sprintf("webhook %v of %v has no caBundle", w.Name, WebhookConfigurationName),
+					Hint:   "the webhook fills it in when it starts, or cert-manager's CA injector does with --certManager; check their logs",
+				}
+			}
+		}
+		checks = append(checks, check)
+	}
+	return checks, targets
+}
+
+// CheckNamespaces checks the namespaces the webhook was set up for are labelled for it to
+// handle their deployments.
+func (k *KubeClient) CheckNamespaces(namespaces []string) Check {
+	if len(namespaces) == 0 {
+		return Check{Name: "target namespaces", Passed: true, Detail: "the webhook was set up for all namespaces"}
+	}
+	unlabelled := make([]string, 0)
+	for _, name := range namespaces {
+		ns, err := k.clientSet.CoreV1().Namespaces().Get(context.TODO(), name, metav1.GetOptions{})
+		if err != nil {
+			unlabelled = append(unlabelled, fmt.Sprintf("%v (%v)", name, err))
+			continue
+		}
+		if ns.Labels[AnalysisEnabledLabel] != "true" {
+			unlabelled = append(unlabelled, name)
+		}
+	}
+	if len(unlabelled) > 0 {
+		return Check{
+			Name:   "target namespaces",
+			Detail: fmt.Sprintf("not labelled %v=true: %v", AnalysisEnabledLabel, strings.Join(unlabelled, ", ")),
+			Hint:   fmt.Sprintf("kubectl label namespace <namespace> %v=true, or run setup with --targetNamespace", AnalysisEnabledLabel),
+		}
+	}
+	return Check{Name: "target namespaces", Passed: true, Detail: fmt.Sprintf("%v labelled %v=true", strings.Join(namespaces, ", "), AnalysisEnabledLabel)}
+}
+
+// CheckPods checks the pods with istio sidecars in namespaces have the locality label and
+// extraStatTags annotation the webhook adds. Empty namespaces means all namespaces.
+func (k *KubeClient) CheckPods(namespaces []string) Check {
+	if len(namespaces) == 0 {
+		namespaces = []string{""}
+	}
+	total := 0
+	missing := make([]string, 0)
+	for _, ns := range namespaces {
+		pods, err := k.clientSet.CoreV1().Pods(ns).List(context.TODO(), metav1.ListOptions{})
+		if err != nil {
+			return Check{Name: "pod labels", Detail: err.Error()}
+		}
+		for _, p := range pods.Items {
+			// only pods with a sidecar report metrics
+			if _, ok := p.Annotations["sidecar.istio.io/status"]; !ok {
+				continue
+			}
+			total++
+			if p.Labels["locality"] == "" || !strings.Contains(p.Annotations[extraStatTagsAnnotation], localityTag) {
+				missing = append(missing, p.Namespace+"/"+p.Name)
+			}
+		}
+	}
+	switch {
+	case total == 0:
+		return Check{
+			Name:   "pod labels",
+			Detail: "no pods with istio sidecars found",
+			Hint:   "label the target namespaces with istio-injection=enabled and restart their deployments",
+		}
+	case len(missing) > 0:
+		examples := missing
+		if len(examples) > maxExamples {
+			examples = examples[:maxExamples]
+		}
+		return Check{
+			Name:   "pod labels",
+			Detail: fmt.Sprintf("%v of %v pods with sidecars lack the locality label or %v annotation, like %v", len(missing), total, extraStatTagsAnnotation, strings.Join(examples, ", ")),
+			Hint:   "pods created before setup aren't labelled until they're recreated; kubectl rollout restart their deployments, or run setup with --backfill",
+		}
+	}
+	return Check{Name: "pod labels", Passed: true, Detail: fmt.Sprintf("all %v pods with sidecars have the locality label and %v annotation", total, extraStatTagsAnnotation)}
+}
+
+// CheckTelemetry checks istio is configured to report destination_locality, either with the
+// Telemetry resource created by setup, or by the IstioOperator. If opName is empty, the
+// first healthy operator in opNamespace is checked.
+func (k *KubeClient) CheckTelemetry(istioNamespace, opName, opNamespace string) Check {
+	_, err := k.dynamic.Resource(telemetryResource).Namespace(istioNamespace).Get(context.TODO(), LocalityTelemetryName, metav1.GetOptions{})
+	if err == nil {
+		return Check{Name: "telemetry override", Passed: true, Detail: fmt.Sprintf("telemetry %v/%v exists", istioNamespace, LocalityTelemetryName)}
+	}
+	hint := "run istio-cost-analyzer setup, with --istioNamespace set to the mesh's root namespace"
+	if opName == "" {
+		if opName, err = k.GetDefaultOperator(opNamespace); err != nil {
+			return Check{
+				Name:   "telemetry override",
+				Detail: fmt.Sprintf("no telemetry %v/%v, and %v", istioNamespace, LocalityTelemetryName, err),
+				Hint:   hint,
+			}
+		}
+	}
+	res, err := k.dynamic.Resource(iopResource).Namespace(opNamespace).Get(context.TODO(), opName, metav1.GetOptions{})
+	if err != nil {
+		return Check{Name: "telemetry override", Detail: fmt.Sprintf("no telemetry %v/%v, and %v", istioNamespace, LocalityTelemetryName, err), Hint: hint}
+	}
+	changed, err := normalizeOperator(res)
+	switch {
+	case err != nil:
+		return Check{Name: "telemetry override", Detail: fmt.Sprintf("istio operator %v/%v: %v", opNamespace, opName, err), Hint: "fix the operator's spec.values.telemetry.v2.prometheus.configOverride"}
+	case changed:
+		return Check{
+			Name:   "telemetry override",
+			Detail: fmt.Sprintf("no telemetry %v/%v, and istio operator %v/%v doesn't add %v", istioNamespace, LocalityTelemetryName, opNamespace, opName, localityTag),
+			Hint:   hint,
+		}
+	}
+	return Check{Name: "telemetry override", Passed: true, Detail: fmt.Sprintf("istio operator %v/%v adds %v", opNamespace, opName, localityTag)}
+}
+
+// CheckMetrics checks Prometheus is reachable, and has istio_request_bytes_sum series with
+// valid destination localities for traffic within the mesh.
+func (d *CostAnalyzerProm) CheckMetrics() []Check {
+	series, err := queryVector(v1.NewAPI(d.client), inferQuery, time.Now())
+	if err != nil {
+		return []Check{{
+			Name:   "prometheus",
+			Detail: err.Error(),
+			Hint:   "set --prometheusNamespace to the namespace prometheus runs in",
+		}}
+	}
+	checks := []Check{{Name: "prometheus", Passed: true, Detail: fmt.Sprintf("reachable at %v", d.promEndpoint)}}
+	mesh, valid := 0, 0
+	invalid := make([]string, 0)
+	for _, s := range series {
+		// traffic to the internet has no destination locality
+		if w := string(s.Metric["destination_workload"]); w == "" || w == "unknown" {
+			continue
+		}
+		mesh++
+		if d.validateLocality(string(s.Metric["destination_locality"])) {
+			valid++
+		} else if len(invalid) < maxExamples {
+			invalid = append(invalid, fmt.Sprintf("%v -> %v (%q)", s.Metric["source_workload"], s.Metric["destination_workload"], s.Metric["destination_locality"]))
+		}
+	}
+	switch {
+	case mesh == 0:
+		checks = append(checks, Check{
+			Name:   "istio_request_bytes_sum",
+			Detail: "no series for traffic within the mesh",
+			Hint:   "send traffic between workloads with sidecars, and check prometheus scrapes them",
+		})
+	case valid < mesh:
+		checks = append(checks, Check{
+			Name:   "destination_locality",
+			Passed: valid > 0,
+			Detail: fmt.Sprintf("%v of %v series have a valid destination_locality; invalid like %v", valid, mesh, strings.Join(invalid, ", ")),
+			Hint:   "check the pod labels and telemetry override above; series from before setup keep their old labels",
+		})
+	default:
+		checks = append(checks, Check{Name: "destination_locality", Passed: true, Detail: fmt.Sprintf("all %v series have a valid destination_locality", mesh)})
+	}
+	return checks
+}
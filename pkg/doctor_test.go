@@ -0,0 +1,236 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// checkResults returns whether each check passed, by name.
+func checkResults(checks []Check) map[string]bool {
+	results := make(map[string]bool, len(checks))
+	for _, c := range checks {
+		results[c.Name] = c.Passed
+	}
+	return results
+}
+
+func TestKubeClient_CheckWebhook(t *testing.T) {
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: WebhookName, Namespace: "istio-system"},
+		Spec: appsv1.DeploymentSpec{Template: v1.PodTemplateSpec{Spec: v1.PodSpec{Containers: []v1.Container{{
+			Env: []v1.EnvVar{{Name: "CLOUD"}, {Name: "NAMESPACE", Value: "default,shop"}},
+		}}}}},
+		Status: appsv1.DeploymentStatus{AvailableReplicas: 1},
+	}
+	endpoints := &v1.Endpoints{
+		ObjectMeta: metav1.ObjectMeta{Name: WebhookName, Namespace: "istio-system"},
+		Subsets:    []v1.EndpointSubset{{Addresses: []v1.EndpointAddress{{IP: "10.0.0.1"}}}},
+	}
+	// applied from rendered manifests, but the init container hasn't run
+	config := &admissionregistrationv1.MutatingWebhookConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: WebhookConfigurationName},
+		Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "mutating-webhook.istio-cost-analyzer.io"}},
+	}
+	k := &KubeClient{clientSet: fake.NewSimpleClientset(deployment, endpoints, config)}
+	checks, targets := k.CheckWebhook("istio-system")
+	expected := map[string]bool{
+		"webhook deployment":             true,
+		"webhook service":                true,
+		"mutating webhook configuration": false,
+	}
+	if got := checkResults(checks); !reflect.DeepEqual(got, expected) {
+		t.Errorf("CheckWebhook() = %v, want %v", got, expected)
+	}
+	if !reflect.DeepEqual(targets, []string{"default", "shop"}) {
+		t.Errorf("targets = %v, want [default shop]", targets)
+	}
+
+	checks, targets = (&KubeClient{clientSet: fake.NewSimpleClientset()}).CheckWebhook("istio-system")
+	for _, c := range checks {
+		if c.Passed || c.Hint == "" {
+			t.Errorf("without setup, check %v passed = %v, hint = %q", c.Name, c.Passed, c.Hint)
+		}
+	}
+	if targets != nil {
+		t.Errorf("without setup, targets = %v", targets)
+	}
+}
+
+func TestKubeClient_CheckNamespacesAndPods(t *testing.T) {
+	sidecar := map[string]string{"sidecar.istio.io/status": "{}", extraStatTagsAnnotation: localityTag}
+	labelled := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "reviews-v1-1", Namespace: "default", Labels: map[string]string{"locality": "us-west1-a"}, Annotations: sidecar}}
+	// created before setup
+	unlabelled := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "ratings-v1-1", Namespace: "shop", Annotations: map[string]string{"sidecar.istio.io/status": "{}"}}}
+	// no sidecar, so it doesn't matter
+	noSidecar := &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "job-1", Namespace: "default"}}
+	k := &KubeClient{clientSet: fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default", Labels: map[string]string{AnalysisEnabledLabel: "true"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shop"}},
+		labelled, unlabelled, noSidecar,
+	)}
+	tests := []struct {
+		name       string
+		namespaces []string
+		want       map[string]bool
+	}{
+		{
+			name:       "labelled",
+			namespaces: []string{"default"},
+			want:       map[string]bool{"target namespaces": true, "pod labels": true},
+		},
+		{
+			name:       "unlabelled",
+			namespaces: []string{"default", "shop"},
+			want:       map[string]bool{"target namespaces": false, "pod labels": false},
+		},
+		{
+			name: "all namespaces",
+			want: map[string]bool{"target namespaces": true, "pod labels": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checks := []Check{k.CheckNamespaces(tt.namespaces), k.CheckPods(tt.namespaces)}
+			if got := checkResults(checks); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("checks = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeClient_CheckTelemetry(t *testing.T) {
+	telemetry := &unstructured.Unstructured{}
+	telemetry.SetAPIVersion(telemetryGroupVersion)
+	telemetry.SetKind("Telemetry")
+	telemetry.SetNamespace("istio-system")
+	telemetry.SetName(LocalityTelemetryName)
+	operator := func(metrics []interface{}) *unstructured.Unstructured {
+		op := testOperator(metrics)
+		op.SetAPIVersion("install.istio.io/v1alpha1")
+		op.SetKind("IstioOperator")
+		op.SetNamespace("istio-system")
+		op.SetName("installed-state")
+		op.Object["status"] = map[string]interface{}{"status": "HEALTHY"}
+		return op
+	}
+	locality := map[string]interface{}{localityTag: localityTagValue}
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		want    bool
+	}{
+		{
+			name:    "telemetry",
+			objects: []runtime.Object{telemetry},
+			want:    true,
+		},
+		{
+			name: "operator",
+			objects: []runtime.Object{operator([]interface{}{
+				map[string]interface{}{"name": "request_bytes", "dimensions": locality},
+				map[string]interface{}{"name": "response_bytes", "dimensions": locality},
+			})},
+			want: true,
+		},
+		{
+			name:    "operator without the dimension",
+			objects: []runtime.Object{operator([]interface{}{})},
+		},
+		{
+			name: "neither",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := &KubeClient{dynamic: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{iopResource: "IstioOperatorList", telemetryResource: "TelemetryList"}, tt.objects...)}
+			if got := k.CheckTelemetry("istio-system", "", "istio-system"); got.Passed != tt.want {
+				t.Errorf("CheckTelemetry() = %+v, want passed = %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCostAnalyzerProm_CheckMetrics(t *testing.T) {
+	query := inferQuery
+	tests := []struct {
+		name   string
+		series []promSeries
+		want   map[string]bool
+	}{
+		{
+			name: "valid",
+			series: []promSeries{
+				{query: query, labels: map[string]string{"source_workload": "productpage-v1", "destination_workload": "reviews-v1", "destination_locality": "us-west1-b"}},
+				// internet traffic has no destination locality
+				{query: query, labels: map[string]string{"source_workload": "productpage-v1", "destination_workload": "unknown"}},
+			},
+			want: map[string]bool{"prometheus": true, "destination_locality": true},
+		},
+		{
+			name: "no localities",
+			series: []promSeries{
+				{query: query, labels: map[string]string{"source_workload": "productpage-v1", "destination_workload": "reviews-v1", "destination_locality": "unknown"}},
+			},
+			want: map[string]bool{"prometheus": true, "destination_locality": false},
+		},
+		{
+			name: "no traffic",
+			want: map[string]bool{"prometheus": true, "istio_request_bytes_sum": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := fakeProm(t, time.Unix(0, 0), tt.series)
+			defer srv.Close()
+			prom, err := NewAnalyzerProm(srv.URL, "gcp")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := checkResults(prom.CheckMetrics()); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("CheckMetrics() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrintChecks(t *testing.T) {
+	out := &bytes.Buffer{}
+	failed := PrintChecks(out, []Check{
+		{Name: "webhook deployment", Passed: true, Detail: "ready", Hint: "not shown"},
+		{Name: "pod labels", Detail: "1 of 2 pods unlabelled", Hint: "restart them"},
+	})
+	if failed != 1 {
+		t.Errorf("PrintChecks() = %v, want 1", failed)
+	}
+	if strings.Contains(out.String(), "not shown") || !strings.Contains(out.String(), "hint: restart them") {
+		t.Errorf("unexpected output:\n%v", out)
+	}
+}
@@ -0,0 +1,256 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// inferQuery matches all traffic as reported by the source, for when pods aren't labelled
+// with their locality and localities have to be inferred.
+const inferQuery = "istio_request_bytes_sum{reporter=\"source\"}"
+
+// LocalityCache maps pods and workloads to the localities of the nodes they ran on, so
+// localities can be inferred without the webhook labelling pods. It's kept on disk, so
+// traffic from pods that have since been deleted can still be placed.
+type LocalityCache struct {
+	// Pods maps namespace/pod to the pod's locality.
+	Pods map[string]string `json:"pods"`
+	// IPs maps pod IPs to the locality of the pod that last had the IP.
+	IPs map[string]string `json:"ips"`
+	// Workloads maps namespace/workload to the number of replicas by locality, when
+	// the workload was last seen running.
+	Workloads map[string]map[string]int `json:"workloads"`
+	// SeenAt is when each pod, IP and workload was last seen running, by its key in
+	// Pods, IPs or Workloads, prefixed with "pod:", "ip:" or "workload:".
+	SeenAt    map[string]time.Time `json:"seenAt,omitempty"`
+	UpdatedAt time.Time            `json:"updatedAt"`
+	path      string
+}
+
+// LoadLocalityCache reads the locality cache at path, or returns an empty cache if there
+// is none yet. If path is empty, the cache is only kept in memory.
+func LoadLocalityCache(path string) (*LocalityCache, error) {
+	cache := &LocalityCache{
+		Pods:      make(map[string]string),
+		IPs:       make(map[string]string),
+		Workloads: make(map[string]map[string]int),
+		SeenAt:    make(map[string]time.Time),
+		path:      path,
+	}
+	if path == "" {
+		return cache, nil
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return cache, nil
+	}
+	if err != nil {
+		fmt.Printf("unable to read file %v: %v", path, err)
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cache); err != nil {
+		fmt.Printf("unable to unmarshal json into object: %v", err)
+		return nil, err
+	}
+	if cache.SeenAt == nil {
+		cache.SeenAt = make(map[string]time.Time)
+	}
+	cache.path = path
+	return cache, nil
+}
+
+// Prune drops the pods, IPs and workloads that haven't been seen running for longer than
+// maxAge, so the cache doesn't grow with every pod ever scheduled, and reused pod IPs
+// don't keep stale localities. Entries from caches written before SeenAt was kept count
+// as seen at UpdatedAt. A maxAge of zero keeps everything.
+func (c *LocalityCache) Prune(maxAge time.Duration, now time.Time) {
+	if maxAge <= 0 {
+		return
+	}
+	stale := func(key string) bool {
+		seen, ok := c.SeenAt[key]
+		if !ok {
+			seen = c.UpdatedAt
+		}
+		if now.Sub(seen) <= maxAge {
+			return false
+		}
+		delete(c.SeenAt, key)
+		return true
+	}
+	for pod := range c.Pods {
+		if stale("pod:" + pod) {
+			delete(c.Pods, pod)
+		}
+	}
+	for ip := range c.IPs {
+		if stale("ip:" + ip) {
+			delete(c.IPs, ip)
+		}
+	}
+	for workload := range c.Workloads {
+		if stale("workload:" + workload) {
+			delete(c.Workloads, workload)
+		}
+	}
+}
+
+// Save writes the cache back to where it was loaded from.
+func (c *LocalityCache) Save() error {
+	if c.path == "" {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(c.path), 0o755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, data, 0o644)
+}
+
+// UpdateLocalityCache adds the localities of the pods running now to cache, replacing
+// what it knew about their workloads.
+func (k *KubeClient) UpdateLocalityCache(cache *LocalityCache, cloud string) error {
+	nodes, err := k.clientSet.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		fmt.Printf("unable to list nodes: %v\n", err)
+		return err
+	}
+	label := zoneLabel
+	if strings.EqualFold(cloud, "aws") {
+		label = regionLabel
+	}
+	nodeLocalities := make(map[string]string, len(nodes.Items))
+	for _, n := range nodes.Items {
+		nodeLocalities[n.Name] = n.Labels[label]
+	}
+	pods, err := k.clientSet.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		fmt.Printf("unable to list pods: %v\n", err)
+		return err
+	}
+	now := time.Now()
+	workloads := make(map[string]map[string]int)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		locality := nodeLocalities[pod.Spec.NodeName]
+		if pod.Status.Phase != v1.PodRunning || locality == "" {
+			continue
+		}
+		cache.Pods[pod.Namespace+"/"+pod.Name] = locality
+		cache.SeenAt["pod:"+pod.Namespace+"/"+pod.Name] = now
+		if pod.Status.PodIP != "" && !pod.Spec.HostNetwork {
+			cache.IPs[pod.Status.PodIP] = locality
+			cache.SeenAt["ip:"+pod.Status.PodIP] = now
+		}
+		workload := pod.Namespace + "/" + PodWorkloadName(pod)
+		if workloads[workload] == nil {
+			workloads[workload] = make(map[string]int)
+		}
+		workloads[workload][locality]++
+	}
+	for workload, localities := range workloads {
+		cache.Workloads[workload] = localities
+		cache.SeenAt["workload:"+workload] = now
+	}
+	cache.UpdatedAt = now
+	return nil
+}
+
+// sourceLocality returns the locality of the pod a series was scraped from, by its pod
+// label, or else the IP of its instance.
+func (c *LocalityCache) sourceLocality(m model.Metric) (string, bool) {
+	namespace := string(m["namespace"])
+	for _, label := range []model.LabelName{"pod", "pod_name", "kubernetes_pod_name"} {
+		if pod := string(m[label]); pod != "" && namespace != "" {
+			if locality, ok := c.Pods[namespace+"/"+pod]; ok {
+				return locality, true
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(string(m["instance"]))
+	if err != nil {
+		host = string(m["instance"])
+	}
+	locality, ok := c.IPs[host]
+	return locality, ok
+}
+
+// getInferredCalls is GetCalls for when pods aren't labelled with their locality. The
+// source's locality is looked up from the pod the series was scraped from. The destination
+// pod isn't known, so traffic is split across the localities of the destination workload's
+// replicas, in proportion to their number, assuming requests are spread evenly.
+func (d *CostAnalyzerProm) getInferredCalls(start, end *time.Time) ([]*Call, error) {
+	series, err := d.queryIncrease(inferQuery, start, end)
+	if err != nil {
+		return nil, err
+	}
+	calls := make([]*Call, 0)
+	for _, s := range series {
+		source, destination := string(s.Metric["source_workload"]), string(s.Metric["destination_workload"])
+		locality, ok := d.localities.sourceLocality(s.Metric)
+		if !ok {
+			fmt.Printf("skipping traffic from %v, unable to infer its locality\n", source)
+			continue
+		}
+		call := &Call{
+			From:          locality,
+			FromWorkload:  source,
+			ToWorkload:    destination,
+			CallSize:      uint64(s.Value),
+			FromNamespace: string(s.Metric["source_workload_namespace"]),
+			ToNamespace:   string(s.Metric["destination_workload_namespace"]),
+			FromCluster:   string(s.Metric["source_cluster"]),
+			ToCluster:     string(s.Metric["destination_cluster"]),
+		}
+		replicas, known := d.localities.Workloads[call.ToNamespace+"/"+destination]
+		switch {
+		case d.ingressGateways[source]:
+			call.Kind = IngressGatewayCall
+			call.Host = string(s.Metric["request_host"])
+			if call.Host == "" || call.Host == "unknown" {
+				call.Host = string(s.Metric["destination_service"])
+			}
+		case d.egressGateways[destination]:
+			call.Kind = EgressGatewayCall
+		case !known && isInternetDestination(s.Metric):
+			call.To, call.ToWorkload, call.Kind = InternetDestination, destinationHost(s.Metric), InternetCall
+			call.ToNamespace, call.ToCluster = "", ""
+			calls = append(calls, call)
+			continue
+		}
+		if !known {
+			fmt.Printf("skipping traffic to %v, unable to infer its locality\n", destination)
+			continue
+		}
+		call.Estimated = true
+		calls = append(calls, splitByLocality(call, replicas, true)...)
+	}
+	return calls, nil
+}
@@ -0,0 +1,212 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestLocalityCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "localities", "default.json")
+	cache, err := LoadLocalityCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a pod that has since been deleted
+	cache.Pods["default/reviews-v1-5d8c7-old"] = "us-west1-c"
+	productpage := testPod("productpage-v1-6b7f-1", "node-b", "ReplicaSet", "productpage-v1-6b7f", map[string]string{"pod-template-hash": "6b7f"})
+	productpage.Status.PodIP = "10.0.0.1"
+	k := &KubeClient{clientSet: fake.NewSimpleClientset(
+		testNode("node-a", "us-west1-a"),
+		testNode("node-b", "us-west1-b"),
+		productpage,
+		testPod("reviews-v1-5d8c7-1", "node-a", "ReplicaSet", "reviews-v1-5d8c7", map[string]string{"pod-template-hash": "5d8c7"}),
+		testPod("reviews-v1-5d8c7-2", "node-b", "ReplicaSet", "reviews-v1-5d8c7", map[string]string{"pod-template-hash": "5d8c7"}),
+	)}
+	if err := k.UpdateLocalityCache(cache, "gcp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadLocalityCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPods := map[string]string{
+		"default/reviews-v1-5d8c7-old":  "us-west1-c",
+		"default/productpage-v1-6b7f-1": "us-west1-b",
+		"default/reviews-v1-5d8c7-1":    "us-west1-a",
+		"default/reviews-v1-5d8c7-2":    "us-west1-b",
+	}
+	if !reflect.DeepEqual(loaded.Pods, expectedPods) {
+		t.Errorf("Pods = %v, want %v", loaded.Pods, expectedPods)
+	}
+	if !reflect.DeepEqual(loaded.IPs, map[string]string{"10.0.0.1": "us-west1-b"}) {
+		t.Errorf("IPs = %v", loaded.IPs)
+	}
+	expectedWorkloads := map[string]map[string]int{
+		"default/productpage-v1": {"us-west1-b": 1},
+		"default/reviews-v1":     {"us-west1-a": 1, "us-west1-b": 1},
+	}
+	if !reflect.DeepEqual(loaded.Workloads, expectedWorkloads) {
+		t.Errorf("Workloads = %v, want %v", loaded.Workloads, expectedWorkloads)
+	}
+	if _, ok := loaded.SeenAt["pod:default/reviews-v1-5d8c7-1"]; !ok {
+		t.Errorf("SeenAt = %v, want running pods", loaded.SeenAt)
+	}
+}
+
+func TestLocalityCache_Prune(t *testing.T) {
+	now := time.Unix(100*24*3600, 0)
+	cache := &LocalityCache{
+		Pods: map[string]string{
+			"default/reviews-v1-1": "us-west1-a",
+			"default/reviews-v1-2": "us-west1-b",
+			"default/legacy-1":     "us-west1-c",
+		},
+		IPs:       map[string]string{"10.0.0.1": "us-west1-a", "10.0.0.2": "us-west1-b"},
+		Workloads: map[string]map[string]int{"default/reviews-v1": {"us-west1-a": 1}, "default/gone": {"us-west1-b": 1}},
+		SeenAt: map[string]time.Time{
+			"pod:default/reviews-v1-1":    now.Add(-time.Hour),
+			"pod:default/reviews-v1-2":    now.Add(-20 * 24 * time.Hour),
+			"ip:10.0.0.1":                 now.Add(-time.Hour),
+			"ip:10.0.0.2":                 now.Add(-20 * 24 * time.Hour),
+			"workload:default/reviews-v1": now.Add(-time.Hour),
+			"workload:default/gone":       now.Add(-20 * 24 * time.Hour),
+		},
+		// entries without SeenAt count as seen when the cache was last updated
+		UpdatedAt: now.Add(-2 * 24 * time.Hour),
+	}
+	cache.Prune(15*24*time.Hour, now)
+	expectedPods := map[string]string{"default/reviews-v1-1": "us-west1-a", "default/legacy-1": "us-west1-c"}
+	if !reflect.DeepEqual(cache.Pods, expectedPods) {
+		t.Errorf("Pods = %v, want %v", cache.Pods, expectedPods)
+	}
+	if !reflect.DeepEqual(cache.IPs, map[string]string{"10.0.0.1": "us-west1-a"}) {
+		t.Errorf("IPs = %v", cache.IPs)
+	}
+	if !reflect.DeepEqual(cache.Workloads, map[string]map[string]int{"default/reviews-v1": {"us-west1-a": 1}}) {
+		t.Errorf("Workloads = %v", cache.Workloads)
+	}
+	if len(cache.SeenAt) != 3 {
+		t.Errorf("SeenAt = %v, want pruned entries dropped", cache.SeenAt)
+	}
+	cache.Prune(time.Hour, now.Add(30*24*time.Hour))
+	if len(cache.Pods) != 0 || len(cache.IPs) != 0 || len(cache.Workloads) != 0 {
+		t.Errorf("Prune() left %v, %v, %v", cache.Pods, cache.IPs, cache.Workloads)
+	}
+}
+
+func TestCostAnalyzerProm_GetInferredCalls(t *testing.T) {
+	start := time.Unix(1000, 0)
+	end := time.Unix(2000, 0)
+	srv := fakeProm(t, start, []promSeries{
+		{
+			query: inferQuery,
+			labels: map[string]string{
+				"namespace": "default", "pod": "productpage-v1-6b7f-1",
+				"source_workload": "productpage-v1", "source_workload_namespace": "default",
+				"destination_workload": "reviews-v1", "destination_workload_namespace": "default",
+				"destination_service": "reviews.default.svc.cluster.local",
+			},
+			start: 0,
+			end:   100,
+		},
+		{
+			// no pod label, so placed by instance ip
+			query: inferQuery,
+			labels: map[string]string{
+				"instance":        "10.0.0.1:15020",
+				"source_workload": "productpage-v1", "source_workload_namespace": "default",
+				"destination_service": "api.stripe.com", "destination_service_name": "api.stripe.com",
+			},
+			start: 0,
+			end:   50,
+		},
+		{
+			query: inferQuery,
+			labels: map[string]string{
+				"namespace": "default", "pod": "unknown-pod",
+				"source_workload": "ratings-v1", "source_workload_namespace": "default",
+				"destination_workload": "reviews-v1", "destination_workload_namespace": "default",
+			},
+			start: 0,
+			end:   100,
+		},
+	})
+	defer srv.Close()
+	prom, err := NewAnalyzerProm(srv.URL, "gcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prom.SetInferredLocalities(&LocalityCache{
+		Pods:      map[string]string{"default/productpage-v1-6b7f-1": "us-west1-b"},
+		IPs:       map[string]string{"10.0.0.1": "us-west1-b"},
+		Workloads: map[string]map[string]int{"default/reviews-v1": {"us-west1-a": 1, "us-west1-b": 1}},
+	})
+	calls, err := prom.GetCalls(&start, &end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Call{
+		{From: "us-west1-b", FromWorkload: "productpage-v1", To: "us-west1-a", ToWorkload: "reviews-v1", CallSize: 50, FromNamespace: "default", ToNamespace: "default", Estimated: true},
+		{From: "us-west1-b", FromWorkload: "productpage-v1", To: "us-west1-b", ToWorkload: "reviews-v1", CallSize: 50, FromNamespace: "default", ToNamespace: "default", Estimated: true},
+		{From: "us-west1-b", FromWorkload: "productpage-v1", To: InternetDestination, ToWorkload: "api.stripe.com", CallSize: 50, FromNamespace: "default", Kind: InternetCall},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("GetCalls() = %v, want %v", calls, expected)
+	}
+}
+
+func TestPrintCostTable_Estimated(t *testing.T) {
+	calls, err := (&KubeClient{}).CollapseLocalityCalls([]*Call{
+		{From: "us-west1-b", FromWorkload: "productpage-v1", To: "us-west1-a", ToWorkload: "reviews-v1", CallSize: 50, Estimated: true},
+		{From: "us-west1-b", FromWorkload: "productpage-v1", To: "us-west1-a", ToWorkload: "reviews-v1", CallSize: 50, Estimated: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(calls) != 1 || !calls[0].Estimated {
+		t.Fatalf("CollapseLocalityCalls() = %v, want one estimated call", calls)
+	}
+	// PrintCostTable writes to stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	PrintCostTable(calls, 0, USD, true)
+	os.Stdout = stdout
+	w.Close()
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"us-west1-a (estimated)", "Destination localities marked (estimated)"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("PrintCostTable() printed %q, want %q in it", out, want)
+		}
+	}
+}
@@ -18,17 +18,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	networkingv1beta1 "istio.io/client-go/pkg/apis/networking/v1beta1"
 	"istio.io/client-go/pkg/clientset/versioned"
-	v12 "k8s.io/api/apps/v1"
 	v1 "k8s.io/api/core/v1"
-	v13 "k8s.io/api/rbac/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"sort"
 	"strings"
 )
 
@@ -41,9 +42,11 @@ var iopResource = schema.GroupVersionResource{Group: "install.istio.io", Version
 //  ```
 // if we get no value from just wrapping?
 type KubeClient struct {
-	clientSet  *kubernetes.Clientset
+	clientSet  kubernetes.Interface
 	dynamic    dynamic.Interface
 	kubeconfig string
+	// context is the kubeconfig context in use. Empty is the current context.
+	context string
 }
 
 type Cloud string
@@ -66,7 +69,13 @@ func (c Cloud) IsGCP() bool {
 // todo make kubeconfig a settable parameter in analyzer.go
 func NewAnalyzerKube(kubeconfig string) *KubeClient {
 	// use the current context in kubeconfig
-	config, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	return NewAnalyzerKubeForContext(kubeconfig, "")
+}
+
+// NewAnalyzerKubeForContext creates a clientset for the given context in kubeconfig,
+// or the current context if it's empty.
+func NewAnalyzerKubeForContext(kubeconfig, context string) *KubeClient {
+	config, err := restConfig(kubeconfig, context)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -80,10 +89,23 @@ func NewAnalyzerKube(kubeconfig string) *KubeClient {
 	return &KubeClient{
 		clientSet:  clientset,
 		kubeconfig: kubeconfig,
+		context:    context,
 		dynamic:    dynamicClient,
 	}
 }
 
+// restConfig loads the client config for context in kubeconfig.
+func restConfig(kubeconfig, context string) (*rest.Config, error) {
+	if context == "" {
+		// falls back to the in-cluster config without a kubeconfig
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		&clientcmd.ClientConfigLoadingRules{ExplicitPath: kubeconfig},
+		&clientcmd.ConfigOverrides{CurrentContext: context},
+	).ClientConfig()
+}
+
 // CollapseLocalityCalls takes a raw list of type Call and collapses the data
 // into a per-link basis (there might be multiple metrics for locality a->b)
 // todo maybe do this directly in prom.go and make it O(n) instead of O(2n)
@@ -96,15 +118,25 @@ func (k *KubeClient) CollapseLocalityCalls(rawCalls []*Call) ([]*Call, error) {
 	serviceCallMap := make(map[Call]*Call)
 	for i := 0; i < len(rawCalls); i++ {
 		serviceLocalityKey := Call{
-			FromWorkload: rawCalls[i].FromWorkload,
-			From:         rawCalls[i].From,
-			ToWorkload:   rawCalls[i].ToWorkload,
-			To:           rawCalls[i].To,
+			FromWorkload:  rawCalls[i].FromWorkload,
+			From:          rawCalls[i].From,
+			ToWorkload:    rawCalls[i].ToWorkload,
+			To:            rawCalls[i].To,
+			Day:           rawCalls[i].Day,
+			Kind:          rawCalls[i].Kind,
+			Host:          rawCalls[i].Host,
+			FromCluster:   rawCalls[i].FromCluster,
+			ToCluster:     rawCalls[i].ToCluster,
+			FromNamespace: rawCalls[i].FromNamespace,
+			ToNamespace:   rawCalls[i].ToNamespace,
+			Estimated:     rawCalls[i].Estimated,
 		}
 		// either create a new entry, or add to an existing one.
 		if _, ok := serviceCallMap[serviceLocalityKey]; !ok {
 			serviceCallMap[serviceLocalityKey] = &serviceLocalityKey
 			serviceLocalityKey.CallSize = rawCalls[i].CallSize
+			// keep links in the order they were first seen, so output is stable
+			calls = append(calls, &serviceLocalityKey)
 		} else {
 			serviceCallMap[serviceLocalityKey].CallSize += rawCalls[i].CallSize
 		}
@@ -114,9 +146,6 @@ func (k *KubeClient) CollapseLocalityCalls(rawCalls []*Call) ([]*Call, error) {
 			}
 		}
 	}
-	for _, v := range serviceCallMap {
-		calls = append(calls, v)
-	}
 	return calls, nil
 }
 
@@ -136,10 +165,10 @@ func (k *KubeClient) getPodNode(name, namespace string) (string, error) {
 func (k *KubeClient) getNodeLocality(name, cloud string) (string, error) {
 	// if we are on AWS, we want to just get region, because availability zones
 	// are not supported yet.
-	if cloud == "aws" {
-		return k.getNodeLabel(name, "topology.kubernetes.io/region")
+	if strings.EqualFold(cloud, "aws") {
+		return k.getNodeLabel(name, regionLabel)
 	}
-	return k.getNodeLabel(name, "topology.kubernetes.io/zone")
+	return k.getNodeLabel(name, zoneLabel)
 }
 
 // nolint
@@ -152,6 +181,215 @@ func (k *KubeClient) getNodeLabel(name, label string) (string, error) {
 	return node.Labels[label], nil
 }
 
+// WorkloadLocalities returns the localities the running pods of a workload are in, with
+// the number of pods in each. Pods are matched on the service.istio.io/canonical-name
+// label Istio sets, falling back to the app label.
+func (k *KubeClient) WorkloadLocalities(workload, cloud string) (map[string]int, error) {
+	var pods *v1.PodList
+	var err error
+	for _, label := range []string{"service.istio.io/canonical-name", "app"} {
+		pods, err = k.clientSet.CoreV1().Pods("").List(context.TODO(), metav1.ListOptions{
+			LabelSelector: fmt.Sprintf("%v=%v", label, workload),
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(pods.Items) > 0 {
+			break
+		}
+	}
+	localities := make(map[string]int)
+	nodeLocalities := make(map[string]string)
+	for _, pod := range pods.Items {
+		if pod.Status.Phase != v1.PodRunning || pod.Spec.NodeName == "" {
+			continue
+		}
+		locality, ok := nodeLocalities[pod.Spec.NodeName]
+		if !ok {
+			if locality, err = k.getNodeLocality(pod.Spec.NodeName, cloud); err != nil {
+				return nil, err
+			}
+			nodeLocalities[pod.Spec.NodeName] = locality
+		}
+		if locality != "" {
+			localities[locality]++
+		}
+	}
+	return localities, nil
+}
+
+// ResolveGatewayLocalities fills in the gateway side of calls through an egress or ingress gateway
+// whose pods aren't labelled with their locality, by looking up where the gateway's pods
+// run. If a gateway has pods in several localities, traffic is split between them in
+// proportion to the number of pods in each.
+func (k *KubeClient) ResolveGatewayLocalities(calls []*Call, cloud string) ([]*Call, error) {
+	resolved := make([]*Call, 0, len(calls))
+	gatewayLocalities := make(map[string]map[string]int)
+	for _, c := range calls {
+		var gateway string
+		switch {
+		case c.Kind == EgressGatewayCall && c.To == "":
+			gateway = c.ToWorkload
+		case (c.Kind == InternetCall || c.Kind == IngressGatewayCall) && c.From == "":
+			gateway = c.FromWorkload
+		default:
+			resolved = append(resolved, c)
+			continue
+		}
+		localities, ok := gatewayLocalities[gateway]
+		if !ok {
+			var err error
+			if localities, err = k.WorkloadLocalities(gateway, cloud); err != nil {
+				return nil, err
+			}
+			gatewayLocalities[gateway] = localities
+		}
+		if len(localities) == 0 {
+			fmt.Printf("unable to find running pods of gateway %v, skipping...\n", gateway)
+			continue
+		}
+		resolved = append(resolved, splitByLocality(c, localities, c.Kind == EgressGatewayCall)...)
+	}
+	return resolved, nil
+}
+
+// splitByLocality splits a call between localities, in proportion to their pod counts.
+// It sets To if to is true, and From otherwise.
+func splitByLocality(c *Call, localities map[string]int, to bool) []*Call {
+	names := make([]string, 0, len(localities))
+	pods := 0
+	for l, n := range localities {
+		names = append(names, l)
+		pods += n
+	}
+	sort.Strings(names)
+	split := make([]*Call, 0, len(names))
+	remaining := c.CallSize
+	for i, l := range names {
+		part := *c
+		part.CallSize = c.CallSize * uint64(localities[l]) / uint64(pods)
+		if i == len(names)-1 {
+			part.CallSize = remaining
+		}
+		remaining -= part.CallSize
+		if to {
+			part.To = l
+		} else {
+			part.From = l
+		}
+		split = append(split, &part)
+	}
+	return split
+}
+
+// ResolveIngressHosts attributes ingress gateway calls to the public hosts of the
+// VirtualServices bound to a gateway that route to their destination service. Calls
+// whose Host is already a request host, or a service no such VirtualService routes to,
+// are left alone.
+func (k *KubeClient) ResolveIngressHosts(calls []*Call) error {
+	virtualServices, err := k.IstioClient().NetworkingV1beta1().VirtualServices("").List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		fmt.Printf("unable to list virtual services: %v\n", err)
+		return err
+	}
+	hosts := ingressHostsByService(virtualServices.Items)
+	for _, c := range calls {
+		if c.Kind != IngressGatewayCall {
+			continue
+		}
+		if h, ok := hosts[c.Host]; ok {
+			c.Host = strings.Join(h, ",")
+		}
+	}
+	return nil
+}
+
+// ingressHostsByService maps the fully qualified name of every service routed to by a
+// VirtualService bound to a gateway, to the sorted hosts of those VirtualServices.
+func ingressHostsByService(virtualServices []*networkingv1beta1.VirtualService) map[string][]string {
+	hostSets := make(map[string]map[string]bool)
+	for _, vs := range virtualServices {
+		bound := false
+		for _, g := range vs.Spec.Gateways {
+			bound = bound || g != "mesh"
+		}
+		if !bound {
+			continue
+		}
+		destinations := make([]string, 0)
+		for _, r := range vs.Spec.Http {
+			for _, d := range r.Route {
+				destinations = append(destinations, d.GetDestination().GetHost())
+			}
+		}
+		for _, r := range vs.Spec.Tls {
+			for _, d := range r.Route {
+				destinations = append(destinations, d.GetDestination().GetHost())
+			}
+		}
+		for _, r := range vs.Spec.Tcp {
+			for _, d := range r.Route {
+				destinations = append(destinations, d.GetDestination().GetHost())
+			}
+		}
+		for _, d := range destinations {
+			if d == "" {
+				continue
+			}
+			service := serviceFQDN(d, vs.Namespace)
+			if hostSets[service] == nil {
+				hostSets[service] = make(map[string]bool)
+			}
+			for _, h := range vs.Spec.Hosts {
+				hostSets[service][h] = true
+			}
+		}
+	}
+	hosts := make(map[string][]string, len(hostSets))
+	for service, set := range hostSets {
+		for h := range set {
+			hosts[service] = append(hosts[service], h)
+		}
+		sort.Strings(hosts[service])
+	}
+	return hosts
+}
+
+// serviceFQDN qualifies a short service host, like reviews or reviews.default, the way
+// Istio does for hosts in a VirtualService in namespace.
+func serviceFQDN(host, namespace string) string {
+	switch {
+	case !strings.Contains(host, "."):
+		return fmt.Sprintf("%v.%v.svc.cluster.local", host, namespace)
+	case strings.Count(host, ".") == 1:
+		return host + ".svc.cluster.local"
+	case strings.HasSuffix(host, ".svc"):
+		return host + ".cluster.local"
+	}
+	return host
+}
+
+// MeshClusterID returns the name istiod in namespace gives the cluster in the mesh, which
+// Istio reports as source_cluster and destination_cluster. It defaults to Kubernetes.
+func (k *KubeClient) MeshClusterID(namespace string) (string, error) {
+	istiods, err := k.clientSet.AppsV1().Deployments(namespace).List(context.TODO(), metav1.ListOptions{
+		LabelSelector: "app=istiod",
+	})
+	if err != nil {
+		return "", err
+	}
+	for _, d := range istiods.Items {
+		for _, c := range d.Spec.Template.Spec.Containers {
+			for _, e := range c.Env {
+				if e.Name == "CLUSTER_ID" && e.Value != "" {
+					return e.Value, nil
+				}
+			}
+		}
+	}
+	return "Kubernetes", nil
+}
+
 func (k *KubeClient) InferCloud() Cloud {
 	nodes, err := k.clientSet.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
@@ -171,50 +409,22 @@ func (k *KubeClient) InferCloud() Cloud {
 	return Unknown
 }
 
-// CreateService creates a service in the given namespace. Returns the service, the error, and
-// a boolean representing whether or not the service already exists.
-func (k *KubeClient) CreateService(service *v1.Service, ns string) (*v1.Service, error, bool) {
-	svc, err := k.clientSet.CoreV1().Services(ns).Create(context.TODO(), service, metav1.CreateOptions{})
-	if err != nil && strings.Contains(err.Error(), "already exists") {
-		return service, nil, true
-	}
-	return svc, err, false
-}
-
-func (k *KubeClient) CreateDeployment(deployment *v12.Deployment, ns string) (*v12.Deployment, error, bool) {
-	dep, err := k.clientSet.AppsV1().Deployments(ns).Create(context.TODO(), deployment, metav1.CreateOptions{})
-	if err != nil && strings.Contains(err.Error(), "already exists") {
-		return deployment, nil, true
-	}
-	return dep, err, false
-}
-
-func (k *KubeClient) CreateServiceAccount(serviceAccount *v1.ServiceAccount, ns string) (*v1.ServiceAccount, error, bool) {
-	sa, err := k.clientSet.CoreV1().ServiceAccounts(ns).Create(context.TODO(), serviceAccount, metav1.CreateOptions{})
-	if err != nil && strings.Contains(err.Error(), "already exists") {
-		return serviceAccount, nil, true
+// LabelNamespace sets a label on a namespace. It returns false if the label was already set.
+func (k *KubeClient) LabelNamespace(ns, key, value string) (bool, error) {
+	namespace, err := k.clientSet.CoreV1().Namespaces().Get(context.TODO(), ns, metav1.GetOptions{})
+	if err != nil {
+		return false, err
 	}
-	return sa, err, false
-}
-
-func (k *KubeClient) CreateClusterRoleBinding(clusterRoleBinding *v13.ClusterRoleBinding) (*v13.ClusterRoleBinding, error, bool) {
-	crb, err := k.clientSet.RbacV1().ClusterRoleBindings().Create(context.TODO(), clusterRoleBinding, metav1.CreateOptions{})
-	if err != nil && strings.Contains(err.Error(), "already exists") {
-		return clusterRoleBinding, nil, true
+	if v, ok := namespace.Labels[key]; ok && v == value {
+		return false, nil
 	}
-	return crb, err, false
+	_, err = k.clientSet.CoreV1().Namespaces().Patch(context.TODO(), ns, types.MergePatchType, []byte(fmt.Sprintf(`{"metadata":{"labels":{"%v":"%v"}}}`, key, value)), metav1.PatchOptions{})
+	return err == nil, err
 }
 
-func (k *KubeClient) CreateClusterRole(clusterRole *v13.ClusterRole) (*v13.ClusterRole, error, bool) {
-	cr, err := k.clientSet.RbacV1().ClusterRoles().Create(context.TODO(), clusterRole, metav1.CreateOptions{})
-	if err != nil && strings.Contains(err.Error(), "already exists") {
-		return clusterRole, nil, true
-	}
-	return cr, err, false
-}
-
-func (k *KubeClient) LabelNamespace(ns, key, value string) error {
-	_, err := k.clientSet.CoreV1().Namespaces().Patch(context.TODO(), ns, types.MergePatchType, []byte(fmt.Sprintf(`{"metadata":{"labels":{"%v":"%v"}}}`, key, value)), metav1.PatchOptions{})
+// UnlabelNamespace removes a label from a namespace.
+func (k *KubeClient) UnlabelNamespace(ns, key string) error {
+	_, err := k.clientSet.CoreV1().Namespaces().Patch(context.TODO(), ns, types.MergePatchType, []byte(fmt.Sprintf(`{"metadata":{"labels":{%q:null}}}`, key)), metav1.PatchOptions{})
 	return err
 }
 
@@ -223,7 +433,7 @@ func (k *KubeClient) Client() kubernetes.Interface {
 }
 
 func (k *KubeClient) IstioClient() *versioned.Clientset {
-	config, err := clientcmd.BuildConfigFromFlags("", k.kubeconfig)
+	config, err := restConfig(k.kubeconfig, k.context)
 	if err != nil {
 		panic(err.Error())
 	}
@@ -236,109 +446,39 @@ func (k *KubeClient) GetDefaultOperator(ns string) (string, error) {
 		return "", err
 	}
 	for _, r := range rl.Items {
-		if _, ok := r.Object["status"]; ok {
-			if status, ok := r.Object["status"].(map[string]interface{})["status"]; ok && status != nil && status.(string) == "HEALTHY" {
-				return r.GetName(), nil
-			}
+		if status, _, _ := unstructured.NestedString(r.Object, "status", "status"); status == "HEALTHY" {
+			return r.GetName(), nil
 		}
 	}
 	return "", errors.New("no default operator found, please specify a healthy istio operator")
 }
 
-func (k *KubeClient) EditIstioOperator(opName, opNamespace string) error {
+// EditIstioOperator adds the destination_locality dimension to the telemetry config of
+// an IstioOperator, for meshes without the Telemetry API. It returns false if it was
+// already there.
+func (k *KubeClient) EditIstioOperator(opName, opNamespace string) (bool, error) {
 	res, err := k.dynamic.Resource(iopResource).Namespace(opNamespace).Get(context.TODO(), opName, metav1.GetOptions{})
-	res, neededUpdate := normalizeOperator(res)
 	if err != nil {
-		return err
+		return false, err
 	}
-	if !neededUpdate {
-		return nil
+	neededUpdate, err := normalizeOperator(res)
+	if err != nil || !neededUpdate {
+		return false, err
 	}
 	_, err = k.dynamic.Resource(iopResource).Namespace(opNamespace).Update(context.TODO(), res, metav1.UpdateOptions{})
-	return err
+	return err == nil, err
 }
 
+// DeleteOperatorConfig removes what EditIstioOperator added to an IstioOperator.
 func (k *KubeClient) DeleteOperatorConfig(opName, opNs string) error {
 	res, err := k.dynamic.Resource(iopResource).Namespace(opNs).Get(context.TODO(), opName, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
-	res = denormalizeOperator(res)
+	neededUpdate, err := denormalizeOperator(res)
+	if err != nil || !neededUpdate {
+		return err
+	}
 	_, err = k.dynamic.Resource(iopResource).Namespace(opNs).Update(context.TODO(), res, metav1.UpdateOptions{})
 	return err
 }
-
-// literal trash but it works
-func normalizeOperator(res *unstructured.Unstructured) (*unstructured.Unstructured, bool) {
-	// lord forgive me for I have sinned
-	// theres probably a better way to figure this out with JSONPatch but i'm lazy
-	if v := res.Object["spec"].(map[string]interface{})["values"]; v == nil {
-		res.Object["spec"].(map[string]interface{})["values"] = make(map[string]interface{})
-	}
-	if v := res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"]; v == nil {
-		res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"] = make(map[string]interface{})
-	}
-	if v := res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"]; v == nil {
-		res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"] = make(map[string]interface{})
-	}
-	if v := res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"].(map[string]interface{})["prometheus"]; v == nil {
-		res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"].(map[string]interface{})["prometheus"] = make(map[string]interface{})
-	}
-	if v := res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"].(map[string]interface{})["prometheus"].(map[string]interface{})["configOverride"]; v == nil {
-		res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"].(map[string]interface{})["prometheus"].(map[string]interface{})["configOverride"] = make(map[string]interface{})
-	}
-	if v := res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"].(map[string]interface{})["prometheus"].(map[string]interface{})["configOverride"].(map[string]interface{})["outboundSidecar"]; v == nil {
-		res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"].(map[string]interface{})["prometheus"].(map[string]interface{})["configOverride"].(map[string]interface{})["outboundSidecar"] = make(map[string]interface{})
-	}
-	outbound := res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"].(map[string]interface{})["prometheus"].(map[string]interface{})["configOverride"].(map[string]interface{})["outboundSidecar"].(map[string]interface{})["metrics"]
-	if outbound == nil {
-		outbound = make([]interface{}, 0)
-	}
-
-	// check if we already wrote
-	for _, o := range outbound.([]interface{}) {
-		if o.(map[string]interface{})["dimensions"] != nil && o.(map[string]interface{})["dimensions"].(map[string]interface{})["destination_locality"] != nil {
-			return res, false
-		}
-	}
-
-	for i, out := range outbound.([]interface{}) {
-		if out.(map[string]interface{})["name"].(string) == "request_bytes" {
-			out.(map[string]interface{})["dimensions"].(map[string]interface{})["destination_locality"] = "upstream_peer.labels['locality'].value"
-		}
-		outbound.([]interface{})[i] = out
-	}
-
-	if len(outbound.([]interface{})) == 0 {
-		outbound = append(outbound.([]interface{}), map[string]interface{}{
-			"name": "request_bytes",
-			"dimensions": map[string]interface{}{
-				"destination_locality": "upstream_peer.labels['locality'].value",
-			},
-		})
-	}
-
-	res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"].(map[string]interface{})["prometheus"].(map[string]interface{})["configOverride"].(map[string]interface{})["outboundSidecar"].(map[string]interface{})["metrics"] = outbound
-	return res, true
-}
-
-// delete our config
-func denormalizeOperator(res *unstructured.Unstructured) *unstructured.Unstructured {
-	if v := res.Object["spec"].(map[string]interface{})["values"]; v == nil {
-		return res
-	}
-	if v := res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"]; v == nil {
-		return res
-	}
-	if v := res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"]; v == nil {
-		return res
-	}
-	if v := res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"].(map[string]interface{})["prometheus"]; v == nil {
-		return res
-	}
-	if v := res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"].(map[string]interface{})["prometheus"].(map[string]interface{})["configOverride"]; v == nil {
-		return res
-	}
-	res.Object["spec"].(map[string]interface{})["values"].(map[string]interface{})["telemetry"].(map[string]interface{})["v2"].(map[string]interface{})["prometheus"].(map[string]interface{})["configOverride"] = make(map[string]interface{})
-	return res
-}
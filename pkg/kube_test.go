@@ -18,6 +18,10 @@ import (
 	"math"
 	"reflect"
 	"testing"
+
+	networking "istio.io/api/networking/v1beta1"
+	networkingv1beta1 "istio.io/client-go/pkg/apis/networking/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 func TestKubeClient_CollapseLocalityCalls(t *testing.T) {
@@ -64,6 +68,18 @@ func TestKubeClient_CollapseLocalityCalls(t *testing.T) {
 				},
 			},
 		},
+		{
+			name: "estimated calls kept apart",
+			calls: []*Call{
+				{From: "us-west1-b", To: "us-west1-a", CallSize: 1, Estimated: true},
+				{From: "us-west1-b", To: "us-west1-a", CallSize: 2},
+				{From: "us-west1-b", To: "us-west1-a", CallSize: 3, Estimated: true},
+			},
+			expected: []*Call{
+				{From: "us-west1-b", To: "us-west1-a", CallSize: 4, Estimated: true},
+				{From: "us-west1-b", To: "us-west1-a", CallSize: 2},
+			},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -73,3 +89,64 @@ func TestKubeClient_CollapseLocalityCalls(t *testing.T) {
 		})
 	}
 }
+
+func TestSplitByLocality(t *testing.T) {
+	call := &Call{From: "us-west1-b", FromWorkload: "a", ToWorkload: "istio-egressgateway", CallSize: 100, Kind: EgressGatewayCall}
+	split := splitByLocality(call, map[string]int{"us-west1-c": 1, "us-west1-a": 2}, true)
+	expected := []*Call{
+		{From: "us-west1-b", FromWorkload: "a", To: "us-west1-a", ToWorkload: "istio-egressgateway", CallSize: 66, Kind: EgressGatewayCall},
+		{From: "us-west1-b", FromWorkload: "a", To: "us-west1-c", ToWorkload: "istio-egressgateway", CallSize: 34, Kind: EgressGatewayCall},
+	}
+	if !reflect.DeepEqual(split, expected) {
+		t.Errorf("splitByLocality() = %v, want %v", split, expected)
+	}
+}
+
+func TestIngressHostsByService(t *testing.T) {
+	virtualServices := []*networkingv1beta1.VirtualService{
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "bookinfo", Namespace: "default"},
+			Spec: networking.VirtualService{
+				Hosts:    []string{"bookinfo.example.com", "www.example.com"},
+				Gateways: []string{"istio-system/bookinfo-gateway"},
+				Http: []*networking.HTTPRoute{{
+					Route: []*networking.HTTPRouteDestination{
+						{Destination: &networking.Destination{Host: "productpage"}},
+						{Destination: &networking.Destination{Host: "reviews.other"}},
+					},
+				}},
+			},
+		},
+		{
+			ObjectMeta: metav1.ObjectMeta{Name: "api", Namespace: "api"},
+			Spec: networking.VirtualService{
+				Hosts:    []string{"api.example.com"},
+				Gateways: []string{"api-gateway", "mesh"},
+				Http: []*networking.HTTPRoute{{
+					Route: []*networking.HTTPRouteDestination{
+						{Destination: &networking.Destination{Host: "productpage.default.svc.cluster.local"}},
+					},
+				}},
+			},
+		},
+		{
+			// only routes mesh traffic
+			ObjectMeta: metav1.ObjectMeta{Name: "ratings", Namespace: "default"},
+			Spec: networking.VirtualService{
+				Hosts: []string{"ratings"},
+				Http: []*networking.HTTPRoute{{
+					Route: []*networking.HTTPRouteDestination{
+						{Destination: &networking.Destination{Host: "ratings"}},
+					},
+				}},
+			},
+		},
+	}
+	expected := map[string][]string{
+		"productpage.default.svc.cluster.local": {"api.example.com", "bookinfo.example.com", "www.example.com"},
+		"reviews.other.svc.cluster.local":       {"bookinfo.example.com", "www.example.com"},
+	}
+	if hosts := ingressHostsByService(virtualServices); !reflect.DeepEqual(hosts, expected) {
+		t.Errorf("ingressHostsByService() = %v, want %v", hosts, expected)
+	}
+}
@@ -0,0 +1,457 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	telemetryv1alpha1 "istio.io/client-go/pkg/apis/telemetry/v1alpha1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	v12 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	policyv1 "k8s.io/api/policy/v1"
+	v13 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/apimachinery/pkg/util/json"
+	k8Yaml "k8s.io/apimachinery/pkg/util/yaml"
+	"sigs.k8s.io/yaml"
+)
+
+// names of the objects setup creates.
+const (
+	WebhookName              = "cost-analyzer-mutating-webhook"
+	WebhookConfigurationName = "cost-analyzer-mutating-webhook-configuration"
+	ServiceAccountName       = "cost-analyzer-sa"
+	ClusterRoleName          = "cost-analyzer-service-role"
+	ClusterRoleBindingName   = "cost-analyzer-role-binding"
+	// AnalysisEnabledLabel is the label on namespaces the webhook handles.
+	AnalysisEnabledLabel = "cost-analyzer-analysis-enabled"
+	// ExcludeLabel on a Deployment or pod, set to true, has the webhook leave it alone. The
+	// default object selector of the webhook excludes it.
+	ExcludeLabel = "cost-analyzer.tetrate.io/exclude"
+	// ExemptAnnotation on a namespace, set to true, has the webhook leave its Deployments and
+	// pods alone even though it's labelled. The webhook checks the same key.
+	ExemptAnnotation = "cost-analyzer.tetrate.io/exempt"
+	// defaultTimeoutSeconds bounds how long creating a Deployment waits for the webhook.
+	defaultTimeoutSeconds = int32(5)
+)
+
+// systemNamespaces are never handled by the webhook, even if labelled, besides the analyzer
+// namespace the webhook runs in.
+var systemNamespaces = []string{"kube-system", "kube-public", "kube-node-lease"}
+
+// webhookDeployment is the webhook server, with an init container that generates its
+// certificate and fills in the caBundle of its MutatingWebhookConfiguration.
+const webhookDeployment = `
+kind: Deployment
+apiVersion: apps/v1
+metadata:
+  name: cost-analyzer-mutating-webhook
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app: cost-analyzer-mutating-webhook
+  template:
+    metadata:
+      labels:
+        app: cost-analyzer-mutating-webhook
+    spec:
+      initContainers:
+        - name: cost-analyzer-mutating-webhook-ca
+          image: adiprerepa/cost-analyzer-mutating-webhook-ca:latest
+          imagePullPolicy: Always
+          volumeMounts:
+            - mountPath: /etc/webhook/certs
+              name: certs
+          env:
+            - name: MUTATE_CONFIG
+              value: cost-analyzer-mutating-webhook-configuration
+            - name: WEBHOOK_SERVICE
+              value: cost-analyzer-mutating-webhook
+      containers:
+        - name: cost-analyzer-mutating-webhook
+          image: adiprerepa/cost-analyzer-mutating-webhook:latest
+          imagePullPolicy: Always
+          ports:
+            - containerPort: 443
+          volumeMounts:
+            - name: certs
+              mountPath: /etc/webhook/certs
+          resources:
+            requests:
+              memory: "64Mi"
+              cpu: "250m"
+            limits:
+              memory: "128Mi"
+              cpu: "500m"
+      volumes:
+        - name: certs
+          emptyDir: {}
+      serviceAccountName: cost-analyzer-sa
+`
+
+const webhookService = `
+kind: Service
+apiVersion: v1
+metadata:
+  name: cost-analyzer-mutating-webhook
+spec:
+  selector:
+    app: cost-analyzer-mutating-webhook
+  ports:
+    - port: 443
+      protocol: TCP
+      targetPort: 443
+`
+
+// SetupConfig is what setup installs.
+type SetupConfig struct {
+	// AnalyzerNamespace is the namespace the webhook runs in.
+	AnalyzerNamespace string
+	// TargetNamespaces are the namespaces whose deployments the webhook handles. Empty
+	// means all namespaces.
+	TargetNamespaces []string
+	// Cloud is the cloud the webhook looks up localities for. Empty is gcp.
+	Cloud string
+	// TelemetryNamespace is the mesh root namespace the locality Telemetry resource is
+	// created in. If empty, there is none, and the IstioOperator is edited instead.
+	TelemetryNamespace string
+	// Webhook customizes the webhook Deployment.
+	Webhook WebhookValues
+	// CertManager has cert-manager issue the webhook's certificate and inject its CA,
+	// instead of the webhook generating and rotating it.
+	CertManager bool
+	// CertManagerIssuer is the cert-manager issuer of the certificate. If empty, a
+	// self-signed Issuer is created.
+	CertManagerIssuer string
+	// CertManagerIssuerKind is Issuer, the default, or ClusterIssuer.
+	CertManagerIssuerKind string
+}
+
+// SetupObjects are the objects setup creates.
+type SetupObjects struct {
+	ServiceAccount      *v1.ServiceAccount
+	ClusterRoles        []*v13.ClusterRole
+	ClusterRoleBindings []*v13.ClusterRoleBinding
+	// Roles and RoleBindings are in each target namespace.
+	Roles        []*v13.Role
+	RoleBindings []*v13.RoleBinding
+	// Issuer and Certificate are only set with cert-manager, and Issuer only if no issuer
+	// is given.
+	Issuer      *unstructured.Unstructured
+	Certificate *unstructured.Unstructured
+	Service     *v1.Service
+	Deployment  *v12.Deployment
+	// WorkloadKinds are the kinds of workloads the webhook handles.
+	WorkloadKinds []WorkloadKind
+	// PodDisruptionBudget keeps one webhook pod running through voluntary disruptions, like
+	// node drains. It's nil with a single replica, which it would keep from being evicted.
+	PodDisruptionBudget *policyv1.PodDisruptionBudget
+	// WebhookConfiguration is applied without a caBundle, which the webhook fills in once
+	// its certificate is ready, or cert-manager's CA injector does.
+	WebhookConfiguration *admissionregistrationv1.MutatingWebhookConfiguration
+	// Namespaces only have the label setup adds to them.
+	Namespaces []*v1.Namespace
+	// Telemetry is nil if the IstioOperator is edited instead.
+	Telemetry *telemetryv1alpha1.Telemetry
+	// backfill is whether the webhook annotates existing workloads.
+	backfill bool
+}
+
+// Manifest is an object setup creates, as it would be applied.
+type Manifest struct {
+	Resource schema.GroupVersionResource
+	Object   *unstructured.Unstructured
+}
+
+// NewSetupObjects builds the objects setup creates for cfg.
+func NewSetupObjects(cfg SetupConfig) (*SetupObjects, error) {
+	ns := cfg.AnalyzerNamespace
+	s := &SetupObjects{
+		ServiceAccount: &v1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: metav1.ObjectMeta{Name: ServiceAccountName, Namespace: ns},
+		},
+		Service:       &v1.Service{},
+		Deployment:    &v12.Deployment{},
+		WorkloadKinds: WorkloadKinds(cfg.Webhook.WorkloadKinds),
+	}
+	if err := k8Yaml.NewYAMLOrJSONDecoder(strings.NewReader(webhookDeployment), 1000).Decode(s.Deployment); err != nil {
+		return nil, fmt.Errorf("unable to decode deployment: %w", err)
+	}
+	if err := k8Yaml.NewYAMLOrJSONDecoder(strings.NewReader(webhookService), 1000).Decode(s.Service); err != nil {
+		return nil, fmt.Errorf("unable to decode service: %w", err)
+	}
+	s.Deployment.Namespace, s.Service.Namespace = ns, ns
+	s.Deployment.Spec.Template.Spec.Containers[0].Env = []v1.EnvVar{{
+		Name:  "CLOUD",
+		Value: cfg.Cloud,
+	}, {
+		Name:  "NAMESPACE",
+		Value: strings.Join(cfg.TargetNamespaces, ","),
+	}, {
+		// to find its certificate, and the webhook configuration whose caBundle it rotates
+		Name:  "WEBHOOK_NAMESPACE",
+		Value: ns,
+	}, {
+		Name:  "WEBHOOK_SERVICE",
+		Value: WebhookName,
+	}, {
+		Name:  "MUTATE_CONFIG",
+		Value: WebhookConfigurationName,
+	}}
+	s.Deployment.Spec.Template.Spec.InitContainers[0].Env = append(s.Deployment.Spec.Template.Spec.InitContainers[0].Env, v1.EnvVar{
+		Name:  "WEBHOOK_NAMESPACE",
+		Value: ns,
+	})
+	if err := cfg.Webhook.apply(s.Deployment); err != nil {
+		return nil, err
+	}
+	kinds, err := json.Marshal(s.WorkloadKinds)
+	if err != nil {
+		return nil, err
+	}
+	s.Deployment.Spec.Template.Spec.Containers[0].Env = append(s.Deployment.Spec.Template.Spec.Containers[0].Env, v1.EnvVar{
+		Name:  "WORKLOAD_KINDS",
+		Value: string(kinds),
+	})
+	if s.Deployment.Spec.Replicas != nil && *s.Deployment.Spec.Replicas > 1 {
+		s.PodDisruptionBudget = webhookDisruptionBudget(ns)
+	}
+	s.WebhookConfiguration = webhookConfiguration(ns, s.WorkloadKinds)
+	cfg.Webhook.applyConfiguration(s.WebhookConfiguration)
+	if err := s.setCertificates(cfg); err != nil {
+		return nil, err
+	}
+	s.setBackfill(cfg.Webhook.Backfill)
+	for _, name := range cfg.TargetNamespaces {
+		if name == "" {
+			continue
+		}
+		s.Namespaces = append(s.Namespaces, &v1.Namespace{
+			TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "Namespace"},
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   name,
+				Labels: map[string]string{AnalysisEnabledLabel: "true"},
+			},
+		})
+	}
+	s.setRBAC(cfg)
+	if cfg.TelemetryNamespace != "" {
+		s.Telemetry = localityTelemetry(cfg.TelemetryNamespace)
+		s.Telemetry.TypeMeta = metav1.TypeMeta{APIVersion: telemetryGroupVersion, Kind: "Telemetry"}
+	}
+	return s, nil
+}
+
+// webhookDisruptionBudget keeps at least one pod of the webhook in namespace available.
+func webhookDisruptionBudget(namespace string) *policyv1.PodDisruptionBudget {
+	minAvailable := intstr.FromInt(1)
+	return &policyv1.PodDisruptionBudget{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "policy/v1", Kind: "PodDisruptionBudget"},
+		ObjectMeta: metav1.ObjectMeta{Name: WebhookName, Namespace: namespace},
+		Spec: policyv1.PodDisruptionBudgetSpec{
+			MinAvailable: &minAvailable,
+			Selector:     &metav1.LabelSelector{MatchLabels: map[string]string{"app": WebhookName}},
+		},
+	}
+}
+
+// webhookConfiguration is the MutatingWebhookConfiguration of the webhook in namespace for
+// kinds of workloads, without its caBundle. By default, the API server creates workloads
+// unchanged when it can't call the webhook, rather than blocking them. Workloads in the
+// webhook's own namespace and the system namespaces are never mutated, even if they're
+// targeted.
+func webhookConfiguration(namespace string, kinds []WorkloadKind) *admissionregistrationv1.MutatingWebhookConfiguration {
+	rules := make([]admissionregistrationv1.RuleWithOperations, 0, len(kinds))
+	for _, kind := range kinds {
+		rules = append(rules, admissionregistrationv1.RuleWithOperations{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Connect},
+			Rule: admissionregistrationv1.Rule{
+				APIGroups:   []string{kind.Group},
+				APIVersions: []string{kind.Version},
+				Resources:   []string{kind.Resource},
+			},
+		})
+	}
+	path := "/mutate"
+	ignore := admissionregistrationv1.Ignore
+	timeout := defaultTimeoutSeconds
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	return &admissionregistrationv1.MutatingWebhookConfiguration{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "admissionregistration.k8s.io/v1", Kind: "MutatingWebhookConfiguration"},
+		ObjectMeta: metav1.ObjectMeta{Name: WebhookConfigurationName},
+		Webhooks: []admissionregistrationv1.MutatingWebhook{{
+			Name: "mutating-webhook.istio-cost-analyzer.io",
+			ClientConfig: admissionregistrationv1.WebhookClientConfig{
+				Service: &admissionregistrationv1.ServiceReference{
+					Name:      WebhookName,
+					Namespace: namespace,
+					Path:      &path,
+				},
+			},
+			Rules:                   rules,
+			FailurePolicy:           &ignore,
+			TimeoutSeconds:          &timeout,
+			SideEffects:             &sideEffects,
+			AdmissionReviewVersions: []string{"v1"},
+			NamespaceSelector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{AnalysisEnabledLabel: "true"},
+				// the webhook's own namespace too, so it never blocks its own Deployment
+				MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key:      v1.LabelMetadataName,
+					Operator: metav1.LabelSelectorOpNotIn,
+					Values:   append(append([]string{}, systemNamespaces...), namespace),
+				}},
+			},
+			ObjectSelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{
+					Key:      ExcludeLabel,
+					Operator: metav1.LabelSelectorOpNotIn,
+					Values:   []string{"true"},
+				}},
+			},
+		}},
+	}
+}
+
+// Manifests returns the objects, in the order they're created.
+func (s *SetupObjects) Manifests() ([]Manifest, error) {
+	type object struct {
+		resource schema.GroupVersionResource
+		object   runtime.Object
+	}
+	objects := []object{
+		{v1.SchemeGroupVersion.WithResource("serviceaccounts"), s.ServiceAccount},
+	}
+	for i := range s.ClusterRoles {
+		objects = append(objects,
+			object{v13.SchemeGroupVersion.WithResource("clusterroles"), s.ClusterRoles[i]},
+			object{v13.SchemeGroupVersion.WithResource("clusterrolebindings"), s.ClusterRoleBindings[i]})
+	}
+	for i := range s.Roles {
+		objects = append(objects,
+			object{v13.SchemeGroupVersion.WithResource("roles"), s.Roles[i]},
+			object{v13.SchemeGroupVersion.WithResource("rolebindings"), s.RoleBindings[i]})
+	}
+	if s.Issuer != nil {
+		objects = append(objects, object{certManagerIssuerResource, s.Issuer})
+	}
+	if s.Certificate != nil {
+		objects = append(objects, object{certManagerCertificateResource, s.Certificate})
+	}
+	objects = append(objects,
+		object{v1.SchemeGroupVersion.WithResource("services"), s.Service},
+		object{v12.SchemeGroupVersion.WithResource("deployments"), s.Deployment})
+	if s.PodDisruptionBudget != nil {
+		objects = append(objects, object{policyv1.SchemeGroupVersion.WithResource("poddisruptionbudgets"), s.PodDisruptionBudget})
+	}
+	objects = append(objects,
+		object{admissionregistrationv1.SchemeGroupVersion.WithResource("mutatingwebhookconfigurations"), s.WebhookConfiguration})
+	for _, n := range s.Namespaces {
+		objects = append(objects, object{v1.SchemeGroupVersion.WithResource("namespaces"), n})
+	}
+	if s.Telemetry != nil {
+		objects = append(objects, object{telemetryv1alpha1.SchemeGroupVersion.WithResource("telemetries"), s.Telemetry})
+	}
+	manifests := make([]Manifest, 0, len(objects))
+	for _, o := range objects {
+		obj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(o.object)
+		if err != nil {
+			return nil, fmt.Errorf("unable to convert %T to unstructured: %w", o.object, err)
+		}
+		// leave out what's only set by the server
+		delete(obj, "status")
+		if spec, ok := obj["spec"].(map[string]interface{}); ok && len(spec) == 0 {
+			delete(obj, "spec")
+		}
+		manifests = append(manifests, Manifest{Resource: o.resource, Object: &unstructured.Unstructured{Object: pruneNulls(obj).(map[string]interface{})}})
+	}
+	return manifests, nil
+}
+
+// pruneNulls removes null fields, like the creationTimestamp of objects that haven't been
+// created.
+func pruneNulls(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if field == nil {
+				delete(v, k)
+				continue
+			}
+			v[k] = pruneNulls(field)
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = pruneNulls(v[i])
+		}
+	}
+	return v
+}
+
+// String names the manifest, like deployment istio-system/cost-analyzer-mutating-webhook.
+func (m Manifest) String() string {
+	kind := strings.ToLower(m.Object.GetKind())
+	if ns := m.Object.GetNamespace(); ns != "" {
+		return fmt.Sprintf("%v %v/%v", kind, ns, m.Object.GetName())
+	}
+	return fmt.Sprintf("%v %v", kind, m.Object.GetName())
+}
+
+// RenderYAML renders manifests as a multi-document yaml file.
+func RenderYAML(manifests []Manifest) ([]byte, error) {
+	out := &bytes.Buffer{}
+	for _, m := range manifests {
+		data, err := yaml.Marshal(m.Object.Object)
+		if err != nil {
+			return nil, err
+		}
+		out.WriteString("---\n")
+		out.Write(data)
+	}
+	return out.Bytes(), nil
+}
+
+// RenderKustomize writes manifests to dir as a kustomize base, with a file per object and
+// a kustomization.yaml listing them.
+func RenderKustomize(manifests []Manifest, dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	kustomization := &bytes.Buffer{}
+	kustomization.WriteString("apiVersion: kustomize.config.k8s.io/v1beta1\nkind: Kustomization\nresources:\n")
+	for _, m := range manifests {
+		data, err := yaml.Marshal(m.Object.Object)
+		if err != nil {
+			return err
+		}
+		file := fmt.Sprintf("%v-%v.yaml", strings.ToLower(m.Object.GetKind()), m.Object.GetName())
+		if err := os.WriteFile(filepath.Join(dir, file), data, 0o644); err != nil {
+			return err
+		}
+		fmt.Fprintf(kustomization, "- %v\n", file)
+	}
+	return os.WriteFile(filepath.Join(dir, "kustomization.yaml"), kustomization.Bytes(), 0o644)
+}
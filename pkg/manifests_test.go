@@ -0,0 +1,246 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func manifestNames(manifests []Manifest) []string {
+	names := make([]string, 0, len(manifests))
+	for _, m := range manifests {
+		names = append(names, m.String())
+	}
+	return names
+}
+
+// manifestOf returns the first manifest of kind.
+func manifestOf(t *testing.T, manifests []Manifest, kind string) Manifest {
+	for _, m := range manifests {
+		if m.Object.GetKind() == kind {
+			return m
+		}
+	}
+	t.Fatalf("no %v manifest", kind)
+	return Manifest{}
+}
+
+func TestSetupObjects_Manifests(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           SetupConfig
+		wantNames     []string
+		wantNamespace string
+	}{
+		{
+			name: "target namespaces with telemetry",
+			cfg:  SetupConfig{AnalyzerNamespace: "cost", TargetNamespaces: []string{"default", "shop"}, TelemetryNamespace: "istio-system"},
+			wantNames: []string{
+				"serviceaccount cost/cost-analyzer-sa",
+				"clusterrole cost-analyzer-service-role",
+				"clusterrolebinding cost-analyzer-role-binding",
+				"clusterrole cost-analyzer-webhook-configuration",
+				"clusterrolebinding cost-analyzer-webhook-configuration",
+				"role cost/cost-analyzer-webhook-certs",
+				"rolebinding cost/cost-analyzer-webhook-certs",
+				"role default/cost-analyzer-workloads",
+				"rolebinding default/cost-analyzer-workloads",
+				"role shop/cost-analyzer-workloads",
+				"rolebinding shop/cost-analyzer-workloads",
+				"service cost/cost-analyzer-mutating-webhook",
+				"deployment cost/cost-analyzer-mutating-webhook",
+				"mutatingwebhookconfiguration cost-analyzer-mutating-webhook-configuration",
+				"namespace default",
+				"namespace shop",
+				"telemetry istio-system/cost-analyzer-locality",
+			},
+			wantNamespace: "default,shop",
+		},
+		{
+			name: "all namespaces with the operator",
+			cfg:  SetupConfig{AnalyzerNamespace: "istio-system"},
+			wantNames: []string{
+				"serviceaccount istio-system/cost-analyzer-sa",
+				"clusterrole cost-analyzer-service-role",
+				"clusterrolebinding cost-analyzer-role-binding",
+				"clusterrole cost-analyzer-webhook-configuration",
+				"clusterrolebinding cost-analyzer-webhook-configuration",
+				"clusterrole cost-analyzer-workloads",
+				"clusterrolebinding cost-analyzer-workloads",
+				"role istio-system/cost-analyzer-webhook-certs",
+				"rolebinding istio-system/cost-analyzer-webhook-certs",
+				"service istio-system/cost-analyzer-mutating-webhook",
+				"deployment istio-system/cost-analyzer-mutating-webhook",
+				"mutatingwebhookconfiguration cost-analyzer-mutating-webhook-configuration",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, err := NewSetupObjects(tt.cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, b := range objects.ClusterRoleBindings {
+				if got := b.Subjects[0].Namespace; got != tt.cfg.AnalyzerNamespace {
+					t.Errorf("%v subject namespace = %v, want %v", b.Name, got, tt.cfg.AnalyzerNamespace)
+				}
+			}
+			if got := objects.Deployment.Spec.Template.Spec.Containers[0].Env[1].Value; got != tt.wantNamespace {
+				t.Errorf("NAMESPACE = %q, want %q", got, tt.wantNamespace)
+			}
+			manifests, err := objects.Manifests()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := manifestNames(manifests); !reflect.DeepEqual(got, tt.wantNames) {
+				t.Errorf("manifests = %v, want %v", got, tt.wantNames)
+			}
+			for _, m := range manifests {
+				if _, ok := m.Object.Object["status"]; ok {
+					t.Errorf("%v has a status", m)
+				}
+				if _, ok, _ := unstructured.NestedFieldNoCopy(m.Object.Object, "metadata", "creationTimestamp"); ok {
+					t.Errorf("%v has a creationTimestamp", m)
+				}
+			}
+		})
+	}
+}
+
+func TestRenderKustomize(t *testing.T) {
+	objects, err := NewSetupObjects(SetupConfig{AnalyzerNamespace: "istio-system", TargetNamespaces: []string{"default"}, TelemetryNamespace: "istio-system"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := objects.Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(t.TempDir(), "base")
+	if err := RenderKustomize(manifests, dir); err != nil {
+		t.Fatal(err)
+	}
+	kustomization, err := os.ReadFile(filepath.Join(dir, "kustomization.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"deployment-cost-analyzer-mutating-webhook.yaml", "namespace-default.yaml", "telemetry-cost-analyzer-locality.yaml"} {
+		if !strings.Contains(string(kustomization), "- "+file+"\n") {
+			t.Errorf("kustomization.yaml doesn't list %v:\n%s", file, kustomization)
+		}
+		if _, err := os.Stat(filepath.Join(dir, file)); err != nil {
+			t.Error(err)
+		}
+	}
+	rendered, err := RenderYAML(manifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(rendered), "---\n"); got != len(manifests) {
+		t.Errorf("rendered %v documents, want %v", got, len(manifests))
+	}
+}
+
+func TestLineDiff(t *testing.T) {
+	tests := []struct {
+		name     string
+		from, to []string
+		want     string
+	}{
+		{
+			name: "same",
+			from: []string{"a", "b"},
+			to:   []string{"a", "b"},
+			want: "",
+		},
+		{
+			name: "created",
+			to:   []string{"a"},
+			want: "+ a\n",
+		},
+		{
+			name: "changed line",
+			from: []string{"a", "b", "c"},
+			to:   []string{"a", "x", "c"},
+			want: "  a\n- b\n+ x\n  c\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := lineDiff(tt.from, tt.to); got != tt.want {
+				t.Errorf("lineDiff() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeClient_PlanManifests(t *testing.T) {
+	objects, err := NewSetupObjects(SetupConfig{AnalyzerNamespace: "istio-system", TargetNamespaces: []string{"default"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := objects.Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the service account as the server returns it, with fields setup doesn't set
+	sa := manifests[0].Object.DeepCopy()
+	sa.SetUID("1234")
+	sa.Object["secrets"] = []interface{}{map[string]interface{}{"name": "cost-analyzer-sa-token"}}
+	// a deployment running another image
+	deployment := manifestOf(t, manifests, "Deployment").Object.DeepCopy()
+	containers, _, _ := unstructured.NestedSlice(deployment.Object, "spec", "template", "spec", "containers")
+	containers[0].(map[string]interface{})["image"] = "adiprerepa/cost-analyzer-mutating-webhook:v1"
+	_ = unstructured.SetNestedSlice(deployment.Object, containers, "spec", "template", "spec", "containers")
+	// a namespace without the label
+	namespace := &unstructured.Unstructured{}
+	namespace.SetAPIVersion("v1")
+	namespace.SetKind("Namespace")
+	namespace.SetName("default")
+	k := &KubeClient{dynamic: fake.NewSimpleDynamicClient(runtime.NewScheme(), sa, deployment, namespace)}
+	changes, err := k.PlanManifests(manifests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range changes {
+		switch c.Manifest.Object.GetKind() {
+		case "ServiceAccount":
+			if !c.Exists || c.Diff != "" {
+				t.Errorf("service account exists = %v, diff = %q, want unchanged", c.Exists, c.Diff)
+			}
+		case "Deployment":
+			if !c.Exists || !strings.Contains(c.Diff, "- ") || !strings.Contains(c.Diff, "+ ") {
+				t.Errorf("deployment exists = %v, diff = %q, want changed", c.Exists, c.Diff)
+			}
+		case "Namespace":
+			if !c.Exists || !strings.Contains(c.Diff, "+     "+AnalysisEnabledLabel) {
+				t.Errorf("namespace exists = %v, diff = %q, want labelled", c.Exists, c.Diff)
+			}
+		default:
+			if c.Exists || c.Diff == "" {
+				t.Errorf("%v exists = %v, diff = %q, want created", c.Manifest, c.Exists, c.Diff)
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// LinkClass classifies a link between two localities by how far apart they are.
+// These match the classes used to generate the flat price sheets (see /pricing).
+type LinkClass string
+
+const (
+	IntraZone                 LinkClass = "intra-zone"
+	InterZoneIntraRegion      LinkClass = "inter-zone-intra-region"
+	InterRegionIntraContinent LinkClass = "inter-region-intra-continent"
+	InterContinent            LinkClass = "inter-continent"
+	// Internet is the class of traffic leaving the mesh to the internet.
+	Internet LinkClass = "internet"
+)
+
+// zonalLocality matches localities that name a zone, like gcp's us-west1-b.
+// aws localities (us-west-2) only name a region.
+var zonalLocality = regexp.MustCompile(`^.+-[a-z]$`)
+
+// localityRegion returns the region of a zone or region locality.
+func localityRegion(locality string) string {
+	if zonalLocality.MatchString(locality) {
+		return locality[:strings.LastIndex(locality, "-")]
+	}
+	return locality
+}
+
+// Continents regions are grouped in to classify links.
+const (
+	northAmerica = "north-america"
+	southAmerica = "south-america"
+	europe       = "europe"
+	asia         = "asia"
+	oceania      = "oceania"
+	middleEast   = "middle-east"
+	africa       = "africa"
+)
+
+// gcpContinents maps gcp regions to their continent.
+var gcpContinents = map[string]string{
+	"us-central1": northAmerica, "us-east1": northAmerica, "us-east4": northAmerica,
+	"us-east5": northAmerica, "us-south1": northAmerica, "us-west1": northAmerica,
+	"us-west2": northAmerica, "us-west3": northAmerica, "us-west4": northAmerica,
+	"northamerica-northeast1": northAmerica, "northamerica-northeast2": northAmerica,
+	"northamerica-south1": northAmerica,
+
+	"southamerica-east1": southAmerica, "southamerica-west1": southAmerica,
+
+	"europe-central2": europe, "europe-north1": europe, "europe-southwest1": europe,
+	"europe-west1": europe, "europe-west2": europe, "europe-west3": europe, "europe-west4": europe,
+	"europe-west6": europe, "europe-west8": europe, "europe-west9": europe, "europe-west10": europe,
+	"europe-west12": europe,
+
+	"asia-east1": asia, "asia-east2": asia, "asia-northeast1": asia, "asia-northeast2": asia,
+	"asia-northeast3": asia, "asia-south1": asia, "asia-south2": asia, "asia-southeast1": asia,
+	"asia-southeast2": asia,
+
+	"australia-southeast1": oceania, "australia-southeast2": oceania,
+
+	"me-central1": middleEast, "me-central2": middleEast, "me-west1": middleEast,
+
+	"africa-south1": africa,
+}
+
+// awsContinents maps aws regions to their continent.
+var awsContinents = map[string]string{
+	"us-east-1": northAmerica, "us-east-2": northAmerica, "us-west-1": northAmerica,
+	"us-west-2": northAmerica, "us-gov-east-1": northAmerica, "us-gov-west-1": northAmerica,
+	"ca-central-1": northAmerica, "ca-west-1": northAmerica, "mx-central-1": northAmerica,
+
+	"sa-east-1": southAmerica,
+
+	"eu-central-1": europe, "eu-central-2": europe, "eu-north-1": europe, "eu-south-1": europe,
+	"eu-south-2": europe, "eu-west-1": europe, "eu-west-2": europe, "eu-west-3": europe,
+
+	"ap-east-1": asia, "ap-south-1": asia, "ap-south-2": asia, "ap-northeast-1": asia,
+	"ap-northeast-2": asia, "ap-northeast-3": asia, "ap-southeast-1": asia, "ap-southeast-3": asia,
+	"ap-southeast-5": asia, "ap-southeast-7": asia,
+
+	"ap-southeast-2": oceania, "ap-southeast-4": oceania,
+
+	"me-south-1": middleEast, "me-central-1": middleEast, "il-central-1": middleEast,
+
+	"af-south-1": africa,
+}
+
+// localityContinent returns the continent of a locality's region, from gcpContinents and
+// awsContinents. A region in neither is its own continent, so links to it are classed as
+// inter-continent.
+func localityContinent(locality string) string {
+	region := localityRegion(locality)
+	for _, continents := range []map[string]string{gcpContinents, awsContinents} {
+		if continent, ok := continents[region]; ok {
+			return continent
+		}
+	}
+	return region
+}
+
+// ClassifyLink returns the LinkClass of traffic between two localities.
+func ClassifyLink(from, to string) LinkClass {
+	switch {
+	case to == InternetDestination:
+		return Internet
+	case from == to:
+		return IntraZone
+	case localityRegion(from) == localityRegion(to):
+		return InterZoneIntraRegion
+	case localityContinent(from) == localityContinent(to):
+		return InterRegionIntraContinent
+	default:
+		return InterContinent
+	}
+}
+
+// PriceOverlay holds negotiated adjustments applied on top of a price sheet, so
+// enterprise discounts don't require editing the sheet itself. For a link, a per-pair
+// rate takes precedence over the rate for its class, which takes precedence over the list
+// rate minus DiscountPercent.
+type PriceOverlay struct {
+	// DiscountPercent is a flat discount off every list rate, from 0 to 100.
+	DiscountPercent float64 `json:"discountPercent,omitempty"`
+	// LinkClasses are negotiated $/GB rates for whole classes of links.
+	LinkClasses map[LinkClass]float64 `json:"linkClasses,omitempty"`
+	// Links are negotiated $/GB rates for specific locality pairs, in the flat
+	// price sheet format.
+	Links Pricing `json:"links,omitempty"`
+}
+
+// loadPriceOverlay reads and validates the overlay file at path.
+func loadPriceOverlay(path string) (*PriceOverlay, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("unable to read file %v: %v", path, err)
+		return nil, err
+	}
+	overlay := &PriceOverlay{}
+	if err := json.Unmarshal(data, overlay); err != nil {
+		fmt.Printf("unable to unmarshal json into object: %v", err)
+		return nil, err
+	}
+	if overlay.DiscountPercent < 0 || overlay.DiscountPercent > 100 {
+		return nil, fmt.Errorf("discountPercent in %v must be between 0 and 100, got %v", path, overlay.DiscountPercent)
+	}
+	for class := range overlay.LinkClasses {
+		switch class {
+		case IntraZone, InterZoneIntraRegion, InterRegionIntraContinent, InterContinent, Internet:
+		default:
+			return nil, fmt.Errorf("unknown link class %q in %v", class, path)
+		}
+	}
+	return overlay, nil
+}
+
+// apply returns the effective rate for a link given its list rate. listOk is whether
+// the sheet has a list rate for the link; ok is whether there is an effective rate.
+func (o *PriceOverlay) apply(from, to string, list float64, listOk bool) (float64, bool) {
+	if o == nil {
+		return list, listOk
+	}
+	if rate, ok := o.Links[from][to]; ok {
+		return rate, true
+	}
+	if rate, ok := o.LinkClasses[ClassifyLink(from, to)]; ok {
+		return rate, true
+	}
+	return list * (1 - o.DiscountPercent/100), listOk
+}
@@ -0,0 +1,176 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// ownerKinds are the controllers a workload name from Istio may refer to, in the order
+// they're looked up. Istio already trims the hashes of ReplicaSets owned by a Deployment
+// and the timestamps of Jobs owned by a CronJob, so the top-level controllers come first.
+var ownerKinds = []schema.GroupVersionResource{
+	{Group: "apps", Version: "v1", Resource: "deployments"},
+	{Group: "apps", Version: "v1", Resource: "statefulsets"},
+	{Group: "apps", Version: "v1", Resource: "daemonsets"},
+	{Group: "batch", Version: "v1", Resource: "cronjobs"},
+	{Group: "argoproj.io", Version: "v1alpha1", Resource: "rollouts"},
+	{Group: "batch", Version: "v1", Resource: "jobs"},
+	{Group: "apps", Version: "v1", Resource: "replicasets"},
+}
+
+// ownerResources maps the kinds that can own a workload to their resources.
+var ownerResources = map[schema.GroupKind]schema.GroupVersionResource{
+	{Group: "apps", Kind: "Deployment"}:     ownerKinds[0],
+	{Group: "apps", Kind: "StatefulSet"}:    ownerKinds[1],
+	{Group: "apps", Kind: "DaemonSet"}:      ownerKinds[2],
+	{Group: "batch", Kind: "CronJob"}:       ownerKinds[3],
+	{Group: "argoproj.io", Kind: "Rollout"}: ownerKinds[4],
+	{Group: "batch", Kind: "Job"}:           ownerKinds[5],
+	{Group: "apps", Kind: "ReplicaSet"}:     ownerKinds[6],
+}
+
+// maxOwnerDepth bounds how many ownerReferences are followed, in case of a cycle.
+const maxOwnerDepth = 5
+
+// ResolveOwners replaces the workload names of calls, which Istio derives from pod names,
+// with the kind and name of their top-level controller, like Deployment/reviews-v1,
+// Rollout/checkout or CronJob/backup. Workloads that can't be found in their namespace,
+// like those in other clusters, are left as they are, and so are those whose controllers
+// the analyzer isn't allowed to read.
+func (k *KubeClient) ResolveOwners(calls []*Call) error {
+	owners := make(map[string]string)
+	// kinds the analyzer isn't allowed to get, warned about once
+	forbidden := make(map[schema.GroupVersionResource]bool)
+	resolve := func(namespace, workload string) (string, error) {
+		if namespace == "" || workload == "" {
+			return workload, nil
+		}
+		key := namespace + "/" + workload
+		if owner, ok := owners[key]; ok {
+			return owner, nil
+		}
+		owner, err := k.topLevelOwner(namespace, workload, forbidden)
+		if err != nil {
+			fmt.Printf("unable to resolve owner of workload %v: %v\n", key, err)
+			return "", err
+		}
+		owners[key] = owner
+		return owner, nil
+	}
+	for _, c := range calls {
+		var err error
+		if c.FromWorkload, err = resolve(c.FromNamespace, c.FromWorkload); err != nil {
+			return err
+		}
+		// internet destinations are hosts, not workloads
+		if c.Kind == InternetCall {
+			continue
+		}
+		if c.ToWorkload, err = resolve(c.ToNamespace, c.ToWorkload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// topLevelOwner finds the controller named workload in namespace, and follows its
+// controller ownerReferences to the top. It returns the top-level controller as Kind/name,
+// or workload if there is no such controller, or one on the way can't be read. Kinds that
+// can't be read are added to forbidden, and skipped.
+func (k *KubeClient) topLevelOwner(namespace, workload string, forbidden map[schema.GroupVersionResource]bool) (string, error) {
+	for _, resource := range ownerKinds {
+		if forbidden[resource] {
+			continue
+		}
+		obj, err := k.dynamic.Resource(resource).Namespace(namespace).Get(context.TODO(), workload, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			// also the case when the kind isn't installed, like Rollouts without Argo
+			continue
+		}
+		if apierrors.IsForbidden(err) {
+			warnForbidden(resource, err, forbidden)
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		for i := 0; i < maxOwnerDepth; i++ {
+			owner, err := k.controllerOf(obj, forbidden)
+			if err == errOwnerForbidden {
+				return workload, nil
+			}
+			if err != nil {
+				return "", err
+			}
+			if owner == nil {
+				break
+			}
+			obj = owner
+		}
+		return fmt.Sprintf("%v/%v", obj.GetKind(), obj.GetName()), nil
+	}
+	return workload, nil
+}
+
+// errOwnerForbidden is returned by controllerOf when the controller's kind can't be read.
+var errOwnerForbidden = errors.New("not allowed to get owner")
+
+// controllerOf returns the controller owning obj, or nil if it has none we know of. It
+// returns errOwnerForbidden if the controller's kind can't be read.
+func (k *KubeClient) controllerOf(obj *unstructured.Unstructured, forbidden map[schema.GroupVersionResource]bool) (*unstructured.Unstructured, error) {
+	ref := metav1.GetControllerOf(obj)
+	if ref == nil {
+		return nil, nil
+	}
+	gv, err := schema.ParseGroupVersion(ref.APIVersion)
+	if err != nil {
+		return nil, err
+	}
+	resource, ok := ownerResources[schema.GroupKind{Group: gv.Group, Kind: ref.Kind}]
+	if !ok {
+		return nil, nil
+	}
+	if forbidden[resource] {
+		return nil, errOwnerForbidden
+	}
+	owner, err := k.dynamic.Resource(resource).Namespace(obj.GetNamespace()).Get(context.TODO(), ref.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		// orphaned by a deleted owner
+		return nil, nil
+	}
+	if apierrors.IsForbidden(err) {
+		warnForbidden(resource, err, forbidden)
+		return nil, errOwnerForbidden
+	}
+	return owner, err
+}
+
+// warnForbidden warns that workloads aren't resolved to controllers of resource, the first
+// time it's forbidden.
+func warnForbidden(resource schema.GroupVersionResource, err error, forbidden map[schema.GroupVersionResource]bool) {
+	if forbidden[resource] {
+		return
+	}
+	forbidden[resource] = true
+	fmt.Printf("not allowed to get %v, workloads won't be resolved to them: %v\n", resource.GroupResource(), err)
+}
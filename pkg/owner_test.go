@@ -0,0 +1,110 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// ownedObject returns an object of kind owned by the controller ownerKind/owner, if set.
+func ownedObject(apiVersion, kind, name, ownerAPIVersion, ownerKind, owner string) runtime.Object {
+	obj := &unstructured.Unstructured{}
+	obj.SetAPIVersion(apiVersion)
+	obj.SetKind(kind)
+	obj.SetNamespace("default")
+	obj.SetName(name)
+	if owner != "" {
+		obj.Object["metadata"].(map[string]interface{})["ownerReferences"] = []interface{}{
+			map[string]interface{}{
+				"apiVersion": ownerAPIVersion,
+				"kind":       ownerKind,
+				"name":       owner,
+				"uid":        owner,
+				"controller": true,
+			},
+		}
+	}
+	return obj
+}
+
+func TestKubeClient_ResolveOwners(t *testing.T) {
+	k := &KubeClient{
+		dynamic: fake.NewSimpleDynamicClient(runtime.NewScheme(),
+			ownedObject("apps/v1", "Deployment", "reviews-v1", "", "", ""),
+			ownedObject("batch/v1", "CronJob", "backup", "", "", ""),
+			// a job created by hand, outside its cronjob's schedule
+			ownedObject("batch/v1", "Job", "backup-manual", "batch/v1", "CronJob", "backup"),
+			ownedObject("argoproj.io/v1alpha1", "Rollout", "checkout", "", "", ""),
+			ownedObject("apps/v1", "ReplicaSet", "checkout-6f7d8", "argoproj.io/v1alpha1", "Rollout", "checkout"),
+			// owned by something we don't know
+			ownedObject("apps/v1", "ReplicaSet", "custom-5c9f", "example.com/v1", "Custom", "custom"),
+		),
+	}
+	calls := []*Call{
+		{FromWorkload: "reviews-v1", FromNamespace: "default", ToWorkload: "backup-manual", ToNamespace: "default"},
+		{FromWorkload: "checkout-6f7d8", FromNamespace: "default", ToWorkload: "custom-5c9f", ToNamespace: "default"},
+		{FromWorkload: "backup", FromNamespace: "default", ToWorkload: "unknown", ToNamespace: "default"},
+		// no namespace reported
+		{FromWorkload: "reviews-v1", ToWorkload: "example.com", Kind: InternetCall},
+	}
+	if err := k.ResolveOwners(calls); err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Call{
+		{FromWorkload: "Deployment/reviews-v1", FromNamespace: "default", ToWorkload: "CronJob/backup", ToNamespace: "default"},
+		{FromWorkload: "Rollout/checkout", FromNamespace: "default", ToWorkload: "ReplicaSet/custom-5c9f", ToNamespace: "default"},
+		{FromWorkload: "CronJob/backup", FromNamespace: "default", ToWorkload: "unknown", ToNamespace: "default"},
+		{FromWorkload: "reviews-v1", ToWorkload: "example.com", Kind: InternetCall},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("ResolveOwners() = %v, want %v", calls, expected)
+	}
+}
+
+func TestKubeClient_ResolveOwnersForbidden(t *testing.T) {
+	client := fake.NewSimpleDynamicClient(runtime.NewScheme(),
+		ownedObject("apps/v1", "Deployment", "reviews-v1", "", "", ""),
+		ownedObject("argoproj.io/v1alpha1", "Rollout", "checkout", "", "", ""),
+		ownedObject("apps/v1", "ReplicaSet", "checkout-6f7d8", "argoproj.io/v1alpha1", "Rollout", "checkout"),
+	)
+	// the analyzer isn't allowed to read rollouts
+	client.PrependReactor("get", "rollouts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "argoproj.io", Resource: "rollouts"}, "", errors.New("rbac"))
+	})
+	k := &KubeClient{dynamic: client}
+	calls := []*Call{
+		{FromWorkload: "reviews-v1", FromNamespace: "default", ToWorkload: "checkout", ToNamespace: "default"},
+		{FromWorkload: "checkout-6f7d8", FromNamespace: "default", ToWorkload: "reviews-v1", ToNamespace: "default"},
+	}
+	if err := k.ResolveOwners(calls); err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Call{
+		{FromWorkload: "Deployment/reviews-v1", FromNamespace: "default", ToWorkload: "checkout", ToNamespace: "default"},
+		{FromWorkload: "checkout-6f7d8", FromNamespace: "default", ToWorkload: "Deployment/reviews-v1", ToNamespace: "default"},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("ResolveOwners() = %v, want %v", calls, expected)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"k8s.io/apimachinery/pkg/util/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PriceSheetOptions controls how price sheets are fetched, cached, verified and adjusted.
+type PriceSheetOptions struct {
+	// CacheDir is where remote price sheets are cached between runs. If empty,
+	// remote sheets are not cached.
+	CacheDir string
+	// Timeout bounds each request for a remote price sheet.
+	Timeout time.Duration
+	// MaxAge is how old a cached sheet may be when it can't be revalidated against
+	// the remote. Zero means cached sheets never go stale.
+	MaxAge time.Duration
+	// SHA256 is the expected hex-encoded sha256 checksum of the sheet. If empty,
+	// the sheet isn't verified.
+	SHA256 string
+	// OverlayPath is a local PriceOverlay file with negotiated rates applied on top
+	// of the sheet. If empty, list rates are used.
+	OverlayPath string
+	// Currency is the currency to report costs in. If empty, the sheet's currency is used.
+	Currency Currency
+	// ExchangeRatesPath is a local ExchangeRates file, needed when Currency differs from
+	// the sheet's currency.
+	ExchangeRatesPath string
+	// NATGateway is whether internet traffic leaves the cluster through a cloud NAT,
+	// whose processing charge (NATProcessing in the sheet) is then added.
+	NATGateway bool
+	// LoadBalancer is whether ingress traffic enters the cluster through a cloud load
+	// balancer, whose processing charge (LoadBalancerProcessing in the sheet) is then added.
+	LoadBalancer bool
+}
+
+// DefaultPriceSheetOptions doesn't cache or verify sheets, and times out remote
+// requests after 30 seconds.
+func DefaultPriceSheetOptions() PriceSheetOptions {
+	return PriceSheetOptions{
+		Timeout: 30 * time.Second,
+	}
+}
+
+// cachedSheetMeta is stored next to a cached price sheet, and holds what we need
+// to revalidate it.
+type cachedSheetMeta struct {
+	Location     string    `json:"location"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"lastModified,omitempty"`
+	FetchedAt    time.Time `json:"fetchedAt"`
+}
+
+// fetchPriceSheet gets a remote price sheet, revalidating the cached copy with
+// If-None-Match/If-Modified-Since if there is one. If the remote can't be reached,
+// the cached copy is used as long as it isn't older than opts.MaxAge.
+func fetchPriceSheet(location string, opts PriceSheetOptions) ([]byte, error) {
+	var meta *cachedSheetMeta
+	var cached []byte
+	if opts.CacheDir != "" {
+		meta, cached = readCachedSheet(opts.CacheDir, location)
+	}
+	req, err := http.NewRequest(http.MethodGet, location, nil)
+	if err != nil {
+		return nil, err
+	}
+	if meta != nil {
+		if meta.ETag != "" {
+			req.Header.Set("If-None-Match", meta.ETag)
+		}
+		if meta.LastModified != "" {
+			req.Header.Set("If-Modified-Since", meta.LastModified)
+		}
+	}
+	client := &http.Client{Timeout: opts.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return useCachedSheet(location, meta, cached, opts, err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusNotModified && meta != nil:
+		meta.FetchedAt = time.Now()
+		if err := writeCachedSheet(opts.CacheDir, meta, nil); err != nil {
+			fmt.Printf("unable to update price sheet cache: %v\n", err)
+		}
+		return cached, nil
+	case resp.StatusCode == http.StatusOK:
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return useCachedSheet(location, meta, cached, opts, err)
+		}
+		// don't cache a sheet we would refuse to use
+		if err := verifyPriceSheet(location, data, opts.SHA256); err != nil {
+			return nil, err
+		}
+		if opts.CacheDir != "" {
+			meta = &cachedSheetMeta{
+				Location:     location,
+				ETag:         resp.Header.Get("ETag"),
+				LastModified: resp.Header.Get("Last-Modified"),
+				FetchedAt:    time.Now(),
+			}
+			if err := writeCachedSheet(opts.CacheDir, meta, data); err != nil {
+				fmt.Printf("unable to cache price sheet: %v\n", err)
+			}
+		}
+		return data, nil
+	default:
+		return useCachedSheet(location, meta, cached, opts, fmt.Errorf("unexpected status %v", resp.Status))
+	}
+}
+
+// useCachedSheet falls back to the cached copy of a sheet after fetchErr, as long as
+// it exists and isn't stale.
+func useCachedSheet(location string, meta *cachedSheetMeta, cached []byte, opts PriceSheetOptions, fetchErr error) ([]byte, error) {
+	if meta == nil {
+		return nil, fmt.Errorf("unable to fetch price sheet %v: %w", location, fetchErr)
+	}
+	age := time.Since(meta.FetchedAt).Round(time.Second)
+	if opts.MaxAge > 0 && age > opts.MaxAge {
+		return nil, fmt.Errorf("unable to fetch price sheet %v (%v), and the cached copy is stale: fetched %v ago, max age is %v",
+			location, fetchErr, age, opts.MaxAge)
+	}
+	fmt.Printf("unable to fetch price sheet %v (%v), using copy cached %v ago\n", location, fetchErr, age)
+	return cached, nil
+}
+
+// verifyPriceSheet checks data against the expected hex-encoded sha256 checksum, if any.
+func verifyPriceSheet(location string, data []byte, expected string) error {
+	if expected == "" {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	if actual := hex.EncodeToString(sum[:]); !strings.EqualFold(actual, expected) {
+		return fmt.Errorf("price sheet %v has sha256 %v, expected %v", location, actual, expected)
+	}
+	return nil
+}
+
+// cachedSheetPaths returns the paths of the cached sheet and its metadata for a location.
+func cachedSheetPaths(dir, location string) (string, string) {
+	sum := sha256.Sum256([]byte(location))
+	name := hex.EncodeToString(sum[:8])
+	return filepath.Join(dir, name+".json"), filepath.Join(dir, name+".meta.json")
+}
+
+// readCachedSheet returns the cached sheet for location and its metadata, or nil if
+// there is no usable cached copy.
+func readCachedSheet(dir, location string) (*cachedSheetMeta, []byte) {
+	sheetPath, metaPath := cachedSheetPaths(dir, location)
+	metaData, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, nil
+	}
+	meta := &cachedSheetMeta{}
+	if err := json.Unmarshal(metaData, meta); err != nil || meta.Location != location {
+		return nil, nil
+	}
+	data, err := os.ReadFile(sheetPath)
+	if err != nil {
+		return nil, nil
+	}
+	return meta, data
+}
+
+// writeCachedSheet writes the metadata, and the sheet itself if data isn't nil.
+func writeCachedSheet(dir string, meta *cachedSheetMeta, data []byte) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	sheetPath, metaPath := cachedSheetPaths(dir, meta.Location)
+	if data != nil {
+		if err := os.WriteFile(sheetPath, data, 0o644); err != nil {
+			return err
+		}
+	}
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(metaPath, metaData, 0o644)
+}
@@ -0,0 +1,123 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const validSheet = `{"us-west1-a": {"us-west1-b": 0.01}}`
+
+// validSheetSHA256 is the sha256 of validSheet.
+const validSheetSHA256 = "6c9f93f198c1af819be5c52e8d99f2615bfdab37cc76be7e0ca9ed7827b74c75"
+
+func TestFetchPriceSheet(t *testing.T) {
+	requests := 0
+	revalidated := 0
+	up := true
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if !up {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			revalidated++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte(validSheet))
+	}))
+	defer srv.Close()
+	opts := PriceSheetOptions{
+		CacheDir: t.TempDir(),
+		Timeout:  time.Second,
+		MaxAge:   time.Hour,
+	}
+	expected := Pricing{"us-west1-a": {"us-west1-b": 0.01}}
+
+	// first fetch populates the cache
+	ca, err := NewCostAnalysisWithOptions(srv.URL, opts)
+	if err != nil || !reflect.DeepEqual(ca.pricing, expected) {
+		t.Fatalf("first fetch: expected %v => (%v, %v)", expected, ca, err)
+	}
+	// second fetch revalidates with the etag
+	ca, err = NewCostAnalysisWithOptions(srv.URL, opts)
+	if err != nil || !reflect.DeepEqual(ca.pricing, expected) || revalidated != 1 {
+		t.Fatalf("revalidation: expected %v and 1 revalidation => (%v, %v, %v)", expected, ca, err, revalidated)
+	}
+	// remote down, cache fresh
+	up = false
+	ca, err = NewCostAnalysisWithOptions(srv.URL, opts)
+	if err != nil || !reflect.DeepEqual(ca.pricing, expected) {
+		t.Fatalf("fresh cache fallback: expected %v => (%v, %v)", expected, ca, err)
+	}
+	// remote down, cache stale
+	_, metaPath := cachedSheetPaths(opts.CacheDir, srv.URL)
+	old := time.Now().Add(-2 * time.Hour)
+	if err := writeCachedSheet(opts.CacheDir, &cachedSheetMeta{Location: srv.URL, ETag: `"v1"`, FetchedAt: old}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewCostAnalysisWithOptions(srv.URL, opts); err == nil {
+		t.Errorf("stale cache: expected error")
+	}
+	// no cache at all
+	if err := os.Remove(metaPath); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = NewCostAnalysisWithOptions(srv.URL, opts); err == nil {
+		t.Errorf("no cache: expected error")
+	}
+	if requests != 5 {
+		t.Errorf("expected 5 requests => (%v)", requests)
+	}
+}
+
+func TestVerifyPriceSheet(t *testing.T) {
+	tests := []struct {
+		name          string
+		expected      string
+		expectedError bool
+	}{
+		{
+			name:          "no pin",
+			expected:      "",
+			expectedError: false,
+		},
+		{
+			name:          "matching pin",
+			expected:      validSheetSHA256,
+			expectedError: false,
+		},
+		{
+			name:          "mismatched pin",
+			expected:      "deadbeef",
+			expectedError: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := verifyPriceSheet("test", []byte(validSheet), tt.expected); (err != nil) != tt.expectedError {
+				t.Errorf("expected error existence: %v => (%v)", tt.expectedError, err)
+			}
+		})
+	}
+}
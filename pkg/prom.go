@@ -21,8 +21,10 @@ import (
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 	"github.com/prometheus/common/model"
 	"net/http"
+	"net/url"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
@@ -37,6 +39,16 @@ type CostAnalyzerProm struct {
 	attemptsForwarding int
 	// attemptsThreshold is the number of retry attempts we will make to port-forward
 	attemptsThreshold int
+	// egressGateways are the workload names of the mesh's egress gateways.
+	egressGateways map[string]bool
+	// ingressGateways are the workload names of the mesh's ingress gateways.
+	ingressGateways map[string]bool
+	// kubeContext is the kubeconfig context Prometheus is port-forwarded from. Empty
+	// is the current context.
+	kubeContext string
+	// localities is set when localities are inferred from pods and nodes, instead of
+	// recorded in metrics.
+	localities *LocalityCache
 }
 
 // NewAnalyzerProm creates a prometheus client given the endpoint,
@@ -64,11 +76,53 @@ func NewAnalyzerProm(promEndpoint, cloud string) (*CostAnalyzerProm, error) {
 	}, nil
 }
 
+// SetEgressGateways sets the workload names of the mesh's egress gateways, so traffic
+// routed through them is recognised.
+func (d *CostAnalyzerProm) SetEgressGateways(workloads []string) {
+	d.egressGateways = make(map[string]bool, len(workloads))
+	for _, w := range workloads {
+		if w != "" {
+			d.egressGateways[w] = true
+		}
+	}
+}
+
+// SetIngressGateways sets the workload names of the mesh's ingress gateways, so traffic
+// entering through them is recognised.
+func (d *CostAnalyzerProm) SetIngressGateways(workloads []string) {
+	d.ingressGateways = make(map[string]bool, len(workloads))
+	for _, w := range workloads {
+		if w != "" {
+			d.ingressGateways[w] = true
+		}
+	}
+}
+
+// SetKubeContext sets the kubeconfig context to port-forward Prometheus from, for
+// analyzing a cluster other than the current one.
+func (d *CostAnalyzerProm) SetKubeContext(context string) {
+	d.kubeContext = context
+}
+
+// SetInferredLocalities makes GetCalls infer localities from the pods and nodes in cache,
+// for meshes where the webhook hasn't labelled pods with their locality.
+func (d *CostAnalyzerProm) SetInferredLocalities(cache *LocalityCache) {
+	d.localities = cache
+}
+
 // PortForwardProm will execute a kubectl port-forward command, forwarding the inbuild prometheus
-// deployment to port 9090 on localhost. This is executed asynchronously, and if there is an error,
-// it is sent into d.errChan.
+// deployment to the port of the prometheus endpoint on localhost. This is executed asynchronously,
+// and if there is an error, it is sent into d.errChan.
 func (d *CostAnalyzerProm) PortForwardProm(promNamespace string) {
-	cmd := exec.Command("kubectl", "-n", promNamespace, "port-forward", "deployment/prometheus", "9990:9090")
+	port := "9990"
+	if u, err := url.Parse(d.promEndpoint); err == nil && u.Port() != "" {
+		port = u.Port()
+	}
+	args := []string{"-n", promNamespace, "port-forward", "deployment/prometheus", port + ":9090"}
+	if d.kubeContext != "" {
+		args = append([]string{"--context", d.kubeContext}, args...)
+	}
+	cmd := exec.Command("kubectl", args...)
 	o, err := cmd.CombinedOutput()
 	if err != nil {
 		if strings.Contains(string(o), "address already in use") && d.attemptsForwarding < d.attemptsThreshold {
@@ -103,85 +157,188 @@ func (d *CostAnalyzerProm) WaitForProm() error {
 	}
 }
 
+const (
+	// localityQuery matches in-mesh traffic between workloads with a known locality.
+	localityQuery = "istio_request_bytes_sum{destination_locality!=\"\", destination_locality!=\"unknown\"}"
+	// internetQuery matches traffic to destinations without a locality, as reported by
+	// the source. Only destinations that isInternetDestination accepts leave the mesh.
+	internetQuery = "istio_request_bytes_sum{reporter=\"source\", destination_locality=~\"|unknown\"}"
+)
+
 // GetCalls queries the prometheus API for istio_request_bytes_sum, given a time range.
-// returns an array of Calls, which contain locality and workload information.
-// todo take an actual timerange, and not the hacky "since" parameter.
+// returns an array of Calls, which contain locality and workload information. Traffic
+// leaving the mesh (to ServiceEntry hosts or through PassthroughCluster) is returned as
+// calls of kind InternetCall, with the destination host as ToWorkload. Traffic to an
+// egress gateway is returned as calls of kind EgressGatewayCall. If the gateway's pods
+// aren't labelled with their locality, the gateway's side of those calls is left empty.
+// Traffic from an ingress gateway is returned as calls of kind IngressGatewayCall, with
+// the request host (if the request_host label is recorded) or the destination service as
+// Host. The gateway's locality is always left empty. If localities are inferred, see
+// getInferredCalls instead.
 func (d *CostAnalyzerProm) GetCalls(start, end *time.Time) ([]*Call, error) {
-	promApi := v1.NewAPI(d.client)
+	if d.localities != nil {
+		return d.getInferredCalls(start, end)
+	}
 	calls := make([]*Call, 0)
-	query := "istio_request_bytes_sum{destination_locality!=\"\", destination_locality!=\"unknown\"}"
-	var result model.Value
-	var warn v1.Warnings
-	var err error
-	if start == nil {
-		fmt.Printf("EFN")
-		result, warn, err = promApi.Query(context.Background(), query, *end)
-		v := result.(model.Vector)
-		for i := 0; i < len(v); i++ {
-			// check if the locality is valid with regexp, if not, throw it out
-			// we do this because anyone can set labels on pods, and we don't want to
-			// count those.
-			if !d.validateLocality(string(v[i].Metric["destination_locality"])) {
-				fmt.Printf("skipping invalid destination locality: %v\n", v[i].Metric["destination_locality"])
-				continue
-			}
-			if !d.validateLocality(string(v[i].Metric["locality"])) {
-				fmt.Printf("skipping invalid source locality: %v\n", v[i].Metric["locality"])
-				continue
-			}
+	series, err := d.queryIncrease(localityQuery, start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range series {
+		// ingress gateway traffic is counted with ingressQuery instead
+		if d.ingressGateways[string(s.Metric["source_workload"])] {
+			continue
+		}
+		// check if the locality is valid with regexp, if not, throw it out
+		// we do this because anyone can set labels on pods, and we don't want to
+		// count those.
+		if !d.validateLocality(string(s.Metric["destination_locality"])) {
+			fmt.Printf("skipping invalid destination locality: %v\n", s.Metric["destination_locality"])
+			continue
+		}
+		if !d.validateLocality(string(s.Metric["locality"])) {
+			fmt.Printf("skipping invalid source locality: %v\n", s.Metric["locality"])
+			continue
+		}
+		call := &Call{
+			From:          string(s.Metric["destination_locality"]),
+			To:            string(s.Metric["locality"]),
+			ToWorkload:    string(s.Metric["destination_workload"]),
+			FromWorkload:  string(s.Metric["source_workload"]),
+			CallSize:      uint64(s.Value),
+			FromCluster:   string(s.Metric["source_cluster"]),
+			ToCluster:     string(s.Metric["destination_cluster"]),
+			FromNamespace: string(s.Metric["source_workload_namespace"]),
+			ToNamespace:   string(s.Metric["destination_workload_namespace"]),
+			Reporter:      string(s.Metric["reporter"]),
+		}
+		if d.egressGateways[call.ToWorkload] {
+			// like the hops to egress gateways from internetQuery, from the source's
+			// locality to the gateway's
+			call.From, call.To = call.To, call.From
+			call.Kind = EgressGatewayCall
+		}
+		calls = append(calls, call)
+	}
+	series, err = d.queryIncrease(internetQuery, start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range series {
+		source, destination := string(s.Metric["source_workload"]), string(s.Metric["destination_workload"])
+		locality := string(s.Metric["locality"])
+		// gateway pods usually aren't labelled with their locality, so it's resolved
+		// later with ResolveGatewayLocalities.
+		fromGateway := d.egressGateways[source] && locality == ""
+		if !fromGateway && !d.validateLocality(locality) {
+			fmt.Printf("skipping invalid source locality: %v\n", s.Metric["locality"])
+			continue
+		}
+		switch {
+		case d.egressGateways[destination]:
+			calls = append(calls, &Call{
+				From:          locality,
+				FromWorkload:  source,
+				ToWorkload:    destination,
+				CallSize:      uint64(s.Value),
+				Kind:          EgressGatewayCall,
+				FromCluster:   string(s.Metric["source_cluster"]),
+				ToCluster:     string(s.Metric["destination_cluster"]),
+				FromNamespace: string(s.Metric["source_workload_namespace"]),
+				ToNamespace:   string(s.Metric["destination_workload_namespace"]),
+			})
+		case isInternetDestination(s.Metric):
 			calls = append(calls, &Call{
-				From:         string(v[i].Metric["destination_locality"]),
-				To:           string(v[i].Metric["locality"]),
-				ToWorkload:   string(v[i].Metric["destination_workload"]),
-				FromWorkload: string(v[i].Metric["source_workload"]),
-				CallSize:     uint64(v[i].Value),
+				From:          locality,
+				To:            InternetDestination,
+				ToWorkload:    destinationHost(s.Metric),
+				FromWorkload:  source,
+				CallSize:      uint64(s.Value),
+				Kind:          InternetCall,
+				FromCluster:   string(s.Metric["source_cluster"]),
+				FromNamespace: string(s.Metric["source_workload_namespace"]),
 			})
 		}
-	} else {
-		// query across timerange
-		startResult, _, err := promApi.Query(context.Background(), query, *start)
-		if err != nil {
-			return nil, err
+	}
+	if len(d.ingressGateways) == 0 {
+		return calls, nil
+	}
+	series, err = d.queryIncrease(ingressQuery(d.ingressGateways), start, end)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range series {
+		// reported by the destination, so locality is the destination's
+		if !d.validateLocality(string(s.Metric["locality"])) {
+			fmt.Printf("skipping invalid destination locality: %v\n", s.Metric["locality"])
+			continue
 		}
-		endResult, _, err := promApi.Query(context.Background(), query, *end)
-		if err != nil {
-			return nil, err
+		host := string(s.Metric["request_host"])
+		if host == "" || host == "unknown" {
+			host = string(s.Metric["destination_service"])
 		}
-		startV := startResult.(model.Vector)
-		endV := endResult.(model.Vector)
-		for i := 0; i < len(startV); i++ {
-			if !d.validateLocality(string(startV[i].Metric["destination_locality"])) {
-				fmt.Printf("skipping invalid destination locality: %v\n", startV[i].Metric["destination_locality"])
-				continue
-			}
-			if !d.validateLocality(string(startV[i].Metric["locality"])) {
-				fmt.Printf("skipping invalid source locality: %v\n", startV[i].Metric["locality"])
-				continue
-			}
-			for j := 0; j < len(endV); j++ {
-				if !d.validateLocality(string(endV[j].Metric["destination_locality"])) {
-					fmt.Printf("skipping invalid destination locality: %v\n", endV[j].Metric["destination_locality"])
-					continue
-				}
-				if !d.validateLocality(string(endV[j].Metric["locality"])) {
-					fmt.Printf("skipping invalid source locality: %v\n", endV[j].Metric["locality"])
-					continue
-				}
-				if string(startV[i].Metric["destination_locality"]) == string(endV[j].Metric["destination_locality"]) &&
-					string(startV[i].Metric["locality"]) == string(endV[j].Metric["locality"]) &&
-					string(startV[i].Metric["destination_workload"]) == string(endV[j].Metric["destination_workload"]) &&
-					string(startV[i].Metric["source_workload"]) == string(endV[j].Metric["source_workload"]) {
-					calls = append(calls, &Call{
-						From:         string(startV[i].Metric["destination_locality"]),
-						To:           string(startV[i].Metric["locality"]),
-						ToWorkload:   string(startV[i].Metric["destination_workload"]),
-						FromWorkload: string(startV[i].Metric["source_workload"]),
-						CallSize:     uint64(endV[j].Value) - uint64(startV[i].Value),
-					})
-				}
-			}
+		calls = append(calls, &Call{
+			FromWorkload:  string(s.Metric["source_workload"]),
+			To:            string(s.Metric["locality"]),
+			ToWorkload:    string(s.Metric["destination_workload"]),
+			CallSize:      uint64(s.Value),
+			Kind:          IngressGatewayCall,
+			Host:          host,
+			FromCluster:   string(s.Metric["source_cluster"]),
+			ToCluster:     string(s.Metric["destination_cluster"]),
+			FromNamespace: string(s.Metric["source_workload_namespace"]),
+			ToNamespace:   string(s.Metric["destination_workload_namespace"]),
+		})
+	}
+	return calls, nil
+}
+
+// ingressQuery matches traffic from the ingress gateways, as reported by the destination.
+// Gateways don't record the destination's locality, but destination sidecars record their own.
+func ingressQuery(ingressGateways map[string]bool) string {
+	gateways := make([]string, 0, len(ingressGateways))
+	for g := range ingressGateways {
+		// escaped once for the regexp, and once for the promql string
+		gateways = append(gateways, strings.ReplaceAll(regexp.QuoteMeta(g), `\`, `\\`))
+	}
+	sort.Strings(gateways)
+	return fmt.Sprintf("istio_request_bytes_sum{reporter=\"destination\", source_workload=~\"%v\"}", strings.Join(gateways, "|"))
+}
+
+// queryIncrease returns every series matching query with its value at end, minus its
+// value at start if start isn't nil. Series that didn't exist at start, or were reset
+// since, count from zero.
+func (d *CostAnalyzerProm) queryIncrease(query string, start, end *time.Time) (model.Vector, error) {
+	promApi := v1.NewAPI(d.client)
+	endV, err := queryVector(promApi, query, *end)
+	if err != nil {
+		return nil, err
+	}
+	if start == nil {
+		return endV, nil
+	}
+	startV, err := queryVector(promApi, query, *start)
+	if err != nil {
+		return nil, err
+	}
+	startValues := make(map[model.Fingerprint]model.SampleValue, len(startV))
+	for _, s := range startV {
+		startValues[s.Metric.Fingerprint()] = s.Value
+	}
+	increase := make(model.Vector, 0, len(endV))
+	for _, s := range endV {
+		v := s.Value
+		if sv, ok := startValues[s.Metric.Fingerprint()]; ok && sv <= v {
+			v -= sv
 		}
+		increase = append(increase, &model.Sample{Metric: s.Metric, Value: v, Timestamp: s.Timestamp})
 	}
+	return increase, nil
+}
+
+// queryVector runs an instant query that is expected to return a vector.
+func queryVector(promApi v1.API, query string, ts time.Time) (model.Vector, error) {
+	result, warn, err := promApi.Query(context.Background(), query, ts)
 	if err != nil {
 		fmt.Printf("error querying prom: %v", err)
 		return nil, err
@@ -189,7 +346,55 @@ func (d *CostAnalyzerProm) GetCalls(start, end *time.Time) ([]*Call, error) {
 	if len(warn) > 0 {
 		fmt.Printf("Warn: %v", warn)
 	}
+	v, ok := result.(model.Vector)
+	if !ok {
+		return nil, fmt.Errorf("unexpected prometheus result type %v for %v", result.Type(), query)
+	}
+	return v, nil
+}
+
+// isInternetDestination returns whether a series' destination is outside the mesh and
+// the cluster: PassthroughCluster, or a ServiceEntry host that isn't a kubernetes service.
+func isInternetDestination(m model.Metric) bool {
+	name, svc := string(m["destination_service_name"]), string(m["destination_service"])
+	switch {
+	case name == "PassthroughCluster":
+		return true
+	case name == "BlackHoleCluster" || svc == "" || svc == "unknown":
+		return false
+	}
+	return !strings.Contains(svc, ".svc.")
+}
+
+// destinationHost returns the external host a series was sent to, if known.
+func destinationHost(m model.Metric) string {
+	if svc := string(m["destination_service"]); svc != "" && svc != "unknown" {
+		return svc
+	}
+	return string(m["destination_service_name"])
+}
 
+// GetDailyCalls splits [start, end) into UTC days and queries the calls made in each
+// day separately, setting Day on each returned Call. It's used to price traffic with the
+// rates in effect on the day it was sent.
+func (d *CostAnalyzerProm) GetDailyCalls(start, end time.Time) ([]*Call, error) {
+	calls := make([]*Call, 0)
+	for from := start; from.Before(end); {
+		day := from.UTC().Truncate(24 * time.Hour)
+		to := day.Add(24 * time.Hour)
+		if to.After(end) {
+			to = end
+		}
+		dayCalls, err := d.GetCalls(&from, &to)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range dayCalls {
+			c.Day = day
+		}
+		calls = append(calls, dayCalls...)
+		from = to
+	}
 	return calls, nil
 }
 
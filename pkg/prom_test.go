@@ -0,0 +1,241 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// promSeries is a series served by fakeProm, with its value at the start and end
+// of the queried window.
+type promSeries struct {
+	query  string
+	labels map[string]string
+	start  float64
+	end    float64
+}
+
+// fakeProm serves instant queries for series. Queries at or before startTime return
+// the start values, later ones the end values.
+func fakeProm(t *testing.T, startTime time.Time, series []promSeries) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Fatal(err)
+		}
+		ts, _ := strconv.ParseFloat(r.Form.Get("time"), 64)
+		atStart := !time.Unix(int64(ts), 0).After(startTime)
+		result := make([]map[string]interface{}, 0)
+		for _, s := range series {
+			if s.query != r.Form.Get("query") {
+				continue
+			}
+			v := s.end
+			if atStart {
+				v = s.start
+			}
+			result = append(result, map[string]interface{}{
+				"metric": s.labels,
+				"value":  []interface{}{ts, strconv.FormatFloat(v, 'f', -1, 64)},
+			})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"status": "success",
+			"data":   map[string]interface{}{"resultType": "vector", "result": result},
+		})
+	}))
+}
+
+func TestCostAnalyzerProm_GetCalls(t *testing.T) {
+	start := time.Unix(1000, 0)
+	end := time.Unix(2000, 0)
+	srv := fakeProm(t, start, []promSeries{
+		{
+			query: localityQuery,
+			labels: map[string]string{
+				"source_workload": "productpage-v1", "locality": "us-west1-b",
+				"destination_workload": "details-v1", "destination_locality": "us-west1-c",
+			},
+			start: 100,
+			end:   300,
+		},
+		{
+			query: localityQuery,
+			labels: map[string]string{
+				"source_workload": "productpage-v1", "locality": "bogus",
+				"destination_workload": "details-v1", "destination_locality": "us-west1-c",
+			},
+			start: 100,
+			end:   300,
+		},
+		{
+			query: internetQuery,
+			labels: map[string]string{
+				"source_workload": "productpage-v1", "locality": "us-west1-b",
+				"destination_service": "api.stripe.com", "destination_service_name": "api.stripe.com",
+			},
+			start: 0,
+			end:   500,
+		},
+		{
+			query: internetQuery,
+			labels: map[string]string{
+				"source_workload": "reviews-v1", "locality": "us-west1-b",
+				"destination_service": "unknown", "destination_service_name": "PassthroughCluster",
+			},
+			start: 50,
+			end:   20,
+		},
+		{
+			query: internetQuery,
+			labels: map[string]string{
+				"source_workload": "reviews-v1", "locality": "us-west1-b",
+				"destination_service": "ratings.default.svc.cluster.local", "destination_service_name": "ratings",
+			},
+			start: 0,
+			end:   100,
+		},
+	})
+	defer srv.Close()
+	prom, err := NewAnalyzerProm(srv.URL, "gcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	calls, err := prom.GetCalls(&start, &end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Call{
+		{From: "us-west1-c", To: "us-west1-b", FromWorkload: "productpage-v1", ToWorkload: "details-v1", CallSize: 200},
+		{From: "us-west1-b", To: InternetDestination, FromWorkload: "productpage-v1", ToWorkload: "api.stripe.com", CallSize: 500, Kind: InternetCall},
+		// counter reset since start, so it counts from zero
+		{From: "us-west1-b", To: InternetDestination, FromWorkload: "reviews-v1", ToWorkload: "PassthroughCluster", CallSize: 20, Kind: InternetCall},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("GetCalls() = %v, want %v", calls, expected)
+	}
+}
+
+func TestCostAnalyzerProm_GetCallsEgressGateway(t *testing.T) {
+	start := time.Unix(1000, 0)
+	end := time.Unix(2000, 0)
+	srv := fakeProm(t, start, []promSeries{
+		{
+			// the gateway's pods are labelled with their locality
+			query: localityQuery,
+			labels: map[string]string{
+				"source_workload": "reviews-v1", "locality": "us-west1-a",
+				"destination_workload": "istio-egressgateway", "destination_locality": "us-west1-c",
+			},
+			start: 0,
+			end:   300,
+		},
+		{
+			query: internetQuery,
+			labels: map[string]string{
+				"source_workload": "productpage-v1", "locality": "us-west1-b",
+				"destination_workload": "istio-egressgateway", "destination_service_name": "istio-egressgateway",
+			},
+			start: 0,
+			end:   400,
+		},
+		{
+			query: internetQuery,
+			labels: map[string]string{
+				"source_workload": "istio-egressgateway", "locality": "",
+				"destination_service": "api.stripe.com", "destination_service_name": "api.stripe.com",
+			},
+			start: 0,
+			end:   400,
+		},
+	})
+	defer srv.Close()
+	prom, err := NewAnalyzerProm(srv.URL, "gcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prom.SetEgressGateways([]string{"istio-egressgateway"})
+	calls, err := prom.GetCalls(&start, &end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Call{
+		{From: "us-west1-a", To: "us-west1-c", FromWorkload: "reviews-v1", ToWorkload: "istio-egressgateway", CallSize: 300, Kind: EgressGatewayCall},
+		{From: "us-west1-b", FromWorkload: "productpage-v1", ToWorkload: "istio-egressgateway", CallSize: 400, Kind: EgressGatewayCall},
+		{From: "", To: InternetDestination, FromWorkload: "istio-egressgateway", ToWorkload: "api.stripe.com", CallSize: 400, Kind: InternetCall},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("GetCalls() = %v, want %v", calls, expected)
+	}
+}
+
+func TestCostAnalyzerProm_GetCallsIngressGateway(t *testing.T) {
+	start := time.Unix(1000, 0)
+	end := time.Unix(2000, 0)
+	query := ingressQuery(map[string]bool{"istio-ingressgateway": true})
+	srv := fakeProm(t, start, []promSeries{
+		{
+			// also reported by the gateway, if it records destination_locality
+			query: localityQuery,
+			labels: map[string]string{
+				"source_workload": "istio-ingressgateway", "locality": "us-west1-a",
+				"destination_workload": "productpage-v1", "destination_locality": "us-west1-b",
+			},
+			start: 0,
+			end:   300,
+		},
+		{
+			query: query,
+			labels: map[string]string{
+				"source_workload": "istio-ingressgateway", "locality": "us-west1-b",
+				"destination_workload": "productpage-v1", "destination_service": "productpage.default.svc.cluster.local",
+			},
+			start: 0,
+			end:   300,
+		},
+		{
+			query: query,
+			labels: map[string]string{
+				"source_workload": "istio-ingressgateway", "locality": "us-west1-c",
+				"destination_workload": "reviews-v1", "destination_service": "reviews.default.svc.cluster.local",
+				"request_host": "reviews.example.com",
+			},
+			start: 0,
+			end:   100,
+		},
+	})
+	defer srv.Close()
+	prom, err := NewAnalyzerProm(srv.URL, "gcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prom.SetIngressGateways([]string{"istio-ingressgateway"})
+	calls, err := prom.GetCalls(&start, &end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []*Call{
+		{FromWorkload: "istio-ingressgateway", To: "us-west1-b", ToWorkload: "productpage-v1", CallSize: 300, Kind: IngressGatewayCall, Host: "productpage.default.svc.cluster.local"},
+		{FromWorkload: "istio-ingressgateway", To: "us-west1-c", ToWorkload: "reviews-v1", CallSize: 100, Kind: IngressGatewayCall, Host: "reviews.example.com"},
+	}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("GetCalls() = %v, want %v", calls, expected)
+	}
+}
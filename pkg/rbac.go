@@ -0,0 +1,165 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	v13 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// names of the roles the webhook is bound to, besides ClusterRoleName for nodes. Each is
+// bound by a binding of the same name.
+const (
+	WebhookConfigurationRoleName = "cost-analyzer-webhook-configuration"
+	WorkloadRoleName             = "cost-analyzer-workloads"
+)
+
+// nodeRules let the webhook watch the zone or region of the nodes pods run on, and whether
+// namespaces are exempt.
+var nodeRules = []v13.PolicyRule{
+	{APIGroups: []string{""}, Resources: []string{"nodes"}, Verbs: []string{"get", "list", "watch"}},
+	{APIGroups: []string{""}, Resources: []string{"namespaces"}, Verbs: []string{"get", "list", "watch"}},
+}
+
+// webhookConfigurationRules let the webhook fill in the caBundle of its
+// MutatingWebhookConfiguration, and create it if it was deployed without setup. Kubernetes
+// can't restrict creating an object to a name.
+var webhookConfigurationRules = []v13.PolicyRule{
+	{APIGroups: []string{"admissionregistration.k8s.io"}, Resources: []string{"mutatingwebhookconfigurations"}, Verbs: []string{"create"}},
+	{APIGroups: []string{"admissionregistration.k8s.io"}, Resources: []string{"mutatingwebhookconfigurations"}, Verbs: []string{"get", "update"}, ResourceNames: []string{WebhookConfigurationName}},
+}
+
+// workloadRules let the webhook annotate the existing workloads of kinds in the namespaces
+// it handles, wait for their rollouts, and label their pods with the locality of their
+// node. Immutable kinds are only handled when they're created, so they aren't listed.
+func workloadRules(kinds []WorkloadKind) []v13.PolicyRule {
+	rules := make([]v13.PolicyRule, 0)
+	// a rule per group
+	byGroup := map[string]int{}
+	for _, kind := range kinds {
+		if kind.Immutable {
+			continue
+		}
+		i, ok := byGroup[kind.Group]
+		if !ok {
+			i = len(rules)
+			byGroup[kind.Group] = i
+			rules = append(rules, v13.PolicyRule{APIGroups: []string{kind.Group}, Verbs: []string{"get", "list", "patch"}})
+		}
+		rules[i].Resources = append(rules[i].Resources, kind.Resource)
+	}
+	return append(rules, v13.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list", "watch", "patch"}})
+}
+
+// setRBAC sets the roles of the webhook for cfg: read-only access to nodes and namespaces,
+// access to its own MutatingWebhookConfiguration, to the Secret of its certificate unless
+// cert-manager issues it, to the Lease and report of the backfill if it's enabled, and
+// access to workloads in the target namespaces, or in all namespaces if there are none.
+func (s *SetupObjects) setRBAC(cfg SetupConfig) {
+	s.addClusterRole(ClusterRoleName, ClusterRoleBindingName, nodeRules, cfg.AnalyzerNamespace)
+	s.addClusterRole(WebhookConfigurationRoleName, WebhookConfigurationRoleName, webhookConfigurationRules, cfg.AnalyzerNamespace)
+	if !cfg.CertManager {
+		s.addRole(CertSecretRoleName, cfg.AnalyzerNamespace, certSecretRules, cfg.AnalyzerNamespace)
+	}
+	if s.backfill {
+		s.addRole(BackfillRoleName, cfg.AnalyzerNamespace, backfillRules, cfg.AnalyzerNamespace)
+	}
+	if len(s.Namespaces) == 0 {
+		s.addClusterRole(WorkloadRoleName, WorkloadRoleName, workloadRules(s.WorkloadKinds), cfg.AnalyzerNamespace)
+		return
+	}
+	for _, n := range s.Namespaces {
+		s.addRole(WorkloadRoleName, n.Name, workloadRules(s.WorkloadKinds), cfg.AnalyzerNamespace)
+	}
+}
+
+// addRole adds a role in namespace, and binds the service account in saNamespace to it
+// with a binding of the same name.
+func (s *SetupObjects) addRole(name, namespace string, rules []v13.PolicyRule, saNamespace string) {
+	s.Roles = append(s.Roles, &v13.Role{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		Rules:      rules,
+	})
+	s.RoleBindings = append(s.RoleBindings, &v13.RoleBinding{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace},
+		RoleRef:    v13.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "Role", Name: name},
+		Subjects:   []v13.Subject{{Kind: "ServiceAccount", Name: ServiceAccountName, Namespace: saNamespace}},
+	})
+}
+
+func (s *SetupObjects) addClusterRole(name, bindingName string, rules []v13.PolicyRule, namespace string) {
+	s.ClusterRoles = append(s.ClusterRoles, &v13.ClusterRole{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Rules:      rules,
+	})
+	s.ClusterRoleBindings = append(s.ClusterRoleBindings, &v13.ClusterRoleBinding{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+		ObjectMeta: metav1.ObjectMeta{Name: bindingName},
+		RoleRef:    v13.RoleRef{APIGroup: "rbac.authorization.k8s.io", Kind: "ClusterRole", Name: name},
+		Subjects:   []v13.Subject{{Kind: "ServiceAccount", Name: ServiceAccountName, Namespace: namespace}},
+	})
+}
+
+// RBACManifests returns the manifests of the roles and bindings of the webhook.
+func (s *SetupObjects) RBACManifests() ([]Manifest, error) {
+	manifests, err := s.Manifests()
+	if err != nil {
+		return nil, err
+	}
+	rbac := make([]Manifest, 0)
+	for _, m := range manifests {
+		if m.Resource.Group == v13.GroupName {
+			rbac = append(rbac, m)
+		}
+	}
+	return rbac, nil
+}
+
+// PrintRBAC writes the permissions of the webhook's service account, by role.
+func PrintRBAC(w io.Writer, s *SetupObjects) {
+	fmt.Fprintf(w, "service account %v/%v:\n", s.ServiceAccount.Namespace, s.ServiceAccount.Name)
+	for _, r := range s.ClusterRoles {
+		fmt.Fprintf(w, "  ClusterRole %v, in all namespaces:\n", r.Name)
+		printRules(w, r.Rules)
+	}
+	for _, r := range s.Roles {
+		fmt.Fprintf(w, "  Role %v, in namespace %v:\n", r.Name, r.Namespace)
+		printRules(w, r.Rules)
+	}
+}
+
+func printRules(w io.Writer, rules []v13.PolicyRule) {
+	for _, rule := range rules {
+		for _, group := range rule.APIGroups {
+			for _, resource := range rule.Resources {
+				if group != "" {
+					resource = group + "/" + resource
+				}
+				fmt.Fprintf(w, "    %v %v", strings.Join(rule.Verbs, ", "), resource)
+				if len(rule.ResourceNames) != 0 {
+					fmt.Fprintf(w, " named %v", strings.Join(rule.ResourceNames, ", "))
+				}
+				fmt.Fprintln(w)
+			}
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSetupObjects_RBAC(t *testing.T) {
+	tests := []struct {
+		name          string
+		targets       []string
+		wantRoles     []string
+		wantWorkloads bool
+	}{
+		{
+			name:      "target namespaces",
+			targets:   []string{"default", "shop"},
+			wantRoles: []string{"istio-system/cost-analyzer-webhook-certs", "default/cost-analyzer-workloads", "shop/cost-analyzer-workloads"},
+		},
+		{
+			name:          "all namespaces",
+			wantRoles:     []string{"istio-system/cost-analyzer-webhook-certs"},
+			wantWorkloads: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, err := NewSetupObjects(SetupConfig{AnalyzerNamespace: "istio-system", TargetNamespaces: tt.targets})
+			if err != nil {
+				t.Fatal(err)
+			}
+			roles := make([]string, 0)
+			for _, r := range objects.Roles {
+				roles = append(roles, r.Namespace+"/"+r.Name)
+			}
+			if !reflect.DeepEqual(roles, tt.wantRoles) {
+				t.Errorf("roles in %v, want %v", roles, tt.wantRoles)
+			}
+			workloads := false
+			for _, r := range objects.ClusterRoles {
+				for _, rule := range r.Rules {
+					for _, verb := range rule.Verbs {
+						// only reading and creating can't be restricted to names
+						readOnly := verb == "get" || verb == "list" || verb == "watch"
+						if r.Name != WorkloadRoleName && !readOnly && verb != "create" && len(rule.ResourceNames) == 0 {
+							t.Errorf("cluster role %v can %v %v of any name", r.Name, verb, rule.Resources)
+						}
+					}
+				}
+				workloads = workloads || r.Name == WorkloadRoleName
+			}
+			if workloads != tt.wantWorkloads {
+				t.Errorf("workloads cluster role = %v, want %v", workloads, tt.wantWorkloads)
+			}
+			out := &bytes.Buffer{}
+			PrintRBAC(out, objects)
+			if !strings.Contains(out.String(), "get, update admissionregistration.k8s.io/mutatingwebhookconfigurations named "+WebhookConfigurationName) {
+				t.Errorf("unexpected output:\n%v", out)
+			}
+		})
+	}
+}
+
+func TestSetupRecord_Stale(t *testing.T) {
+	before, err := NewSetupObjects(SetupConfig{AnalyzerNamespace: "istio-system", TargetNamespaces: []string{"default", "shop"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifests, err := before.Manifests()
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &SetupRecord{}
+	for _, m := range manifests {
+		if m.Object.GetKind() != "Namespace" {
+			record.AddCreated(RefOf(m))
+		}
+	}
+	after, err := NewSetupObjects(SetupConfig{AnalyzerNamespace: "istio-system", TargetNamespaces: []string{"default"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifests, err = after.Manifests(); err != nil {
+		t.Fatal(err)
+	}
+	stale := make([]string, 0)
+	for _, ref := range record.Stale(manifests) {
+		stale = append(stale, ref.String())
+	}
+	want := []string{"roles shop/cost-analyzer-workloads", "rolebindings shop/cost-analyzer-workloads"}
+	if !reflect.DeepEqual(stale, want) {
+		t.Errorf("Stale() = %v, want %v", stale, want)
+	}
+}
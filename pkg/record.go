@@ -0,0 +1,209 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+// SetupRecordName is the ConfigMap in the analyzer namespace recording what setup changed,
+// so destroy reverts exactly that.
+const SetupRecordName = "cost-analyzer-setup"
+
+// MutatedAnnotation marks the workloads and pods the webhook changed. On a workload, like a
+// Deployment, it means the webhook added the extraStatTags annotation to its pod template; on
+// a pod, that it added the locality label and extraStatTags annotation. The webhook sets the
+// same key.
+const MutatedAnnotation = "cost-analyzer.tetrate.io/mutated"
+
+// ObjectRef identifies an object setup created.
+type ObjectRef struct {
+	Group     string `json:"group,omitempty"`
+	Version   string `json:"version"`
+	Resource  string `json:"resource"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+}
+
+// SetupRecord is what setup changed in the cluster.
+type SetupRecord struct {
+	// Created are the objects setup created, in the order it created them. Objects that
+	// already existed aren't included.
+	Created []ObjectRef `json:"created,omitempty"`
+	// LabelledNamespaces are the namespaces setup added the analysis label to.
+	LabelledNamespaces []string `json:"labelledNamespaces,omitempty"`
+	// Generated are the objects created for setup at runtime rather than by it, like the
+	// Secret of the webhook's certificate. They're deleted with what setup created.
+	Generated []ObjectRef `json:"generated,omitempty"`
+	// Operator is the IstioOperator setup added destination_locality to, if it did.
+	Operator *ObjectRef `json:"operator,omitempty"`
+	// WorkloadKinds are the kinds of workloads the webhook was set up to handle, so destroy
+	// reverts those it changed, even if they aren't handled anymore.
+	WorkloadKinds []WorkloadKind `json:"workloadKinds,omitempty"`
+	// Applied are hashes of the manifests setup last applied, by object, to tell edits
+	// made outside setup from changes to the setup options.
+	Applied map[string]string `json:"applied,omitempty"`
+}
+
+// RefOf returns the reference to the object of a manifest.
+func RefOf(m Manifest) ObjectRef {
+	return ObjectRef{
+		Group:     m.Resource.Group,
+		Version:   m.Resource.Version,
+		Resource:  m.Resource.Resource,
+		Namespace: m.Object.GetNamespace(),
+		Name:      m.Object.GetName(),
+	}
+}
+
+// OperatorRef returns the reference to an IstioOperator.
+func OperatorRef(name, namespace string) ObjectRef {
+	return ObjectRef{
+		Group:     iopResource.Group,
+		Version:   iopResource.Version,
+		Resource:  iopResource.Resource,
+		Namespace: namespace,
+		Name:      name,
+	}
+}
+
+// GroupVersionResource returns the resource of the object.
+func (r ObjectRef) GroupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: r.Group, Version: r.Version, Resource: r.Resource}
+}
+
+func (r ObjectRef) String() string {
+	if r.Namespace != "" {
+		return fmt.Sprintf("%v %v/%v", r.Resource, r.Namespace, r.Name)
+	}
+	return fmt.Sprintf("%v %v", r.Resource, r.Name)
+}
+
+// AddCreated records that setup created an object, unless it's already recorded.
+func (r *SetupRecord) AddCreated(ref ObjectRef) {
+	for _, c := range r.Created {
+		if c == ref {
+			return
+		}
+	}
+	r.Created = append(r.Created, ref)
+}
+
+// RemoveCreated records that an object setup created was deleted.
+func (r *SetupRecord) RemoveCreated(ref ObjectRef) {
+	delete(r.Applied, ref.String())
+	for i, c := range r.Created {
+		if c == ref {
+			r.Created = append(r.Created[:i], r.Created[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddGenerated records that an object is created for setup at runtime, unless it's already
+// recorded.
+func (r *SetupRecord) AddGenerated(ref ObjectRef) {
+	for _, g := range r.Generated {
+		if g == ref {
+			return
+		}
+	}
+	r.Generated = append(r.Generated, ref)
+}
+
+// AddWorkloadKind records that the webhook handles a kind of workloads, unless it's already
+// recorded.
+func (r *SetupRecord) AddWorkloadKind(kind WorkloadKind) {
+	for _, k := range r.WorkloadKinds {
+		if k == kind {
+			return
+		}
+	}
+	r.WorkloadKinds = append(r.WorkloadKinds, kind)
+}
+
+// AddLabelledNamespace records that setup labelled a namespace, unless it's already recorded.
+func (r *SetupRecord) AddLabelledNamespace(namespace string) {
+	for _, n := range r.LabelledNamespaces {
+		if n == namespace {
+			return
+		}
+	}
+	r.LabelledNamespaces = append(r.LabelledNamespaces, namespace)
+}
+
+// RemoveLabelledNamespace records that a namespace setup labelled was unlabelled.
+func (r *SetupRecord) RemoveLabelledNamespace(namespace string) {
+	for i, n := range r.LabelledNamespaces {
+		if n == namespace {
+			r.LabelledNamespaces = append(r.LabelledNamespaces[:i], r.LabelledNamespaces[i+1:]...)
+			return
+		}
+	}
+}
+
+// LoadSetupRecord reads the setup record in namespace. It returns nil if there is none.
+func (k *KubeClient) LoadSetupRecord(namespace string) (*SetupRecord, error) {
+	cm, err := k.clientSet.CoreV1().ConfigMaps(namespace).Get(context.TODO(), SetupRecordName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	record := &SetupRecord{}
+	if err := json.Unmarshal([]byte(cm.Data["record"]), record); err != nil {
+		fmt.Printf("unable to unmarshal setup record: %v\n", err)
+		return nil, err
+	}
+	return record, nil
+}
+
+// SaveSetupRecord writes the setup record to namespace, replacing the one there.
+func (k *KubeClient) SaveSetupRecord(namespace string, record *SetupRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	cm := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      SetupRecordName,
+			Namespace: namespace,
+			Labels:    map[string]string{"app": "cost-analyzer"},
+		},
+		Data: map[string]string{"record": string(data)},
+	}
+	_, err = k.clientSet.CoreV1().ConfigMaps(namespace).Update(context.TODO(), cm, metav1.UpdateOptions{})
+	if apierrors.IsNotFound(err) {
+		_, err = k.clientSet.CoreV1().ConfigMaps(namespace).Create(context.TODO(), cm, metav1.CreateOptions{})
+	}
+	return err
+}
+
+// DeleteSetupRecord deletes the setup record in namespace, if there is one.
+func (k *KubeClient) DeleteSetupRecord(namespace string) error {
+	err := k.clientSet.CoreV1().ConfigMaps(namespace).Delete(context.TODO(), SetupRecordName, metav1.DeleteOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,228 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+
+	telemetryapi "istio.io/api/telemetry/v1alpha1"
+	telemetryv1alpha1 "istio.io/client-go/pkg/apis/telemetry/v1alpha1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	// LocalityTelemetryName is the name of the Telemetry resource setup creates.
+	LocalityTelemetryName = "cost-analyzer-locality"
+	// localityTag is the tag added to istio's size metrics, with the locality of the
+	// destination pod, from the locality label the webhook adds to pods.
+	localityTag = "destination_locality"
+	// localityTagValue is the expression the tag is set from.
+	localityTagValue = "upstream_peer.labels['locality'].value"
+	// telemetryGroupVersion is the group version of the Telemetry API.
+	telemetryGroupVersion = "telemetry.istio.io/v1alpha1"
+)
+
+// localityMetrics are the metrics given a destination_locality tag, by their name in the
+// IstioOperator's telemetry config.
+var localityMetrics = map[string]telemetryapi.MetricSelector_IstioMetric{
+	"request_bytes":  telemetryapi.MetricSelector_REQUEST_SIZE,
+	"response_bytes": telemetryapi.MetricSelector_RESPONSE_SIZE,
+}
+
+var telemetryResource = schema.GroupVersionResource{Group: "telemetry.istio.io", Version: "v1alpha1", Resource: "telemetries"}
+
+// outboundMetricsPath is where the metric overrides of outbound sidecars are in an
+// IstioOperator.
+var outboundMetricsPath = []string{"spec", "values", "telemetry", "v2", "prometheus", "configOverride", "outboundSidecar", "metrics"}
+
+// TelemetryAPIAvailable returns whether the cluster serves istio's Telemetry API, which
+// istio 1.12 and later do, however it was installed.
+func (k *KubeClient) TelemetryAPIAvailable() (bool, error) {
+	resources, err := k.clientSet.Discovery().ServerResourcesForGroupVersion(telemetryGroupVersion)
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == "telemetries" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CheckMeshTelemetry returns an error if another Telemetry resource in the mesh's root
+// namespace applies to the whole mesh, since istio only uses one mesh-wide Telemetry, and
+// which one would be undefined once setup adds its own.
+func (k *KubeClient) CheckMeshTelemetry(namespace string) error {
+	list, err := k.dynamic.Resource(telemetryResource).Namespace(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, t := range list.Items {
+		if t.GetName() == LocalityTelemetryName {
+			continue
+		}
+		spec, _, _ := unstructured.NestedMap(t.Object, "spec")
+		if spec["selector"] != nil || spec["targetRef"] != nil || spec["targetRefs"] != nil {
+			continue
+		}
+		return fmt.Errorf("telemetry %v/%v already applies to the whole mesh, and istio only uses one mesh-wide telemetry: "+
+			"add a %v tag override with the value %q to its request and response size metrics of clients instead",
+			namespace, t.GetName(), localityTag, localityTagValue)
+	}
+	return nil
+}
+
+// localityTelemetry is the Telemetry resource adding the destination_locality tag to the
+// metrics reported by the client side of requests. namespace should be the mesh's root
+// namespace, usually istio-system, for it to apply to the whole mesh.
+func localityTelemetry(namespace string) *telemetryv1alpha1.Telemetry {
+	overrides := make([]*telemetryapi.MetricsOverrides, 0, len(localityMetrics))
+	for _, metric := range []telemetryapi.MetricSelector_IstioMetric{telemetryapi.MetricSelector_REQUEST_SIZE, telemetryapi.MetricSelector_RESPONSE_SIZE} {
+		overrides = append(overrides, &telemetryapi.MetricsOverrides{
+			Match: &telemetryapi.MetricSelector{
+				MetricMatch: &telemetryapi.MetricSelector_Metric{Metric: metric},
+				Mode:        telemetryapi.WorkloadMode_CLIENT,
+			},
+			TagOverrides: map[string]*telemetryapi.MetricsOverrides_TagOverride{
+				localityTag: {
+					Operation: telemetryapi.MetricsOverrides_TagOverride_UPSERT,
+					Value:     localityTagValue,
+				},
+			},
+		})
+	}
+	return &telemetryv1alpha1.Telemetry{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      LocalityTelemetryName,
+			Namespace: namespace,
+			Labels:    map[string]string{"app": "cost-analyzer"},
+		},
+		Spec: telemetryapi.Telemetry{
+			Metrics: []*telemetryapi.Metrics{{Overrides: overrides}},
+		},
+	}
+}
+
+// normalizeOperator adds the destination_locality dimension to the request_bytes and
+// response_bytes metrics of outbound sidecars in an IstioOperator, for meshes without the
+// Telemetry API. It returns whether res was changed, or an error if the telemetry config
+// isn't shaped like it should be.
+func normalizeOperator(res *unstructured.Unstructured) (bool, error) {
+	metrics, _, err := unstructured.NestedSlice(res.Object, outboundMetricsPath...)
+	if err != nil {
+		return false, err
+	}
+	changed := false
+	seen := make(map[string]bool)
+	for _, m := range metrics {
+		metric, ok := m.(map[string]interface{})
+		if !ok {
+			return false, fmt.Errorf("unexpected outbound metric override %v", m)
+		}
+		name, _ := metric["name"].(string)
+		if _, ok := localityMetrics[name]; !ok {
+			continue
+		}
+		seen[name] = true
+		dimensions, err := metricDimensions(metric)
+		if err != nil {
+			return false, err
+		}
+		if dimensions[localityTag] == localityTagValue {
+			continue
+		}
+		dimensions[localityTag] = localityTagValue
+		metric["dimensions"] = dimensions
+		changed = true
+	}
+	for _, name := range []string{"request_bytes", "response_bytes"} {
+		if seen[name] {
+			continue
+		}
+		metrics = append(metrics, map[string]interface{}{
+			"name":       name,
+			"dimensions": map[string]interface{}{localityTag: localityTagValue},
+		})
+		changed = true
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, unstructured.SetNestedSlice(res.Object, metrics, outboundMetricsPath...)
+}
+
+// denormalizeOperator removes the destination_locality dimension normalizeOperator added,
+// leaving the rest of the telemetry config alone. It returns whether res was changed.
+func denormalizeOperator(res *unstructured.Unstructured) (bool, error) {
+	metrics, found, err := unstructured.NestedSlice(res.Object, outboundMetricsPath...)
+	if err != nil || !found {
+		return false, err
+	}
+	changed := false
+	kept := make([]interface{}, 0, len(metrics))
+	for _, m := range metrics {
+		metric, ok := m.(map[string]interface{})
+		if !ok {
+			return false, fmt.Errorf("unexpected outbound metric override %v", m)
+		}
+		name, _ := metric["name"].(string)
+		if _, ok := localityMetrics[name]; !ok {
+			kept = append(kept, m)
+			continue
+		}
+		dimensions, err := metricDimensions(metric)
+		if err != nil {
+			return false, err
+		}
+		if _, ok := dimensions[localityTag]; !ok {
+			kept = append(kept, m)
+			continue
+		}
+		delete(dimensions, localityTag)
+		metric["dimensions"] = dimensions
+		changed = true
+		// drop overrides that were only there for the locality
+		if len(dimensions) == 0 && len(metric) == 2 {
+			continue
+		}
+		kept = append(kept, metric)
+	}
+	if !changed {
+		return false, nil
+	}
+	return true, unstructured.SetNestedSlice(res.Object, kept, outboundMetricsPath...)
+}
+
+// metricDimensions returns the dimensions of a metric override, or an empty map if it has
+// none.
+func metricDimensions(metric map[string]interface{}) (map[string]interface{}, error) {
+	d, ok := metric["dimensions"]
+	if !ok || d == nil {
+		return make(map[string]interface{}), nil
+	}
+	dimensions, ok := d.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("unexpected dimensions of metric %v: %v", metric["name"], d)
+	}
+	return dimensions, nil
+}
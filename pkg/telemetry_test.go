@@ -0,0 +1,266 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	fakediscovery "k8s.io/client-go/discovery/fake"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testOperator(metrics interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{
+			"values": map[string]interface{}{
+				"telemetry": map[string]interface{}{
+					"v2": map[string]interface{}{
+						"prometheus": map[string]interface{}{
+							"configOverride": map[string]interface{}{
+								"outboundSidecar": map[string]interface{}{
+									"metrics": metrics,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}}
+}
+
+func TestNormalizeOperator(t *testing.T) {
+	locality := map[string]interface{}{localityTag: localityTagValue}
+	tests := []struct {
+		name        string
+		operator    *unstructured.Unstructured
+		wantChanged bool
+		wantErr     bool
+		wantMetrics []interface{}
+	}{
+		{
+			name:        "no spec",
+			operator:    &unstructured.Unstructured{Object: map[string]interface{}{}},
+			wantChanged: true,
+			wantMetrics: []interface{}{
+				map[string]interface{}{"name": "request_bytes", "dimensions": locality},
+				map[string]interface{}{"name": "response_bytes", "dimensions": locality},
+			},
+		},
+		{
+			name: "other overrides kept",
+			operator: testOperator([]interface{}{
+				map[string]interface{}{"name": "requests_total", "tags_to_remove": []interface{}{"request_protocol"}},
+				map[string]interface{}{"name": "request_bytes", "dimensions": map[string]interface{}{"source_zone": "node.metadata['LABELS']['zone']"}},
+			}),
+			wantChanged: true,
+			wantMetrics: []interface{}{
+				map[string]interface{}{"name": "requests_total", "tags_to_remove": []interface{}{"request_protocol"}},
+				map[string]interface{}{"name": "request_bytes", "dimensions": map[string]interface{}{"source_zone": "node.metadata['LABELS']['zone']", localityTag: localityTagValue}},
+				map[string]interface{}{"name": "response_bytes", "dimensions": locality},
+			},
+		},
+		{
+			name: "already normalized",
+			operator: testOperator([]interface{}{
+				map[string]interface{}{"name": "request_bytes", "dimensions": locality},
+				map[string]interface{}{"name": "response_bytes", "dimensions": locality},
+			}),
+			wantChanged: false,
+			wantMetrics: []interface{}{
+				map[string]interface{}{"name": "request_bytes", "dimensions": locality},
+				map[string]interface{}{"name": "response_bytes", "dimensions": locality},
+			},
+		},
+		{
+			name:     "metrics not a list",
+			operator: testOperator("request_bytes"),
+			wantErr:  true,
+		},
+		{
+			name:     "dimensions not a map",
+			operator: testOperator([]interface{}{map[string]interface{}{"name": "request_bytes", "dimensions": "destination_locality"}}),
+			wantErr:  true,
+		},
+		{
+			name:     "telemetry not a map",
+			operator: &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{"values": map[string]interface{}{"telemetry": true}}}},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, err := normalizeOperator(tt.operator)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("normalizeOperator() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("normalizeOperator() = %v, want %v", changed, tt.wantChanged)
+			}
+			metrics, _, _ := unstructured.NestedSlice(tt.operator.Object, outboundMetricsPath...)
+			if !reflect.DeepEqual(metrics, tt.wantMetrics) {
+				t.Errorf("metrics = %v, want %v", metrics, tt.wantMetrics)
+			}
+		})
+	}
+}
+
+func TestDenormalizeOperator(t *testing.T) {
+	tests := []struct {
+		name        string
+		operator    *unstructured.Unstructured
+		wantChanged bool
+		wantMetrics []interface{}
+	}{
+		{
+			name:     "not configured",
+			operator: &unstructured.Unstructured{Object: map[string]interface{}{"spec": map[string]interface{}{}}},
+		},
+		{
+			name: "only our dimension removed",
+			operator: testOperator([]interface{}{
+				map[string]interface{}{"name": "requests_total", "tags_to_remove": []interface{}{"request_protocol"}},
+				map[string]interface{}{"name": "request_bytes", "dimensions": map[string]interface{}{"source_zone": "node.metadata['LABELS']['zone']", localityTag: localityTagValue}},
+				map[string]interface{}{"name": "response_bytes", "dimensions": map[string]interface{}{localityTag: localityTagValue}},
+			}),
+			wantChanged: true,
+			wantMetrics: []interface{}{
+				map[string]interface{}{"name": "requests_total", "tags_to_remove": []interface{}{"request_protocol"}},
+				map[string]interface{}{"name": "request_bytes", "dimensions": map[string]interface{}{"source_zone": "node.metadata['LABELS']['zone']"}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			changed, err := denormalizeOperator(tt.operator)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if changed != tt.wantChanged {
+				t.Errorf("denormalizeOperator() = %v, want %v", changed, tt.wantChanged)
+			}
+			metrics, _, _ := unstructured.NestedSlice(tt.operator.Object, outboundMetricsPath...)
+			if !reflect.DeepEqual(metrics, tt.wantMetrics) {
+				t.Errorf("metrics = %v, want %v", metrics, tt.wantMetrics)
+			}
+		})
+	}
+}
+
+func TestTelemetryAPIAvailable(t *testing.T) {
+	tests := []struct {
+		name      string
+		resources []*metav1.APIResourceList
+		want      bool
+	}{
+		{
+			name: "no telemetry api",
+		},
+		{
+			name: "telemetry api",
+			resources: []*metav1.APIResourceList{{
+				GroupVersion: telemetryGroupVersion,
+				APIResources: []metav1.APIResource{{Name: "telemetries", Kind: "Telemetry", Namespaced: true}},
+			}},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientSet := fake.NewSimpleClientset()
+			clientSet.Discovery().(*fakediscovery.FakeDiscovery).Resources = tt.resources
+			k := &KubeClient{clientSet: clientSet}
+			got, err := k.TelemetryAPIAvailable()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("TelemetryAPIAvailable() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLocalityTelemetry(t *testing.T) {
+	telemetry := localityTelemetry("istio-system")
+	if telemetry.Name != LocalityTelemetryName || telemetry.Namespace != "istio-system" {
+		t.Errorf("telemetry = %v/%v, want istio-system/%v", telemetry.Namespace, telemetry.Name, LocalityTelemetryName)
+	}
+	if len(telemetry.Spec.Metrics) != 1 {
+		t.Fatalf("got %v metrics, want 1", len(telemetry.Spec.Metrics))
+	}
+	overrides := telemetry.Spec.Metrics[0].Overrides
+	if len(overrides) != 2 {
+		t.Fatalf("got %v overrides, want 2", len(overrides))
+	}
+	for _, o := range overrides {
+		if tag := o.TagOverrides[localityTag]; tag == nil || tag.Value != localityTagValue {
+			t.Errorf("override %v doesn't set %v", o.Match, localityTag)
+		}
+	}
+}
+
+func TestKubeClient_CheckMeshTelemetry(t *testing.T) {
+	telemetry := func(name string, spec map[string]interface{}) runtime.Object {
+		u := &unstructured.Unstructured{Object: map[string]interface{}{"spec": spec}}
+		u.SetAPIVersion(telemetryGroupVersion)
+		u.SetKind("Telemetry")
+		u.SetNamespace("istio-system")
+		u.SetName(name)
+		return u
+	}
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		wantErr bool
+	}{
+		{
+			name: "none",
+		},
+		{
+			name:    "ours",
+			objects: []runtime.Object{telemetry(LocalityTelemetryName, map[string]interface{}{})},
+		},
+		{
+			name: "workload telemetry",
+			objects: []runtime.Object{telemetry("ingress", map[string]interface{}{
+				"selector": map[string]interface{}{"matchLabels": map[string]interface{}{"app": "istio-ingressgateway"}},
+			})},
+		},
+		{
+			name:    "mesh-wide telemetry",
+			objects: []runtime.Object{telemetry("mesh-default", map[string]interface{}{"tracing": []interface{}{}})},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			k := &KubeClient{dynamic: dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+				map[schema.GroupVersionResource]string{telemetryResource: "TelemetryList"}, tt.objects...)}
+			if err := k.CheckMeshTelemetry("istio-system"); (err != nil) != tt.wantErr {
+				t.Errorf("CheckMeshTelemetry() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"context"
+	"fmt"
+	"github.com/olekukonko/tablewriter"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	zoneLabel   = "topology.kubernetes.io/zone"
+	regionLabel = "topology.kubernetes.io/region"
+)
+
+// WorkloadTopology is where the running replicas of a workload are.
+type WorkloadTopology struct {
+	Namespace string
+	Workload  string
+	// Zones and Regions hold the number of running replicas by the zone and region of
+	// their nodes.
+	Zones   map[string]int
+	Regions map[string]int
+	// UnservedCallers holds the bytes sent to the workload by callers in localities it
+	// has no replicas in, by caller locality. That traffic has to cross zones or regions.
+	UnservedCallers map[string]uint64
+}
+
+// Replicas returns the number of running replicas of the workload.
+func (w *WorkloadTopology) Replicas() int {
+	replicas := 0
+	for _, n := range w.Zones {
+		replicas += n
+	}
+	return replicas
+}
+
+// serves is whether the workload has replicas in locality, which is a zone or a region
+// depending on the cloud.
+func (w *WorkloadTopology) serves(locality string) bool {
+	return w.Zones[locality] > 0 || w.Regions[locality] > 0
+}
+
+// WorkloadTopologies lists the running pods in namespace (or all namespaces if it's empty),
+// and returns where the replicas of each workload run, sorted by namespace and workload.
+func (k *KubeClient) WorkloadTopologies(namespace string) ([]*WorkloadTopology, error) {
+	nodes, err := k.clientSet.CoreV1().Nodes().List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		fmt.Printf("unable to list nodes: %v\n", err)
+		return nil, err
+	}
+	nodeLabels := make(map[string]map[string]string, len(nodes.Items))
+	for _, n := range nodes.Items {
+		nodeLabels[n.Name] = n.Labels
+	}
+	pods, err := k.clientSet.CoreV1().Pods(namespace).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		fmt.Printf("unable to list pods: %v\n", err)
+		return nil, err
+	}
+	topologies := make([]*WorkloadTopology, 0)
+	byWorkload := make(map[string]*WorkloadTopology)
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != v1.PodRunning || pod.Spec.NodeName == "" {
+			continue
+		}
+		workload := PodWorkloadName(pod)
+		key := pod.Namespace + "/" + workload
+		t, ok := byWorkload[key]
+		if !ok {
+			t = &WorkloadTopology{
+				Namespace: pod.Namespace,
+				Workload:  workload,
+				Zones:     make(map[string]int),
+				Regions:   make(map[string]int),
+			}
+			byWorkload[key] = t
+			topologies = append(topologies, t)
+		}
+		labels := nodeLabels[pod.Spec.NodeName]
+		t.Zones[labels[zoneLabel]]++
+		t.Regions[labels[regionLabel]]++
+	}
+	sort.Slice(topologies, func(i, j int) bool {
+		if topologies[i].Namespace != topologies[j].Namespace {
+			return topologies[i].Namespace < topologies[j].Namespace
+		}
+		return topologies[i].Workload < topologies[j].Workload
+	})
+	return topologies, nil
+}
+
+// jobTimestamp matches the scheduled time suffix of Jobs created by a CronJob.
+var jobTimestamp = regexp.MustCompile(`-\d+$`)
+
+// PodWorkloadName returns the workload name Istio reports for a pod: the name of its
+// controller, with the hash of a ReplicaSet or the timestamp of a CronJob's Job trimmed.
+func PodWorkloadName(pod *v1.Pod) string {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return pod.Name
+	}
+	switch owner.Kind {
+	case "ReplicaSet":
+		if hash, ok := pod.Labels["pod-template-hash"]; ok {
+			return strings.TrimSuffix(owner.Name, "-"+hash)
+		}
+	case "Job":
+		return jobTimestamp.ReplaceAllString(owner.Name, "")
+	}
+	return owner.Name
+}
+
+// FlagUnservedCallers records, for each workload, the traffic it received from callers in
+// localities where it has no replicas.
+func FlagUnservedCallers(topologies []*WorkloadTopology, calls []*Call) {
+	byWorkload := make(map[string]*WorkloadTopology, len(topologies))
+	for _, t := range topologies {
+		byWorkload[t.Namespace+"/"+t.Workload] = t
+		// calls without a namespace can only be matched on the workload name
+		if _, ok := byWorkload["/"+t.Workload]; !ok {
+			byWorkload["/"+t.Workload] = t
+		}
+	}
+	for _, c := range calls {
+		if c.Kind == InternetCall || c.From == "" {
+			continue
+		}
+		t, ok := byWorkload[c.ToNamespace+"/"+c.ToWorkload]
+		if !ok || t.serves(c.From) {
+			continue
+		}
+		if t.UnservedCallers == nil {
+			t.UnservedCallers = make(map[string]uint64)
+		}
+		t.UnservedCallers[c.From] += c.CallSize
+	}
+}
+
+// PrintTopologyTable prints the replica spread of each workload across zones, and the
+// caller localities it has no replicas in, if any.
+func PrintTopologyTable(topologies []*WorkloadTopology) {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Namespace", "Workload", "Replicas", "Zones", "Regions", "Callers In Zones Without Replicas"})
+	for _, t := range topologies {
+		unserved := make([]string, 0, len(t.UnservedCallers))
+		for locality, size := range t.UnservedCallers {
+			unserved = append(unserved, fmt.Sprintf("%v (%f MB)", locality, float64(size)/math.Pow(10, 6)))
+		}
+		sort.Strings(unserved)
+		table.Append([]string{
+			t.Namespace,
+			t.Workload,
+			fmt.Sprintf("%v", t.Replicas()),
+			formatSpread(t.Zones),
+			formatSpread(t.Regions),
+			strings.Join(unserved, ", "),
+		})
+	}
+	kubernetesify(table)
+	table.Render()
+	fmt.Println()
+}
+
+// formatSpread formats replica counts by zone or region, like us-west1-a: 2, us-west1-b: 1.
+func formatSpread(spread map[string]int) string {
+	names := make([]string, 0, len(spread))
+	for name := range spread {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		label := name
+		if label == "" {
+			label = "unknown"
+		}
+		parts = append(parts, fmt.Sprintf("%v: %v", label, spread[name]))
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,106 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testNode(name, zone string) *v1.Node {
+	return &v1.Node{ObjectMeta: metav1.ObjectMeta{
+		Name:   name,
+		Labels: map[string]string{zoneLabel: zone, regionLabel: localityRegion(zone)},
+	}}
+}
+
+// testPod returns a running pod on node, controlled by ownerKind/owner.
+func testPod(name, node, ownerKind, owner string, labels map[string]string) *v1.Pod {
+	controller := true
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "default",
+			Labels:    labels,
+			OwnerReferences: []metav1.OwnerReference{
+				{Kind: ownerKind, Name: owner, Controller: &controller},
+			},
+		},
+		Spec:   v1.PodSpec{NodeName: node},
+		Status: v1.PodStatus{Phase: v1.PodRunning},
+	}
+}
+
+func TestPodWorkloadName(t *testing.T) {
+	tests := []struct {
+		name string
+		pod  *v1.Pod
+		want string
+	}{
+		{"deployment", testPod("reviews-v1-5d8c7-x2k4p", "", "ReplicaSet", "reviews-v1-5d8c7", map[string]string{"pod-template-hash": "5d8c7"}), "reviews-v1"},
+		{"cronjob", testPod("backup-27623470-h8w2q", "", "Job", "backup-27623470", nil), "backup"},
+		{"statefulset", testPod("db-0", "", "StatefulSet", "db", nil), "db"},
+		{"bare pod", &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "debug"}}, "debug"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PodWorkloadName(tt.pod); got != tt.want {
+				t.Errorf("PodWorkloadName() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestKubeClient_WorkloadTopologies(t *testing.T) {
+	pending := testPod("ratings-v1-7c9d-pending", "", "ReplicaSet", "ratings-v1-7c9d", map[string]string{"pod-template-hash": "7c9d"})
+	pending.Status.Phase = v1.PodPending
+	k := &KubeClient{clientSet: fake.NewSimpleClientset(
+		testNode("node-a", "us-west1-a"),
+		testNode("node-b", "us-west1-b"),
+		testPod("reviews-v1-5d8c7-1", "node-a", "ReplicaSet", "reviews-v1-5d8c7", map[string]string{"pod-template-hash": "5d8c7"}),
+		testPod("reviews-v1-5d8c7-2", "node-a", "ReplicaSet", "reviews-v1-5d8c7", map[string]string{"pod-template-hash": "5d8c7"}),
+		testPod("ratings-v1-7c9d-1", "node-b", "ReplicaSet", "ratings-v1-7c9d", map[string]string{"pod-template-hash": "7c9d"}),
+		pending,
+	)}
+	topologies, err := k.WorkloadTopologies("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	FlagUnservedCallers(topologies, []*Call{
+		{From: "us-west1-b", FromWorkload: "productpage-v1", To: "us-west1-a", ToWorkload: "reviews-v1", ToNamespace: "default", CallSize: 100},
+		{From: "us-west1-a", FromWorkload: "productpage-v1", To: "us-west1-a", ToWorkload: "reviews-v1", ToNamespace: "default", CallSize: 100},
+		// no namespace reported
+		{From: "us-west1-b", FromWorkload: "productpage-v1", To: "us-west1-a", ToWorkload: "reviews-v1", CallSize: 50},
+		{From: "us-west1-b", FromWorkload: "reviews-v1", To: "us-west1-b", ToWorkload: "ratings-v1", ToNamespace: "default", CallSize: 100},
+	})
+	expected := []*WorkloadTopology{
+		{
+			Namespace: "default", Workload: "ratings-v1",
+			Zones: map[string]int{"us-west1-b": 1}, Regions: map[string]int{"us-west1": 1},
+		},
+		{
+			Namespace: "default", Workload: "reviews-v1",
+			Zones: map[string]int{"us-west1-a": 2}, Regions: map[string]int{"us-west1": 2},
+			UnservedCallers: map[string]uint64{"us-west1-b": 150},
+		},
+	}
+	if !reflect.DeepEqual(topologies, expected) {
+		t.Errorf("WorkloadTopologies() = %v, want %v", topologies, expected)
+	}
+}
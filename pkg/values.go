@@ -0,0 +1,207 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	v12 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// WebhookValues customizes the webhook Deployment and MutatingWebhookConfiguration, like the
+// values of a helm chart. Fields left empty keep the defaults.
+type WebhookValues struct {
+	// Image is the webhook server image, like registry.example.com/webhook@sha256:...
+	Image string `json:"image,omitempty"`
+	// CAImage is the image of the init container generating the webhook's certificate.
+	CAImage string `json:"caImage,omitempty"`
+	// ImagePullPolicy of both containers. It defaults to IfNotPresent for images pinned
+	// to a digest, and to Always otherwise.
+	ImagePullPolicy v1.PullPolicy `json:"imagePullPolicy,omitempty"`
+	// ImagePullSecrets are the names of the secrets in the analyzer namespace to pull the
+	// images with.
+	ImagePullSecrets []string `json:"imagePullSecrets,omitempty"`
+	Replicas         *int32   `json:"replicas,omitempty"`
+	// Resources of both containers.
+	Resources          *v1.ResourceRequirements `json:"resources,omitempty"`
+	NodeSelector       map[string]string        `json:"nodeSelector,omitempty"`
+	Tolerations        []v1.Toleration          `json:"tolerations,omitempty"`
+	PriorityClassName  string                   `json:"priorityClassName,omitempty"`
+	PodSecurityContext *v1.PodSecurityContext   `json:"podSecurityContext,omitempty"`
+	// FailurePolicy is what the API server does when it can't call the webhook: Ignore, the
+	// default, creates the Deployment without the stat tag, and Fail rejects it.
+	FailurePolicy admissionregistrationv1.FailurePolicyType `json:"failurePolicy,omitempty"`
+	// TimeoutSeconds is how long the API server waits for the webhook, from 1 to 30.
+	TimeoutSeconds *int32 `json:"timeoutSeconds,omitempty"`
+	// ObjectSelector selects the Deployments the webhook handles by their labels. It
+	// defaults to those without the ExcludeLabel.
+	ObjectSelector *metav1.LabelSelector `json:"objectSelector,omitempty"`
+	// WorkloadKinds are kinds of workloads the webhook handles besides the
+	// DefaultWorkloadKinds, like Argo Rollouts.
+	WorkloadKinds []WorkloadKind `json:"workloadKinds,omitempty"`
+	// Backfill configures annotating the workloads that exist when the webhook starts.
+	Backfill BackfillValues `json:"backfill,omitempty"`
+}
+
+// LoadWebhookValues reads the webhook values in the yaml file at path.
+func LoadWebhookValues(path string) (WebhookValues, error) {
+	values := WebhookValues{}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("unable to read file %v: %v", path, err)
+		return values, err
+	}
+	if err := yaml.UnmarshalStrict(data, &values); err != nil {
+		fmt.Printf("unable to unmarshal yaml into object: %v", err)
+		return values, err
+	}
+	return values, nil
+}
+
+// Override sets the fields set in o, like values given as flags over a values file.
+func (v *WebhookValues) Override(o WebhookValues) {
+	if o.Image != "" {
+		v.Image = o.Image
+	}
+	if o.CAImage != "" {
+		v.CAImage = o.CAImage
+	}
+	if o.ImagePullPolicy != "" {
+		v.ImagePullPolicy = o.ImagePullPolicy
+	}
+	if len(o.ImagePullSecrets) != 0 {
+		v.ImagePullSecrets = o.ImagePullSecrets
+	}
+	if o.Replicas != nil {
+		v.Replicas = o.Replicas
+	}
+	if o.Resources != nil {
+		v.Resources = o.Resources
+	}
+	if len(o.NodeSelector) != 0 {
+		v.NodeSelector = o.NodeSelector
+	}
+	if len(o.Tolerations) != 0 {
+		v.Tolerations = o.Tolerations
+	}
+	if o.PriorityClassName != "" {
+		v.PriorityClassName = o.PriorityClassName
+	}
+	if o.PodSecurityContext != nil {
+		v.PodSecurityContext = o.PodSecurityContext
+	}
+	if o.FailurePolicy != "" {
+		v.FailurePolicy = o.FailurePolicy
+	}
+	if o.TimeoutSeconds != nil {
+		v.TimeoutSeconds = o.TimeoutSeconds
+	}
+	if o.ObjectSelector != nil {
+		v.ObjectSelector = o.ObjectSelector
+	}
+	if len(o.WorkloadKinds) != 0 {
+		v.WorkloadKinds = o.WorkloadKinds
+	}
+	v.Backfill.Override(o.Backfill)
+}
+
+func (v WebhookValues) validate() error {
+	switch v.ImagePullPolicy {
+	case "", v1.PullAlways, v1.PullIfNotPresent, v1.PullNever:
+	default:
+		return fmt.Errorf("unknown imagePullPolicy %q, must be Always, IfNotPresent or Never", v.ImagePullPolicy)
+	}
+	if v.Replicas != nil && *v.Replicas < 1 {
+		return fmt.Errorf("the webhook must have at least 1 replica, got %v", *v.Replicas)
+	}
+	switch v.FailurePolicy {
+	case "", admissionregistrationv1.Ignore, admissionregistrationv1.Fail:
+	default:
+		return fmt.Errorf("unknown failurePolicy %q, must be Ignore or Fail", v.FailurePolicy)
+	}
+	if v.TimeoutSeconds != nil && (*v.TimeoutSeconds < 1 || *v.TimeoutSeconds > 30) {
+		return fmt.Errorf("timeoutSeconds must be from 1 to 30, got %v", *v.TimeoutSeconds)
+	}
+	if v.ObjectSelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(v.ObjectSelector); err != nil {
+			return fmt.Errorf("invalid objectSelector: %v", err)
+		}
+	}
+	for _, kind := range v.WorkloadKinds {
+		if err := kind.validate(); err != nil {
+			return err
+		}
+	}
+	return v.Backfill.validate()
+}
+
+// apply customizes the webhook deployment with v.
+func (v WebhookValues) apply(deployment *v12.Deployment) error {
+	if err := v.validate(); err != nil {
+		return err
+	}
+	spec := &deployment.Spec.Template.Spec
+	containers := []*v1.Container{&spec.InitContainers[0], &spec.Containers[0]}
+	images := []string{v.CAImage, v.Image}
+	for i, c := range containers {
+		if images[i] != "" {
+			c.Image = images[i]
+		}
+		switch {
+		case v.ImagePullPolicy != "":
+			c.ImagePullPolicy = v.ImagePullPolicy
+		case strings.Contains(c.Image, "@"):
+			// a digest never changes, so there's nothing new to pull
+			c.ImagePullPolicy = v1.PullIfNotPresent
+		}
+		if v.Resources != nil {
+			c.Resources = *v.Resources
+		}
+	}
+	for _, secret := range v.ImagePullSecrets {
+		spec.ImagePullSecrets = append(spec.ImagePullSecrets, v1.LocalObjectReference{Name: secret})
+	}
+	if v.Replicas != nil {
+		deployment.Spec.Replicas = v.Replicas
+	}
+	spec.NodeSelector = v.NodeSelector
+	spec.Tolerations = v.Tolerations
+	spec.PriorityClassName = v.PriorityClassName
+	spec.SecurityContext = v.PodSecurityContext
+	return nil
+}
+
+// applyConfiguration customizes the webhook configuration with v.
+func (v WebhookValues) applyConfiguration(config *admissionregistrationv1.MutatingWebhookConfiguration) {
+	for i := range config.Webhooks {
+		w := &config.Webhooks[i]
+		if v.FailurePolicy != "" {
+			policy := v.FailurePolicy
+			w.FailurePolicy = &policy
+		}
+		if v.TimeoutSeconds != nil {
+			w.TimeoutSeconds = v.TimeoutSeconds
+		}
+		if v.ObjectSelector != nil {
+			w.ObjectSelector = v.ObjectSelector
+		}
+	}
+}
@@ -0,0 +1,194 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestLoadWebhookValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  string
+		want    WebhookValues
+		wantErr bool
+	}{
+		{
+			name: "valid",
+			values: `
+image: registry.example.com/webhook@sha256:1234
+imagePullSecrets: [regcred]
+resources:
+  requests:
+    cpu: 100m
+tolerations:
+  - key: dedicated
+    operator: Exists
+`,
+			want: WebhookValues{
+				Image:            "registry.example.com/webhook@sha256:1234",
+				ImagePullSecrets: []string{"regcred"},
+				Resources:        &v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("100m")}},
+				Tolerations:      []v1.Toleration{{Key: "dedicated", Operator: v1.TolerationOpExists}},
+			},
+		},
+		{
+			name:    "unknown field",
+			values:  "imagePullSecret: regcred\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "values.yaml")
+			if err := os.WriteFile(path, []byte(tt.values), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadWebhookValues(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadWebhookValues() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("LoadWebhookValues() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWebhookValues_Apply(t *testing.T) {
+	zero := int32(0)
+	tests := []struct {
+		name       string
+		values     WebhookValues
+		override   WebhookValues
+		wantImages []string
+		wantPolicy v1.PullPolicy
+		wantErr    bool
+	}{
+		{
+			name:       "defaults",
+			wantImages: []string{"adiprerepa/cost-analyzer-mutating-webhook-ca:latest", "adiprerepa/cost-analyzer-mutating-webhook:latest"},
+			wantPolicy: v1.PullAlways,
+		},
+		{
+			name:       "pinned digests",
+			values:     WebhookValues{Image: "registry.example.com/webhook:v1", CAImage: "registry.example.com/ca@sha256:1234"},
+			override:   WebhookValues{Image: "registry.example.com/webhook@sha256:5678"},
+			wantImages: []string{"registry.example.com/ca@sha256:1234", "registry.example.com/webhook@sha256:5678"},
+			wantPolicy: v1.PullIfNotPresent,
+		},
+		{
+			name:    "bad pull policy",
+			values:  WebhookValues{ImagePullPolicy: "Sometimes"},
+			wantErr: true,
+		},
+		{
+			name:    "no replicas",
+			values:  WebhookValues{Replicas: &zero},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values := tt.values
+			values.Override(tt.override)
+			objects, err := NewSetupObjects(SetupConfig{AnalyzerNamespace: "istio-system", Webhook: values})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSetupObjects() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			spec := objects.Deployment.Spec.Template.Spec
+			for i, c := range []v1.Container{spec.InitContainers[0], spec.Containers[0]} {
+				if c.Image != tt.wantImages[i] || c.ImagePullPolicy != tt.wantPolicy {
+					t.Errorf("container %v = %v %v, want %v %v", c.Name, c.Image, c.ImagePullPolicy, tt.wantImages[i], tt.wantPolicy)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookValues_ApplyConfiguration(t *testing.T) {
+	two, ten, sixty := int32(2), int32(10), int32(60)
+	system := &metav1.LabelSelector{MatchLabels: map[string]string{"tier": "app"}}
+	tests := []struct {
+		name        string
+		values      WebhookValues
+		wantPolicy  admissionregistrationv1.FailurePolicyType
+		wantTimeout int32
+		wantExclude bool
+		wantPDB     bool
+		wantErr     bool
+	}{
+		{
+			name:        "defaults",
+			wantPolicy:  admissionregistrationv1.Ignore,
+			wantTimeout: 5,
+			wantExclude: true,
+		},
+		{
+			name:        "fail closed with replicas",
+			values:      WebhookValues{FailurePolicy: admissionregistrationv1.Fail, TimeoutSeconds: &ten, Replicas: &two, ObjectSelector: system},
+			wantPolicy:  admissionregistrationv1.Fail,
+			wantTimeout: 10,
+			wantPDB:     true,
+		},
+		{
+			name:    "bad failure policy",
+			values:  WebhookValues{FailurePolicy: "Retry"},
+			wantErr: true,
+		},
+		{
+			name:    "timeout too long",
+			values:  WebhookValues{TimeoutSeconds: &sixty},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, err := NewSetupObjects(SetupConfig{AnalyzerNamespace: "istio-system", Webhook: tt.values})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSetupObjects() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			w := objects.WebhookConfiguration.Webhooks[0]
+			if *w.FailurePolicy != tt.wantPolicy || *w.TimeoutSeconds != tt.wantTimeout {
+				t.Errorf("failurePolicy, timeoutSeconds = %v, %v, want %v, %v", *w.FailurePolicy, *w.TimeoutSeconds, tt.wantPolicy, tt.wantTimeout)
+			}
+			exclude := len(w.ObjectSelector.MatchExpressions) == 1 && w.ObjectSelector.MatchExpressions[0].Key == ExcludeLabel
+			if exclude != tt.wantExclude {
+				t.Errorf("objectSelector = %v, want the %v label excluded: %v", w.ObjectSelector, ExcludeLabel, tt.wantExclude)
+			}
+			excluded := w.NamespaceSelector.MatchExpressions[0].Values
+			if excluded[len(excluded)-1] != "istio-system" {
+				t.Errorf("namespaces excluded = %v, want the analyzer namespace", excluded)
+			}
+			if (objects.PodDisruptionBudget != nil) != tt.wantPDB {
+				t.Errorf("pod disruption budget = %v, want %v", objects.PodDisruptionBudget, tt.wantPDB)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+// WorkloadKind is a kind of workload with a pod template, that the webhook adds the
+// destination_locality stat tag to.
+type WorkloadKind struct {
+	Group    string `json:"group,omitempty"`
+	Version  string `json:"version"`
+	Kind     string `json:"kind"`
+	Resource string `json:"resource"`
+	// TemplatePath is the dot-separated path of the pod template in the object, like
+	// spec.template.
+	TemplatePath string `json:"templatePath"`
+	// Immutable kinds can't have their pod template changed once created, so only new ones
+	// are handled.
+	Immutable bool `json:"immutable,omitempty"`
+}
+
+// DefaultWorkloadKinds are the built-in kinds of workloads the webhook handles. Others, like
+// Argo Rollouts, can be added with the workloadKinds webhook value.
+var DefaultWorkloadKinds = []WorkloadKind{
+	{Group: "apps", Version: "v1", Kind: "Deployment", Resource: "deployments", TemplatePath: "spec.template"},
+	{Group: "apps", Version: "v1", Kind: "StatefulSet", Resource: "statefulsets", TemplatePath: "spec.template"},
+	{Group: "apps", Version: "v1", Kind: "DaemonSet", Resource: "daemonsets", TemplatePath: "spec.template"},
+	{Group: "batch", Version: "v1", Kind: "Job", Resource: "jobs", TemplatePath: "spec.template", Immutable: true},
+	{Group: "batch", Version: "v1", Kind: "CronJob", Resource: "cronjobs", TemplatePath: "spec.jobTemplate.spec.template"},
+}
+
+// WorkloadKinds returns DefaultWorkloadKinds and extra, which replace the default kinds of
+// the same resource.
+func WorkloadKinds(extra []WorkloadKind) []WorkloadKind {
+	kinds := make([]WorkloadKind, 0, len(DefaultWorkloadKinds)+len(extra))
+	for _, d := range DefaultWorkloadKinds {
+		replaced := false
+		for _, e := range extra {
+			replaced = replaced || e.GroupVersionResource().GroupResource() == d.GroupVersionResource().GroupResource()
+		}
+		if !replaced {
+			kinds = append(kinds, d)
+		}
+	}
+	return append(kinds, extra...)
+}
+
+// GroupVersionResource returns the resource of the kind.
+func (w WorkloadKind) GroupVersionResource() schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: w.Group, Version: w.Version, Resource: w.Resource}
+}
+
+// annotationFields returns the fields of the annotations of the pod template.
+func (w WorkloadKind) annotationFields() []string {
+	return append(strings.Split(w.TemplatePath, "."), "metadata", "annotations")
+}
+
+func (w WorkloadKind) validate() error {
+	if w.Version == "" || w.Kind == "" || w.Resource == "" || w.TemplatePath == "" {
+		return fmt.Errorf("workload kind %+v must have a version, kind, resource and templatePath", w)
+	}
+	for _, field := range strings.Split(w.TemplatePath, ".") {
+		if field == "" {
+			return fmt.Errorf("invalid templatePath %q of workload kind %v", w.TemplatePath, w.Kind)
+		}
+	}
+	return nil
+}
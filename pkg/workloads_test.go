@@ -0,0 +1,109 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pkg
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/util/json"
+)
+
+var rolloutKind = WorkloadKind{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout", Resource: "rollouts", TemplatePath: "spec.template"}
+
+func TestSetupObjects_WorkloadKinds(t *testing.T) {
+	tests := []struct {
+		name          string
+		kinds         []WorkloadKind
+		wantResources []string
+		wantUpdated   []string
+		wantErr       bool
+	}{
+		{
+			name:          "defaults",
+			wantResources: []string{"apps/deployments", "apps/statefulsets", "apps/daemonsets", "batch/jobs", "batch/cronjobs"},
+			wantUpdated:   []string{"apps/deployments,statefulsets,daemonsets", "batch/cronjobs", "/pods"},
+		},
+		{
+			name: "argo rollouts, and jobs replaced",
+			kinds: []WorkloadKind{
+				rolloutKind,
+				{Group: "batch", Version: "v1", Kind: "Job", Resource: "jobs", TemplatePath: "spec.template"},
+			},
+			wantResources: []string{"apps/deployments", "apps/statefulsets", "apps/daemonsets", "batch/cronjobs", "argoproj.io/rollouts", "batch/jobs"},
+			wantUpdated:   []string{"apps/deployments,statefulsets,daemonsets", "batch/cronjobs,jobs", "argoproj.io/rollouts", "/pods"},
+		},
+		{
+			name:    "no template path",
+			kinds:   []WorkloadKind{{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout", Resource: "rollouts", TemplatePath: "spec..template"}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objects, err := NewSetupObjects(SetupConfig{AnalyzerNamespace: "istio-system", TargetNamespaces: []string{"default"}, Webhook: WebhookValues{WorkloadKinds: tt.kinds}})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewSetupObjects() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			resources := make([]string, 0)
+			for _, rule := range objects.WebhookConfiguration.Webhooks[0].Rules {
+				resources = append(resources, rule.APIGroups[0]+"/"+rule.Resources[0])
+			}
+			if !reflect.DeepEqual(resources, tt.wantResources) {
+				t.Errorf("webhook rules for %v, want %v", resources, tt.wantResources)
+			}
+			updated := make([]string, 0)
+			for _, rule := range objects.Roles[1].Rules {
+				updated = append(updated, rule.APIGroups[0]+"/"+strings.Join(rule.Resources, ","))
+			}
+			if !reflect.DeepEqual(updated, tt.wantUpdated) {
+				t.Errorf("workload role for %v, want %v", updated, tt.wantUpdated)
+			}
+			// the webhook gets the kinds to handle from its environment
+			var kinds []WorkloadKind
+			for _, e := range objects.Deployment.Spec.Template.Spec.Containers[0].Env {
+				if e.Name == "WORKLOAD_KINDS" {
+					if err := json.Unmarshal([]byte(e.Value), &kinds); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			if !reflect.DeepEqual(kinds, objects.WorkloadKinds) {
+				t.Errorf("WORKLOAD_KINDS = %v, want %v", kinds, objects.WorkloadKinds)
+			}
+		})
+	}
+}
+
+// TestDefaultWorkloadKinds_Webhook checks the webhook's tests use the kinds setup passes
+// it in WORKLOAD_KINDS, since it has no defaults of its own.
+func TestDefaultWorkloadKinds_Webhook(t *testing.T) {
+	data, err := os.ReadFile("../mutating-webhook/cmd/mutating-webhook/testdata/workload-kinds.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	kinds := make([]WorkloadKind, 0)
+	if err := json.Unmarshal(data, &kinds); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(kinds, DefaultWorkloadKinds) {
+		t.Errorf("webhook test kinds = %v, want %v", kinds, DefaultWorkloadKinds)
+	}
+}
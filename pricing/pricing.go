@@ -0,0 +1,88 @@
+// Copyright 2022 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pricing bundles the default egress price sheets into the binary, so
+// the cost analyzer works without network access to GitHub.
+package pricing
+
+import (
+	_ "embed"
+	"strings"
+)
+
+//go:embed gcp/gcp_pricing.json
+var gcpPricing []byte
+
+//go:embed aws/aws_pricing.json
+var awsPricing []byte
+
+// Sheet is a price sheet embedded in the binary. Version and Date must be bumped
+// whenever the underlying json file is regenerated.
+type Sheet struct {
+	Cloud   string
+	Version string
+	Date    string
+	Data    []byte
+	// Internet holds $/GB internet egress rates by source region. These are the first-tier
+	// list rates; volume tiers aren't modelled. Regions without a rate aren't priced.
+	Internet map[string]float64
+	// Processing holds $/GB charges of network services, like "nat" or "loadBalancer".
+	Processing map[string]float64
+}
+
+var sheets = map[string]Sheet{
+	"GCP": {
+		Cloud:   "GCP",
+		Version: "2022.1",
+		Date:    "2022-04-06",
+		Data:    gcpPricing,
+		// premium tier, worldwide destinations excluding China and Australia, which is the
+		// same from every region
+		Internet: map[string]float64{
+			"asia-east1": 0.12, "asia-east2": 0.12, "asia-northeast1": 0.12, "asia-northeast2": 0.12,
+			"asia-northeast3": 0.12, "asia-south1": 0.12, "asia-southeast1": 0.12,
+			"australia-southeast1": 0.12, "europe-north1": 0.12, "europe-west1": 0.12,
+			"europe-west2": 0.12, "europe-west3": 0.12, "europe-west4": 0.12, "europe-west6": 0.12,
+			"northamerica-northeast1": 0.12, "southamerica-east1": 0.12, "us-central1": 0.12,
+			"us-east1": 0.12, "us-east4": 0.12, "us-west1": 0.12, "us-west2": 0.12, "us-west3": 0.12,
+		},
+		// cloud nat and external https load balancer data processing
+		Processing: map[string]float64{"nat": 0.045, "loadBalancer": 0.008},
+	},
+	"AWS": {
+		Cloud:   "AWS",
+		Version: "2022.1",
+		Date:    "2022-04-06",
+		Data:    awsPricing,
+		// first 10TB/month
+		Internet: map[string]float64{
+			"us-east-1": 0.09, "us-east-2": 0.09, "us-west-1": 0.09, "us-west-2": 0.09,
+			"ca-central-1": 0.09, "eu-central-1": 0.09, "eu-north-1": 0.09, "eu-south-1": 0.09,
+			"eu-west-1": 0.09, "eu-west-2": 0.09, "eu-west-3": 0.09, "ap-east-1": 0.12,
+			"ap-south-1": 0.1093, "ap-northeast-1": 0.114, "ap-northeast-2": 0.126,
+			"ap-northeast-3": 0.114, "ap-southeast-1": 0.12, "ap-southeast-2": 0.114,
+			"ap-southeast-3": 0.132, "sa-east-1": 0.15, "me-south-1": 0.117, "af-south-1": 0.154,
+		},
+		// nat gateway data processing, and network load balancer data processed
+		// (one NLCU per GB)
+		Processing: map[string]float64{"nat": 0.045, "loadBalancer": 0.006},
+	},
+}
+
+// Embedded returns the embedded price sheet for the given cloud (case-insensitive),
+// and whether one exists.
+func Embedded(cloud string) (Sheet, bool) {
+	s, ok := sheets[strings.ToUpper(cloud)]
+	return s, ok
+}